@@ -0,0 +1,77 @@
+// Package dates parses the free-form dates concerts were stored with before
+// they had typed start times.
+package dates
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrUnrecognized is returned for strings in none of the known formats.
+var ErrUnrecognized = errors.New("unrecognized date format")
+
+// layouts are tried in order. Layouts without a zone are read in the
+// location passed to Parse; those without a time mean local midnight.
+var layouts = []string{
+    time.RFC3339,
+    "2006-01-02T15:04:05",
+    "2006-01-02T15:04",
+    "2006-01-02 15:04:05",
+    "2006-01-02 15:04",
+    "2006-01-02",
+    "2006/01/02",
+    "20060102",
+    "02.01.2006",
+    "2.1.2006",
+    "02.01.06",
+    "January 2, 2006",
+    "January 2 2006",
+    "Jan 2, 2006",
+    "Jan 2 2006",
+    "2 January 2006",
+    "2 Jan 2006",
+    "Monday, January 2, 2006",
+    "Mon, Jan 2, 2006",
+    "Monday, 2 January 2006",
+    "Mon, 2 Jan 2006",
+}
+
+// Slash dates are ambiguous: 12/03/2025 is December 3rd in the US and
+// March 12th in most other places.
+var (
+    monthFirst = []string{"01/02/2006", "1/2/2006", "01/02/06", "1/2/06"}
+    dayFirst   = []string{"02/01/2006", "2/1/2006", "02/01/06", "2/1/06"}
+)
+
+// DayFirst reports whether ambiguous slash dates are read day first, as
+// most of the world writes them, or month first with DATE_DAY_FIRST=0. A date
+// that only makes sense the other way round, such as 12/25/2024, is read that
+// way regardless.
+func DayFirst() bool {
+    return os.Getenv("DATE_DAY_FIRST") != "0"
+}
+
+// Parse reads s in one of the common date and date-time formats.
+func Parse(s string, loc *time.Location) (time.Time, error) {
+    s = strings.Join(strings.Fields(s), " ")
+    if s == "" {
+        return time.Time{}, ErrUnrecognized
+    }
+    candidates := layouts
+    if strings.Contains(s, "/") {
+        if DayFirst() {
+            candidates = append(append([]string{}, dayFirst...), monthFirst...)
+        } else {
+            candidates = append(append([]string{}, monthFirst...), dayFirst...)
+        }
+        candidates = append(candidates, layouts...)
+    }
+    for _, layout := range candidates {
+        if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+            return t, nil
+        }
+    }
+    return time.Time{}, ErrUnrecognized
+}
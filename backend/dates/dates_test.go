@@ -0,0 +1,77 @@
+package dates
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+    lisbon, err := time.LoadLocation("Europe/Lisbon")
+    if err != nil {
+        t.Fatal(err)
+    }
+    day := time.Date(2025, time.March, 12, 0, 0, 0, 0, lisbon)
+    evening := time.Date(2025, time.March, 12, 20, 30, 0, 0, lisbon)
+    for _, tc := range []struct {
+        in   string
+        want time.Time
+    }{
+        {"2025-03-12T20:30:00Z", time.Date(2025, time.March, 12, 20, 30, 0, 0, time.UTC)},
+        {"2025-03-12T20:30:00+01:00", time.Date(2025, time.March, 12, 19, 30, 0, 0, time.UTC)},
+        {"2025-03-12T20:30:00", evening},
+        {"2025-03-12T20:30", evening},
+        {"2025-03-12 20:30:00", evening},
+        {"2025-03-12 20:30", evening},
+        {"2025-03-12", day},
+        {"  2025-03-12 ", day},
+        {"2025/03/12", day},
+        {"20250312", day},
+        {"12.03.2025", day},
+        {"12.3.2025", day},
+        {"12.03.25", day},
+        {"March 12, 2025", day},
+        {"March 12 2025", day},
+        {"Mar 12, 2025", day},
+        {"Mar 12 2025", day},
+        {"12 March 2025", day},
+        {"12  Mar   2025", day},
+        {"Wednesday, March 12, 2025", day},
+        {"Wed, Mar 12, 2025", day},
+        {"Wednesday, 12 March 2025", day},
+        {"Wed, 12 Mar 2025", day},
+        // Slash dates are read day first unless only month first works.
+        {"12/03/2025", day},
+        {"12/3/2025", day},
+        {"12/03/25", day},
+        {"3/12/2025", time.Date(2025, time.December, 3, 0, 0, 0, 0, lisbon)},
+        {"03/25/2025", time.Date(2025, time.March, 25, 0, 0, 0, 0, lisbon)},
+    } {
+        got, err := Parse(tc.in, lisbon)
+        if err != nil {
+            t.Errorf("Parse(%q): %v", tc.in, err)
+            continue
+        }
+        if !got.Equal(tc.want) {
+            t.Errorf("Parse(%q) = %s, want %s", tc.in, got, tc.want)
+        }
+    }
+
+    for _, in := range []string{"", "   ", "sometime in spring", "2025-13-01", "32.01.2025", "13/13/2025"} {
+        if got, err := Parse(in, lisbon); err != ErrUnrecognized {
+            t.Errorf("Parse(%q) = %s, %v, want ErrUnrecognized", in, got, err)
+        }
+    }
+}
+
+func TestParseMonthFirst(t *testing.T) {
+    t.Setenv("DATE_DAY_FIRST", "0")
+    for in, want := range map[string]time.Time{
+        "12/03/2025": time.Date(2025, time.December, 3, 0, 0, 0, 0, time.UTC),
+        "25/03/2025": time.Date(2025, time.March, 25, 0, 0, 0, 0, time.UTC),
+    } {
+        got, err := Parse(in, time.UTC)
+        if err != nil || !got.Equal(want) {
+            t.Errorf("Parse(%q) = %s, %v, want %s", in, got, err, want)
+        }
+    }
+}
@@ -4,11 +4,15 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	_ "modernc.org/sqlite"
+
+	"concerts/dates"
 )
 
 var (
@@ -26,8 +30,9 @@ func Init() (*sql.DB, error) {
             return
         }
 
-        // modernc.org/sqlite registers the driver as "sqlite"
-        dsn := fmt.Sprintf("file:%s?cache=shared&mode=rwc", dbPath)
+        // modernc.org/sqlite registers the driver as "sqlite". foreign_keys is a
+        // per-connection setting, so it goes in the DSN for every pooled connection.
+        dsn := fmt.Sprintf("file:%s?cache=shared&mode=rwc&_pragma=foreign_keys(1)", dbPath)
         c, err := sql.Open("sqlite", dsn)
         if err != nil {
             initErr = fmt.Errorf("failed to open sqlite: %w", err)
@@ -105,13 +110,427 @@ func migrate(c *sql.DB) error {
             FOREIGN KEY(concert_id) REFERENCES concerts(id) ON DELETE CASCADE
         );`,
         `CREATE INDEX IF NOT EXISTS idx_songs_concert_id ON songs(concert_id);`,
+        `CREATE TABLE IF NOT EXISTS refresh_tokens (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            user_id INTEGER NOT NULL,
+            family_id TEXT NOT NULL,
+            token_hash TEXT NOT NULL UNIQUE,
+            created_at INTEGER NOT NULL,
+            expires_at INTEGER NOT NULL,
+            used_at INTEGER,
+            revoked_at INTEGER,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+        `CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id);`,
+        `CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id);`,
+        `CREATE TABLE IF NOT EXISTS revoked_tokens (
+            jti TEXT PRIMARY KEY,
+            user_id INTEGER NOT NULL,
+            expires_at INTEGER NOT NULL,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+        `CREATE INDEX IF NOT EXISTS idx_revoked_tokens_expires_at ON revoked_tokens(expires_at);`,
+        `CREATE TABLE IF NOT EXISTS one_time_tokens (
+            token_hash TEXT PRIMARY KEY,
+            user_id INTEGER NOT NULL,
+            purpose TEXT NOT NULL,
+            created_at INTEGER NOT NULL,
+            expires_at INTEGER NOT NULL,
+            used_at INTEGER,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+        `CREATE INDEX IF NOT EXISTS idx_one_time_tokens_user_purpose ON one_time_tokens(user_id, purpose);`,
+        `CREATE TABLE IF NOT EXISTS recovery_codes (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            user_id INTEGER NOT NULL,
+            code_hash TEXT NOT NULL,
+            used_at INTEGER,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+        `CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes(user_id);`,
+        `CREATE TABLE IF NOT EXISTS api_tokens (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            user_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            token_hash TEXT NOT NULL UNIQUE,
+            token_prefix TEXT NOT NULL,
+            scopes TEXT NOT NULL,
+            created_at INTEGER NOT NULL,
+            last_used_at INTEGER,
+            expires_at INTEGER,
+            revoked_at INTEGER,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+        `CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);`,
+        `CREATE TABLE IF NOT EXISTS user_identities (
+            provider TEXT NOT NULL,
+            subject TEXT NOT NULL,
+            user_id INTEGER NOT NULL,
+            email TEXT,
+            created_at INTEGER NOT NULL,
+            PRIMARY KEY(provider, subject),
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+        `CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id);`,
+        `CREATE TABLE IF NOT EXISTS oidc_login_states (
+            state_hash TEXT PRIMARY KEY,
+            provider TEXT NOT NULL,
+            nonce TEXT NOT NULL,
+            code_verifier TEXT NOT NULL,
+            expires_at INTEGER NOT NULL
+        );`,
+        `CREATE TABLE IF NOT EXISTS login_attempts (
+            key TEXT PRIMARY KEY,
+            failures INTEGER NOT NULL,
+            locked_until INTEGER NOT NULL DEFAULT 0,
+            last_failure_at INTEGER NOT NULL
+        );`,
+        `CREATE TABLE IF NOT EXISTS invites (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            code_hash TEXT NOT NULL UNIQUE,
+            code_prefix TEXT NOT NULL,
+            created_by INTEGER NOT NULL,
+            created_at INTEGER NOT NULL,
+            expires_at INTEGER NOT NULL,
+            max_uses INTEGER NOT NULL,
+            uses INTEGER NOT NULL DEFAULT 0,
+            revoked_at INTEGER,
+            FOREIGN KEY(created_by) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+        `CREATE INDEX IF NOT EXISTS idx_invites_created_by ON invites(created_by);`,
+        `CREATE TABLE IF NOT EXISTS sessions (
+            id TEXT PRIMARY KEY,
+            user_id INTEGER NOT NULL,
+            user_agent TEXT NOT NULL,
+            ip TEXT NOT NULL,
+            created_at INTEGER NOT NULL,
+            last_seen_at INTEGER NOT NULL,
+            expires_at INTEGER NOT NULL,
+            revoked_at INTEGER,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+        `CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);`,
+        `CREATE TABLE IF NOT EXISTS webauthn_credentials (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            user_id INTEGER NOT NULL,
+            credential_id TEXT NOT NULL UNIQUE,
+            public_key BLOB NOT NULL,
+            algorithm INTEGER NOT NULL,
+            sign_count INTEGER NOT NULL DEFAULT 0,
+            name TEXT NOT NULL,
+            transports TEXT NOT NULL DEFAULT '',
+            backup_eligible INTEGER NOT NULL DEFAULT 0,
+            backed_up INTEGER NOT NULL DEFAULT 0,
+            created_at INTEGER NOT NULL,
+            last_used_at INTEGER,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+        `CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user_id ON webauthn_credentials(user_id);`,
+        `CREATE TABLE IF NOT EXISTS webauthn_challenges (
+            challenge_hash TEXT PRIMARY KEY,
+            user_id INTEGER,
+            purpose TEXT NOT NULL,
+            expires_at INTEGER NOT NULL,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+        `CREATE TABLE IF NOT EXISTS venues (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            user_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            address TEXT NOT NULL DEFAULT '',
+            city TEXT NOT NULL DEFAULT '',
+            country TEXT NOT NULL DEFAULT '',
+            capacity INTEGER,
+            latitude REAL,
+            longitude REAL,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+        `CREATE INDEX IF NOT EXISTS idx_venues_user_id ON venues(user_id);`,
+        `CREATE TABLE IF NOT EXISTS artists (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            user_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+        `CREATE UNIQUE INDEX IF NOT EXISTS idx_artists_user_name ON artists(user_id, name COLLATE NOCASE);`,
+        `CREATE TABLE IF NOT EXISTS lineup_entries (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            concert_id INTEGER NOT NULL,
+            artist_id INTEGER NOT NULL,
+            role TEXT NOT NULL,
+            position INTEGER NOT NULL DEFAULT 0,
+            set_starts_at INTEGER,
+            set_ends_at INTEGER,
+            UNIQUE(concert_id, artist_id),
+            FOREIGN KEY(concert_id) REFERENCES concerts(id) ON DELETE CASCADE,
+            FOREIGN KEY(artist_id) REFERENCES artists(id) ON DELETE CASCADE
+        );`,
+        `CREATE INDEX IF NOT EXISTS idx_lineup_entries_artist_id ON lineup_entries(artist_id);`,
+        // The audit log outlives the accounts it mentions, so user_id is not a
+        // foreign key, and the triggers make it append-only.
+        `CREATE TABLE IF NOT EXISTS auth_events (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            created_at INTEGER NOT NULL,
+            event TEXT NOT NULL,
+            outcome TEXT NOT NULL,
+            user_id INTEGER,
+            username TEXT,
+            actor_id INTEGER,
+            ip TEXT NOT NULL,
+            user_agent TEXT NOT NULL,
+            detail TEXT NOT NULL DEFAULT ''
+        );`,
+        `CREATE INDEX IF NOT EXISTS idx_auth_events_user_id ON auth_events(user_id, id);`,
+        `CREATE INDEX IF NOT EXISTS idx_auth_events_created_at ON auth_events(created_at);`,
+        `CREATE TRIGGER IF NOT EXISTS auth_events_no_update BEFORE UPDATE ON auth_events
+         BEGIN SELECT RAISE(ABORT, 'auth_events is append-only'); END;`,
+        `CREATE TRIGGER IF NOT EXISTS auth_events_no_delete BEFORE DELETE ON auth_events
+         BEGIN SELECT RAISE(ABORT, 'auth_events is append-only'); END;`,
     }
     for _, s := range stmts {
         if _, err := c.Exec(s); err != nil {
             return fmt.Errorf("migration failed: %w", err)
         }
     }
+
+    // Columns added to tables that may already exist.
+    columns := []struct {
+        table, column, definition string
+    }{
+        {"users", "email", "TEXT"},
+        {"users", "totp_secret", "TEXT"},
+        {"users", "totp_enabled", "INTEGER NOT NULL DEFAULT 0"},
+        {"users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+        {"users", "role", "TEXT NOT NULL DEFAULT 'user'"},
+        {"users", "disabled_at", "INTEGER"},
+        {"users", "email_verified_at", "INTEGER"},
+        {"users", "verification_pending", "INTEGER NOT NULL DEFAULT 0"},
+        {"users", "invite_id", "INTEGER"},
+        {"users", "display_name", "TEXT"},
+        {"users", "timezone", "TEXT"},
+        {"users", "locale", "TEXT"},
+        {"users", "avatar_url", "TEXT"},
+        {"users", "webauthn_handle", "TEXT"},
+        {"users", "token_generation", "INTEGER NOT NULL DEFAULT 0"},
+        {"concerts", "starts_at", "INTEGER"},
+        {"concerts", "ends_at", "INTEGER"},
+        {"concerts", "timezone", "TEXT"},
+        {"concerts", "venue_id", "INTEGER REFERENCES venues(id) ON DELETE SET NULL"},
+        {"oidc_login_states", "session_mode", "TEXT NOT NULL DEFAULT 'bearer'"},
+    }
+    for _, col := range columns {
+        if err := addColumn(c, col.table, col.column, col.definition); err != nil {
+            return fmt.Errorf("migration failed: %w", err)
+        }
+    }
+
+    post := []string{
+        `CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users(email) WHERE email IS NOT NULL;`,
+        `CREATE UNIQUE INDEX IF NOT EXISTS idx_users_webauthn_handle ON users(webauthn_handle) WHERE webauthn_handle IS NOT NULL;`,
+        `CREATE INDEX IF NOT EXISTS idx_concerts_user_starts_at ON concerts(user_id, starts_at);`,
+        `CREATE INDEX IF NOT EXISTS idx_concerts_venue_id ON concerts(venue_id);`,
+    }
+    for _, s := range post {
+        if _, err := c.Exec(s); err != nil {
+            return fmt.Errorf("migration failed: %w", err)
+        }
+    }
+    if err := dropTokenCutoffs(c); err != nil {
+        return fmt.Errorf("migration failed: %w", err)
+    }
+    if err := backfillConcertTimes(c); err != nil {
+        return fmt.Errorf("migration failed: %w", err)
+    }
+    if err := createSearchIndex(c); err != nil {
+        return fmt.Errorf("migration failed: %w", err)
+    }
     return nil
 }
 
+// searchTokenizer folds case and diacritics, so "lisboa" finds "Lisbôa".
+const searchTokenizer = `tokenize = 'unicode61 remove_diacritics 2'`
+
+// createSearchIndex sets up the FTS5 tables behind /search. concerts_fts holds
+// each concert's title and location plus the titles of its songs, so a search
+// can match a concert by what was played there; songs_fts indexes the songs
+// table itself. Triggers keep both in sync. The tables are filled from
+// existing rows when they are first created.
+func createSearchIndex(c *sql.DB) error {
+    var exists int
+    if err := c.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'concerts_fts'").Scan(&exists); err != nil {
+        return err
+    }
+    const songTitles = `COALESCE((SELECT group_concat(title, ' / ') FROM songs WHERE concert_id = %s), '')`
+    stmts := []string{
+        `CREATE VIRTUAL TABLE IF NOT EXISTS concerts_fts USING fts5(title, location, songs, ` + searchTokenizer + `);`,
+        `CREATE VIRTUAL TABLE IF NOT EXISTS songs_fts USING fts5(title, notes, content = 'songs', content_rowid = 'id', ` + searchTokenizer + `);`,
+        `CREATE TRIGGER IF NOT EXISTS concerts_fts_insert AFTER INSERT ON concerts BEGIN
+            INSERT INTO concerts_fts (rowid, title, location, songs) VALUES (new.id, new.title, new.location, '');
+         END;`,
+        `CREATE TRIGGER IF NOT EXISTS concerts_fts_update AFTER UPDATE OF title, location ON concerts BEGIN
+            UPDATE concerts_fts SET title = new.title, location = new.location WHERE rowid = new.id;
+         END;`,
+        `CREATE TRIGGER IF NOT EXISTS concerts_fts_delete AFTER DELETE ON concerts BEGIN
+            DELETE FROM concerts_fts WHERE rowid = old.id;
+         END;`,
+        `CREATE TRIGGER IF NOT EXISTS songs_fts_insert AFTER INSERT ON songs BEGIN
+            INSERT INTO songs_fts (rowid, title, notes) VALUES (new.id, new.title, new.notes);
+            UPDATE concerts_fts SET songs = ` + fmt.Sprintf(songTitles, "new.concert_id") + ` WHERE rowid = new.concert_id;
+         END;`,
+        `CREATE TRIGGER IF NOT EXISTS songs_fts_update AFTER UPDATE OF title, notes, concert_id ON songs BEGIN
+            INSERT INTO songs_fts (songs_fts, rowid, title, notes) VALUES ('delete', old.id, old.title, old.notes);
+            INSERT INTO songs_fts (rowid, title, notes) VALUES (new.id, new.title, new.notes);
+            UPDATE concerts_fts SET songs = ` + fmt.Sprintf(songTitles, "old.concert_id") + ` WHERE rowid = old.concert_id;
+            UPDATE concerts_fts SET songs = ` + fmt.Sprintf(songTitles, "new.concert_id") + ` WHERE rowid = new.concert_id;
+         END;`,
+        `CREATE TRIGGER IF NOT EXISTS songs_fts_delete AFTER DELETE ON songs BEGIN
+            INSERT INTO songs_fts (songs_fts, rowid, title, notes) VALUES ('delete', old.id, old.title, old.notes);
+            UPDATE concerts_fts SET songs = ` + fmt.Sprintf(songTitles, "old.concert_id") + ` WHERE rowid = old.concert_id;
+         END;`,
+    }
+    if exists == 0 {
+        stmts = append(stmts,
+            `INSERT INTO concerts_fts (rowid, title, location, songs)
+             SELECT id, title, location, `+fmt.Sprintf(songTitles, "concerts.id")+` FROM concerts;`,
+            `INSERT INTO songs_fts (songs_fts) VALUES ('rebuild');`,
+        )
+    }
+    tx, err := c.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    for _, s := range stmts {
+        if _, err := tx.Exec(s); err != nil {
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+// dropTokenCutoffs replaces the time-based user_token_cutoffs table with
+// users.token_generation. Users with a cutoff that may still cover live tokens
+// move to a new generation, which revokes every access token they hold.
+func dropTokenCutoffs(c *sql.DB) error {
+    var exists int
+    if err := c.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'user_token_cutoffs'").Scan(&exists); err != nil {
+        return err
+    }
+    if exists == 0 {
+        return nil
+    }
+    tx, err := c.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    _, err = tx.Exec(
+        "UPDATE users SET token_generation = token_generation + 1 WHERE id IN (SELECT user_id FROM user_token_cutoffs WHERE expires_at > ?)",
+        time.Now().Unix(),
+    )
+    if err != nil {
+        return err
+    }
+    if _, err := tx.Exec("DROP TABLE user_token_cutoffs"); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// backfillConcertTimes derives starts_at for concerts created before it
+// existed by parsing their free-form date in the owner's time zone (UTC if
+// unset). Dates that cannot be parsed are left for the owner to fix and are
+// retried on every start.
+func backfillConcertTimes(c *sql.DB) error {
+    rows, err := c.Query(
+        `SELECT c.id, c.date, COALESCE(c.timezone, u.timezone, '') FROM concerts c
+         JOIN users u ON u.id = c.user_id WHERE c.starts_at IS NULL`,
+    )
+    if err != nil {
+        return err
+    }
+    type update struct {
+        id       int64
+        startsAt int64
+        timezone string
+    }
+    var (
+        updates  []update
+        failures int
+    )
+    for rows.Next() {
+        var (
+            id       int64
+            date, tz string
+        )
+        if err := rows.Scan(&id, &date, &tz); err != nil {
+            rows.Close()
+            return err
+        }
+        loc, err := time.LoadLocation(tz)
+        if err != nil || tz == "" {
+            loc, tz = time.UTC, "UTC"
+        }
+        t, err := dates.Parse(date, loc)
+        if err != nil {
+            failures++
+            continue
+        }
+        updates = append(updates, update{id, t.Unix(), tz})
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    if len(updates) == 0 && failures == 0 {
+        return nil
+    }
+
+    tx, err := c.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    for _, u := range updates {
+        if _, err := tx.Exec("UPDATE concerts SET starts_at = ?, timezone = ? WHERE id = ?", u.startsAt, u.timezone, u.id); err != nil {
+            return err
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        return err
+    }
+    log.Printf("concert dates: backfilled %d, %d could not be parsed and need a starts_at", len(updates), failures)
+    return nil
+}
+
+// addColumn adds a column to an existing table unless it is already present.
+func addColumn(c *sql.DB, table, column, definition string) error {
+    rows, err := c.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var (
+            cid       int
+            name      string
+            ctype     string
+            notNull   int
+            dfltValue sql.NullString
+            pk        int
+        )
+        if err := rows.Scan(&cid, &name, &ctype, &notNull, &dfltValue, &pk); err != nil {
+            return err
+        }
+        if name == column {
+            return nil
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    _, err = c.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+    return err
+}
+
 
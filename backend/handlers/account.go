@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"concerts/db"
+	"concerts/models"
+)
+
+type exportedConcert struct {
+    models.Concert
+    Songs  []models.Song        `json:"songs"`
+    Lineup []models.LineupEntry `json:"lineup"`
+}
+
+// exportSection is one list in an account export. add passes each item to
+// the writer as it is read.
+type exportSection struct {
+    name string
+    add  func(uid int64, a *jsonArray) error
+}
+
+var exportSections = []exportSection{
+    {"concerts", exportConcerts},
+    {"venues", func(uid int64, a *jsonArray) error {
+        return exportPages(venueList, "created", venueColumns, "venues", uid, scanVenue, func(v models.Venue) error { return a.add(v) })
+    }},
+    {"artists", func(uid int64, a *jsonArray) error {
+        return exportPages(artistList, "created", artistColumns, "artists", uid, scanArtist, func(v models.Artist) error { return a.add(v) })
+    }},
+}
+
+// ExportMe downloads the authenticated user's profile, concerts with their
+// songs and lineups, venues and artists, as a ZIP archive by default or as a
+// single JSON document with ?format=json. Rows are written out as they are
+// read, a page at a time, rather than collected first.
+func ExportMe(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    format := r.URL.Query().Get("format")
+    if format == "" {
+        format = "zip"
+    }
+    if format != "zip" && format != "json" {
+        writeError(w, http.StatusBadRequest, errors.New("format must be zip or json"))
+        return
+    }
+    profile, err := loadUser(db.Get(), uid)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    exportedAt := time.Now().Unix()
+
+    name := fmt.Sprintf("concerts-export-%s-%s", profile.Username, time.Unix(exportedAt, 0).UTC().Format("20060102"))
+    if format == "json" {
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".json"))
+        w.WriteHeader(http.StatusOK)
+        // As below, an error leaves the document unfinished.
+        _ = writeExportJSON(w, uid, profile, exportedAt)
+        return
+    }
+    w.Header().Set("Content-Type", "application/zip")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".zip"))
+    w.WriteHeader(http.StatusOK)
+    // Headers are sent; from here on errors can only abort the stream.
+    archive := zip.NewWriter(w)
+    create := func(name string) (io.Writer, error) {
+        return archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Unix(exportedAt, 0)})
+    }
+    fw, err := create("profile.json")
+    if err != nil {
+        return
+    }
+    if err := writeIndentedJSON(fw, profile); err != nil {
+        return
+    }
+    for _, s := range exportSections {
+        fw, err := create(s.name + ".json")
+        if err != nil {
+            return
+        }
+        if err := writeExportSection(fw, "", uid, s); err != nil {
+            return
+        }
+        if _, err := io.WriteString(fw, "\n"); err != nil {
+            return
+        }
+    }
+    _ = archive.Close()
+}
+
+func writeIndentedJSON(w io.Writer, v any) error {
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    return enc.Encode(v)
+}
+
+// writeExportJSON writes the whole export as one JSON object, laid out as
+// writeIndentedJSON would.
+func writeExportJSON(w io.Writer, uid int64, profile models.User, exportedAt int64) error {
+    raw, err := json.MarshalIndent(profile, "  ", "  ")
+    if err != nil {
+        return err
+    }
+    if _, err := fmt.Fprintf(w, "{\n  \"exported_at\": %d,\n  \"profile\": %s", exportedAt, raw); err != nil {
+        return err
+    }
+    for _, s := range exportSections {
+        if _, err := fmt.Fprintf(w, ",\n  %q: ", s.name); err != nil {
+            return err
+        }
+        if err := writeExportSection(w, "  ", uid, s); err != nil {
+            return err
+        }
+    }
+    _, err = io.WriteString(w, "\n}\n")
+    return err
+}
+
+func writeExportSection(w io.Writer, indent string, uid int64, s exportSection) error {
+    a := &jsonArray{w: w, indent: indent}
+    if err := s.add(uid, a); err != nil {
+        return err
+    }
+    return a.close()
+}
+
+// jsonArray writes an indented JSON array one item at a time. indent is the
+// indentation of the line the array starts on.
+type jsonArray struct {
+    w      io.Writer
+    indent string
+    n      int
+}
+
+func (a *jsonArray) add(v any) error {
+    raw, err := json.MarshalIndent(v, a.indent+"  ", "  ")
+    if err != nil {
+        return err
+    }
+    sep := ",\n"
+    if a.n == 0 {
+        sep = "[\n"
+    }
+    a.n++
+    _, err = fmt.Fprintf(a.w, "%s%s  %s", sep, a.indent, raw)
+    return err
+}
+
+func (a *jsonArray) close() error {
+    if a.n == 0 {
+        _, err := io.WriteString(a.w, "[]")
+        return err
+    }
+    _, err := fmt.Fprintf(a.w, "\n%s]", a.indent)
+    return err
+}
+
+// exportPages passes each of the user's rows in table to add, in the given
+// sort. Rows are read a page at a time so that no query stays open while a
+// slow client reads the export.
+func exportPages[T any](spec listSpec, sort, columns, table string, uid int64, scan func(rowScanner) (T, error), add func(T) error) error {
+    q := url.Values{"sort": {sort}, "limit": {strconv.Itoa(maxPageLimit)}}
+    for {
+        page, err := parseListPage(q, spec, sort)
+        if err != nil {
+            return err
+        }
+        list, next, err := queryPage(page, columns, table, []string{"user_id = ?"}, []any{uid}, scan)
+        if err != nil {
+            return err
+        }
+        for _, item := range list {
+            if err := add(item); err != nil {
+                return err
+            }
+        }
+        if next == "" {
+            return nil
+        }
+        q.Set("cursor", next)
+    }
+}
+
+// exportConcerts adds the user's concerts, latest first, each with its songs
+// and lineup.
+func exportConcerts(uid int64, a *jsonArray) error {
+    return exportPages(concertList, "-date", concertColumns, "concerts", uid, scanConcert, func(c models.Concert) error {
+        songs, err := loadSongs(c.ID)
+        if err != nil {
+            return err
+        }
+        lineup, err := loadLineup(c)
+        if err != nil {
+            return err
+        }
+        return a.add(exportedConcert{Concert: c, Songs: songs, Lineup: lineup})
+    })
+}
+
+type deleteMeRequest struct {
+    Password string `json:"password"`
+    // Confirm must repeat the username for accounts without a local
+    // password (e.g. created through OpenID Connect).
+    Confirm string `json:"confirm"`
+}
+
+// deletedCounts lists the rows removed together with an account, by the
+// ON DELETE CASCADE foreign keys.
+var deletedCounts = []struct {
+    name, query string
+}{
+    {"concerts", "SELECT COUNT(*) FROM concerts WHERE user_id = ?"},
+    {"songs", "SELECT COUNT(*) FROM songs s JOIN concerts c ON c.id = s.concert_id WHERE c.user_id = ?"},
+    {"venues", "SELECT COUNT(*) FROM venues WHERE user_id = ?"},
+    {"artists", "SELECT COUNT(*) FROM artists WHERE user_id = ?"},
+    {"api_tokens", "SELECT COUNT(*) FROM api_tokens WHERE user_id = ?"},
+    {"sessions", "SELECT COUNT(DISTINCT family_id) FROM refresh_tokens WHERE user_id = ?"},
+    {"passkeys", "SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = ?"},
+    {"linked_identities", "SELECT COUNT(*) FROM user_identities WHERE user_id = ?"},
+    {"invites", "SELECT COUNT(*) FROM invites WHERE created_by = ?"},
+}
+
+// DeleteMe permanently deletes the authenticated user's account after
+// re-confirming the password, and reports what was removed with it.
+func DeleteMe(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    var req deleteMeRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+
+    connection := db.Get()
+    tx, err := connection.Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+
+    var username, hash string
+    if err := tx.QueryRow("SELECT username, password_hash FROM users WHERE id = ?", uid).Scan(&username, &hash); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if hash == "" {
+        if req.Confirm != username {
+            writeError(w, http.StatusForbidden, errors.New("confirm must match your username"))
+            return
+        }
+    } else if ok, err := verifyPassword(hash, req.Password); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    } else if !ok {
+        writeError(w, http.StatusForbidden, errors.New("password is incorrect"))
+        return
+    }
+
+    removed := map[string]int64{}
+    for _, c := range deletedCounts {
+        var n int64
+        if err := tx.QueryRow(c.query, uid).Scan(&n); err != nil {
+            writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+            return
+        }
+        removed[c.name] = n
+    }
+    if _, err := tx.Exec("DELETE FROM users WHERE id = ?", uid); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db delete error: %w", err))
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    recordAuthEvent(r, authEvent{Event: eventAccountDeleted, Outcome: outcomeSuccess, UserID: uid, Username: username})
+    clearSessionCookies(w)
+    writeJSON(w, http.StatusOK, map[string]any{
+        "deleted": uid,
+        "removed": removed,
+    })
+}
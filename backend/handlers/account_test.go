@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"testing"
+
+	"concerts/db"
+	"concerts/models"
+)
+
+func TestExportMeCoversEveryConcert(t *testing.T) {
+    uid := createUser(t, "exporter", "right password", "")
+    other := createUser(t, "export-bystander", "right password", "")
+    tx, err := db.Get().Begin()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var artistID int64
+    if err := tx.QueryRow("INSERT INTO artists (user_id, name) VALUES (?, 'Headliner') RETURNING id", uid).Scan(&artistID); err != nil {
+        t.Fatal(err)
+    }
+    // More concerts than fit in one page, some without a start time.
+    var want []int64
+    for i := 0; i < maxPageLimit+3; i++ {
+        var startsAt any = 1_700_000_000 + int64(i%7)*86_400
+        if i%10 == 0 {
+            startsAt = nil
+        }
+        var id int64
+        if err := tx.QueryRow(
+            "INSERT INTO concerts (title, date, location, user_id, starts_at, timezone) VALUES ('Show', 'some day', 'Lisbon', ?, ?, 'UTC') RETURNING id",
+            uid, startsAt,
+        ).Scan(&id); err != nil {
+            t.Fatal(err)
+        }
+        want = append(want, id)
+        for _, title := range []string{"Opener", "Closer"} {
+            if _, err := tx.Exec("INSERT INTO songs (title, concert_id, song_order) VALUES (?, ?, ?)", title, id, len(title)); err != nil {
+                t.Fatal(err)
+            }
+        }
+        if _, err := tx.Exec("INSERT INTO lineup_entries (concert_id, artist_id, role) VALUES (?, ?, 'headliner')", id, artistID); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if _, err := tx.Exec("INSERT INTO concerts (title, date, location, user_id) VALUES ('Not mine', 'some day', 'Porto', ?)", other); err != nil {
+        t.Fatal(err)
+    }
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+
+    // Latest first, concerts without a start time last.
+    starts := map[int64]int64{}
+    rows, err := db.Get().Query("SELECT id, COALESCE(starts_at, 0) FROM concerts WHERE user_id = ?", uid)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for rows.Next() {
+        var id, s int64
+        if err := rows.Scan(&id, &s); err != nil {
+            t.Fatal(err)
+        }
+        starts[id] = s
+    }
+    rows.Close()
+    slices.SortFunc(want, func(a, b int64) int {
+        if starts[a] != starts[b] {
+            return int(starts[b] - starts[a])
+        }
+        return int(b - a)
+    })
+
+    check := func(format string, concerts []exportedConcert) {
+        t.Helper()
+        got := make([]int64, len(concerts))
+        for i, c := range concerts {
+            got[i] = c.ID
+            if len(c.Songs) != 2 || c.Songs[0].Title != "Opener" || len(c.Lineup) != 1 || c.Lineup[0].ArtistName != "Headliner" {
+                t.Fatalf("%s: concert %d exported with songs %v and lineup %v", format, c.ID, c.Songs, c.Lineup)
+            }
+        }
+        if !slices.Equal(got, want) {
+            t.Fatalf("%s: exported concerts %v, want %v", format, got, want)
+        }
+    }
+
+    w := call(t, asUser(uid, ExportMe), http.MethodGet, "/me/export?format=json", "192.0.2.180", nil)
+    expectStatus(t, w, http.StatusOK)
+    var export struct {
+        Profile  models.User       `json:"profile"`
+        Concerts []exportedConcert `json:"concerts"`
+        Venues   []models.Venue    `json:"venues"`
+        Artists  []models.Artist   `json:"artists"`
+    }
+    decode(t, w, &export)
+    if export.Profile.Username != "exporter" || export.Venues == nil || len(export.Artists) != 1 {
+        t.Fatalf("unexpected export %+v", export)
+    }
+    check("json", export.Concerts)
+
+    w = call(t, asUser(uid, ExportMe), http.MethodGet, "/me/export", "192.0.2.180", nil)
+    expectStatus(t, w, http.StatusOK)
+    archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var names []string
+    var concerts []exportedConcert
+    for _, f := range archive.File {
+        names = append(names, f.Name)
+        r, err := f.Open()
+        if err != nil {
+            t.Fatal(err)
+        }
+        raw, err := io.ReadAll(r)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !json.Valid(raw) {
+            t.Fatalf("%s is not valid JSON: %s", f.Name, raw)
+        }
+        if f.Name == "concerts.json" {
+            if err := json.Unmarshal(raw, &concerts); err != nil {
+                t.Fatal(err)
+            }
+        }
+    }
+    if !slices.Equal(names, []string{"profile.json", "concerts.json", "venues.json", "artists.json"}) {
+        t.Fatalf("archive holds %v", names)
+    }
+    check("zip", concerts)
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"concerts/db"
+	"concerts/models"
+)
+
+// BootstrapAdmin grants the admin role to an existing user, so that a fresh
+// instance has someone who can manage the others.
+func BootstrapAdmin(username string) error {
+    res, err := db.Get().Exec("UPDATE users SET role = ? WHERE username = ?", RoleAdmin, username)
+    if err != nil {
+        return fmt.Errorf("db update error: %w", err)
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        log.Printf("bootstrap admin %q does not exist yet; register it and restart", username)
+    }
+    return nil
+}
+
+// AdminListUsers returns every user account.
+func AdminListUsers(w http.ResponseWriter, r *http.Request) {
+    rows, err := db.Get().Query("SELECT " + userColumns + " FROM users ORDER BY id ASC")
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    defer rows.Close()
+    list := []models.User{}
+    for rows.Next() {
+        u, err := scanUser(rows)
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, fmt.Errorf("db scan error: %w", err))
+            return
+        }
+        list = append(list, u)
+    }
+    writeJSON(w, http.StatusOK, list)
+}
+
+// AdminDisableUser blocks a user from logging in and signs out all their sessions.
+func AdminDisableUser(w http.ResponseWriter, r *http.Request) {
+    target, ok := adminTarget(w, r)
+    if !ok {
+        return
+    }
+    connection := db.Get()
+    res, err := connection.Exec("UPDATE users SET disabled_at = ? WHERE id = ? AND disabled_at IS NULL", time.Now().Unix(), target)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        writeError(w, http.StatusNotFound, errors.New("user not found or already disabled"))
+        return
+    }
+    if err := revokeAllSessions(connection, target); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    recordAdminEvent(r, eventUserDisabled, target, "")
+    writeJSON(w, http.StatusOK, map[string]any{"disabled": target})
+}
+
+// AdminEnableUser re-enables a disabled user.
+func AdminEnableUser(w http.ResponseWriter, r *http.Request) {
+    target, ok := adminTarget(w, r)
+    if !ok {
+        return
+    }
+    res, err := db.Get().Exec("UPDATE users SET disabled_at = NULL WHERE id = ? AND disabled_at IS NOT NULL", target)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        writeError(w, http.StatusNotFound, errors.New("user not found or not disabled"))
+        return
+    }
+    recordAdminEvent(r, eventUserEnabled, target, "")
+    writeJSON(w, http.StatusOK, map[string]any{"enabled": target})
+}
+
+// AdminDeleteUser deletes a user together with all of their data.
+func AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+    target, ok := adminTarget(w, r)
+    if !ok {
+        return
+    }
+    var username string
+    err := db.Get().QueryRow("DELETE FROM users WHERE id = ? RETURNING username", target).Scan(&username)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            writeError(w, http.StatusNotFound, sql.ErrNoRows)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db delete error: %w", err))
+        return
+    }
+    actor, _ := UserIDFromContext(r.Context())
+    recordAuthEvent(r, authEvent{Event: eventUserDeleted, Outcome: outcomeSuccess, UserID: target, Username: username, ActorID: actor})
+    writeJSON(w, http.StatusOK, map[string]any{"deleted": target})
+}
+
+type setRoleRequest struct {
+    Role string `json:"role"`
+}
+
+// AdminSetUserRole changes a user's role.
+func AdminSetUserRole(w http.ResponseWriter, r *http.Request) {
+    target, ok := adminTarget(w, r)
+    if !ok {
+        return
+    }
+    var req setRoleRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    if req.Role != RoleUser && req.Role != RoleAdmin {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("role must be %q or %q", RoleUser, RoleAdmin))
+        return
+    }
+    res, err := db.Get().Exec("UPDATE users SET role = ? WHERE id = ?", req.Role, target)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        writeError(w, http.StatusNotFound, sql.ErrNoRows)
+        return
+    }
+    recordAdminEvent(r, eventRoleChanged, target, req.Role)
+    writeJSON(w, http.StatusOK, map[string]any{"id": target, "role": req.Role})
+}
+
+// AdminUnlockUser clears a login lockout on the user's account.
+func AdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+    target, ok := adminTarget(w, r)
+    if !ok {
+        return
+    }
+    if err := unlockUser(target); err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            writeError(w, http.StatusNotFound, sql.ErrNoRows)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    recordAdminEvent(r, eventUserUnlocked, target, "")
+    writeJSON(w, http.StatusOK, map[string]any{"unlocked": target})
+}
+
+// adminTarget parses the {id} route variable. Admins cannot act on their own
+// account here, which keeps at least one admin able to log in.
+func adminTarget(w http.ResponseWriter, r *http.Request) (int64, bool) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return 0, false
+    }
+    target, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("invalid id"))
+        return 0, false
+    }
+    if target == uid {
+        writeError(w, http.StatusBadRequest, errors.New("cannot change your own account via the admin API"))
+        return 0, false
+    }
+    return target, true
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"concerts/db"
+	"concerts/models"
+)
+
+// Scopes that can be granted to personal access tokens.
+const (
+    ScopeConcertsRead  = "concerts:read"
+    ScopeConcertsWrite = "concerts:write"
+    ScopeSongsRead     = "songs:read"
+    ScopeSongsWrite    = "songs:write"
+)
+
+// ScopeAccount guards account management routes. It is never granted to
+// personal access tokens, so those routes require an interactive session.
+const ScopeAccount = "account"
+
+var grantableScopes = []string{ScopeConcertsRead, ScopeConcertsWrite, ScopeSongsRead, ScopeSongsWrite}
+
+const (
+    apiTokenPrefix       = "cpat_"
+    apiTokenDisplayChars = 8
+    maxAPITokenNameLen   = 100
+    // lastUsedResolution limits how often last_used_at is written.
+    lastUsedResolution = time.Minute
+)
+
+var errAPITokenInvalid = errors.New("invalid token")
+
+// authenticateAPIToken resolves a personal access token to its user and scopes.
+func authenticateAPIToken(raw string) (int64, []string, error) {
+    connection := db.Get()
+    var (
+        id        int64
+        uid       int64
+        scopes    string
+        expiresAt sql.NullInt64
+        revokedAt sql.NullInt64
+    )
+    err := connection.QueryRow(
+        "SELECT id, user_id, scopes, expires_at, revoked_at FROM api_tokens WHERE token_hash = ?",
+        hashToken(raw),
+    ).Scan(&id, &uid, &scopes, &expiresAt, &revokedAt)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return 0, nil, errAPITokenInvalid
+        }
+        return 0, nil, fmt.Errorf("db query error: %w", err)
+    }
+    now := time.Now()
+    if revokedAt.Valid || (expiresAt.Valid && now.Unix() >= expiresAt.Int64) {
+        return 0, nil, errAPITokenInvalid
+    }
+    _, err = connection.Exec(
+        "UPDATE api_tokens SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)",
+        now.Unix(), id, now.Add(-lastUsedResolution).Unix(),
+    )
+    if err != nil {
+        return 0, nil, fmt.Errorf("db update error: %w", err)
+    }
+    return uid, strings.Fields(scopes), nil
+}
+
+// RequireScope rejects requests authenticated with a personal access token
+// that was not granted scope. Session tokens carry every scope.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if !hasScope(r.Context(), scope) {
+                writeError(w, http.StatusForbidden, fmt.Errorf("token lacks required scope %q", scope))
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// hasScope reports whether the request's credentials carry scope.
+func hasScope(ctx context.Context, scope string) bool {
+    scopes, ok := tokenScopesFromContext(ctx)
+    return !ok || slices.Contains(scopes, scope)
+}
+
+// Scoped wraps a single handler with RequireScope.
+func Scoped(scope string, h http.HandlerFunc) http.Handler {
+    return RequireScope(scope)(h)
+}
+
+// ListAPITokens returns the authenticated user's active personal access tokens.
+func ListAPITokens(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    connection := db.Get()
+    rows, err := connection.Query(
+        `SELECT id, name, token_prefix, scopes, created_at, last_used_at, expires_at FROM api_tokens
+         WHERE user_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)
+         ORDER BY created_at DESC, id DESC`,
+        uid, time.Now().Unix(),
+    )
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    defer rows.Close()
+    list := []models.APIToken{}
+    for rows.Next() {
+        var (
+            t          models.APIToken
+            scopes     string
+            lastUsedAt sql.NullInt64
+            expiresAt  sql.NullInt64
+        )
+        if err := rows.Scan(&t.ID, &t.Name, &t.Prefix, &scopes, &t.CreatedAt, &lastUsedAt, &expiresAt); err != nil {
+            writeError(w, http.StatusInternalServerError, fmt.Errorf("db scan error: %w", err))
+            return
+        }
+        t.Scopes = strings.Fields(scopes)
+        if lastUsedAt.Valid {
+            t.LastUsedAt = &lastUsedAt.Int64
+        }
+        if expiresAt.Valid {
+            t.ExpiresAt = &expiresAt.Int64
+        }
+        list = append(list, t)
+    }
+    writeJSON(w, http.StatusOK, list)
+}
+
+type createAPITokenRequest struct {
+    Name          string   `json:"name"`
+    Scopes        []string `json:"scopes"`
+    ExpiresInDays int      `json:"expires_in_days"`
+}
+
+// CreateAPIToken creates a personal access token. The plaintext token is only
+// included in this response.
+func CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    var req createAPITokenRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    name := strings.TrimSpace(req.Name)
+    if name == "" || len(name) > maxAPITokenNameLen {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("name is required and must be <=%d characters", maxAPITokenNameLen))
+        return
+    }
+    if len(req.Scopes) == 0 {
+        writeError(w, http.StatusBadRequest, errors.New("at least one scope is required"))
+        return
+    }
+    var scopes []string
+    for _, s := range req.Scopes {
+        if !slices.Contains(grantableScopes, s) {
+            writeError(w, http.StatusBadRequest, fmt.Errorf("unknown scope %q, allowed: %s", s, strings.Join(grantableScopes, ", ")))
+            return
+        }
+        if !slices.Contains(scopes, s) {
+            scopes = append(scopes, s)
+        }
+    }
+    if req.ExpiresInDays < 0 {
+        writeError(w, http.StatusBadRequest, errors.New("expires_in_days must be positive"))
+        return
+    }
+
+    secret, err := randomToken(32)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate token: %w", err))
+        return
+    }
+    raw := apiTokenPrefix + secret
+    now := time.Now()
+    var expiresAt *int64
+    if req.ExpiresInDays > 0 {
+        exp := now.AddDate(0, 0, req.ExpiresInDays).Unix()
+        expiresAt = &exp
+    }
+    token := models.APIToken{
+        Name:      name,
+        Prefix:    raw[:len(apiTokenPrefix)+apiTokenDisplayChars],
+        Scopes:    scopes,
+        CreatedAt: now.Unix(),
+        ExpiresAt: expiresAt,
+    }
+    res, err := db.Get().Exec(
+        "INSERT INTO api_tokens (user_id, name, token_hash, token_prefix, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+        uid, token.Name, hashToken(raw), token.Prefix, strings.Join(scopes, " "), token.CreatedAt, expiresAt,
+    )
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db insert error: %w", err))
+        return
+    }
+    token.ID, _ = res.LastInsertId()
+    writeJSON(w, http.StatusCreated, map[string]any{
+        "token":     raw,
+        "api_token": token,
+    })
+}
+
+// RevokeAPIToken revokes one of the authenticated user's personal access tokens.
+func RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    tid, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("invalid id"))
+        return
+    }
+    res, err := db.Get().Exec("UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL", time.Now().Unix(), tid, uid)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+        return
+    }
+    n, _ := res.RowsAffected()
+    if n == 0 {
+        writeError(w, http.StatusNotFound, sql.ErrNoRows)
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{"revoked": tid})
+}
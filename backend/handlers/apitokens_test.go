@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// createAPIToken mints a personal access token for uid and returns it.
+func createAPIToken(t *testing.T, uid int64) string {
+    t.Helper()
+    w := call(t, asUser(uid, CreateAPIToken), http.MethodPost, "/tokens", "192.0.2.120", createAPITokenRequest{Name: "cli", Scopes: []string{ScopeConcertsRead}})
+    expectStatus(t, w, http.StatusCreated)
+    var res struct {
+        Token string `json:"token"`
+    }
+    decode(t, w, &res)
+    if _, _, err := authenticateAPIToken(res.Token); err != nil {
+        t.Fatalf("fresh token rejected: %v", err)
+    }
+    return res.Token
+}
+
+func expectAPITokenRevoked(t *testing.T, raw string) {
+    t.Helper()
+    if _, _, err := authenticateAPIToken(raw); !errors.Is(err, errAPITokenInvalid) {
+        t.Fatalf("token still accepted, err = %v", err)
+    }
+}
+
+func TestRecoveryRevokesAPITokens(t *testing.T) {
+    uid := createUser(t, "pat-logout-all", "right password", "")
+    token := createAPIToken(t, uid)
+    expectStatus(t, call(t, asUser(uid, LogoutAll), http.MethodPost, "/logout/all", "192.0.2.120", nil), http.StatusOK)
+    expectAPITokenRevoked(t, token)
+
+    uid = createUser(t, "pat-change-password", "right password", "")
+    token = createAPIToken(t, uid)
+    req := changePasswordRequest{CurrentPassword: "right password", NewPassword: "a much better password"}
+    expectStatus(t, call(t, asUser(uid, ChangePassword), http.MethodPost, "/password/change", "192.0.2.120", req), http.StatusOK)
+    expectAPITokenRevoked(t, token)
+}
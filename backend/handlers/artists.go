@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"concerts/db"
+	"concerts/models"
+)
+
+const maxArtistNameLen = 200
+
+var errArtistExists = errors.New("an artist with this name already exists")
+
+const artistColumns = "id, name, user_id"
+
+func scanArtist(row rowScanner) (models.Artist, error) {
+    var a models.Artist
+    err := row.Scan(&a.ID, &a.Name, &a.UserID)
+    return a, err
+}
+
+func validateArtistName(field, name string) (string, error) {
+    name = strings.TrimSpace(name)
+    if name == "" {
+        return "", fmt.Errorf("%s is required", field)
+    }
+    if len(name) > maxArtistNameLen {
+        return "", fmt.Errorf("%s must be at most %d bytes", field, maxArtistNameLen)
+    }
+    return name, nil
+}
+
+// findOrCreateArtist returns uid's artist called name, ignoring case, adding
+// it if there is none.
+func findOrCreateArtist(q queryExecer, uid int64, name string) (models.Artist, error) {
+    a, err := scanArtist(q.QueryRow("SELECT "+artistColumns+" FROM artists WHERE user_id = ? AND name = ? COLLATE NOCASE", uid, name))
+    if err == nil {
+        return a, nil
+    }
+    if !errors.Is(err, sql.ErrNoRows) {
+        return a, fmt.Errorf("db query error: %w", err)
+    }
+    a = models.Artist{Name: name, UserID: uid}
+    if err := q.QueryRow("INSERT INTO artists (user_id, name) VALUES (?, ?) RETURNING id", uid, name).Scan(&a.ID); err != nil {
+        return a, fmt.Errorf("db insert error: %w", err)
+    }
+    return a, nil
+}
+
+type artistRequest struct {
+    Name string `json:"name"`
+}
+
+// artistList is the sorting ListArtists offers.
+var artistList = listSpec{Keys: map[string]sortKey{
+    "name":    {Expr: "name COLLATE NOCASE"},
+    "created": {Expr: "id", Numeric: true},
+}}
+
+// ListArtists returns a page of the authenticated user's artists, by name.
+// ?name matches a substring; paging works as for ListConcerts.
+func ListArtists(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    q := r.URL.Query()
+    page, err := parseListPage(q, artistList, "name")
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    where, args := []string{"user_id = ?"}, []any{uid}
+    if v := q.Get("name"); v != "" {
+        where, args = append(where, `name LIKE ? ESCAPE '\'`), append(args, likePattern(v))
+    }
+    list, next, err := queryPage(page, artistColumns, "artists", where, args, scanArtist)
+    if err != nil {
+        if errors.Is(err, errInvalidCursor) {
+            writeError(w, http.StatusBadRequest, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    setNextPage(w, r, next)
+    writeJSON(w, http.StatusOK, list)
+}
+
+// CreateArtist adds an artist for the authenticated user. Names are unique
+// per user, ignoring case.
+func CreateArtist(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    var req artistRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    name, err := validateArtistName("name", req.Name)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    a := models.Artist{Name: name, UserID: uid}
+    err = db.Get().QueryRow("INSERT INTO artists (user_id, name) VALUES (?, ?) RETURNING id", uid, name).Scan(&a.ID)
+    if err != nil {
+        if strings.Contains(strings.ToLower(err.Error()), "unique") {
+            writeError(w, http.StatusConflict, errArtistExists)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db insert error: %w", err))
+        return
+    }
+    writeJSON(w, http.StatusCreated, a)
+}
+
+// GetArtist returns one of the authenticated user's artists.
+func GetArtist(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    aid, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("invalid id"))
+        return
+    }
+    a, err := scanArtist(db.Get().QueryRow("SELECT "+artistColumns+" FROM artists WHERE id = ? AND user_id = ?", aid, uid))
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            writeError(w, http.StatusNotFound, sql.ErrNoRows)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    writeJSON(w, http.StatusOK, a)
+}
+
+// RenameArtist replaces an artist's name (PUT).
+func RenameArtist(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    aid, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("invalid id"))
+        return
+    }
+    var req artistRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    name, err := validateArtistName("name", req.Name)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    res, err := db.Get().Exec("UPDATE artists SET name = ? WHERE id = ? AND user_id = ?", name, aid, uid)
+    if err != nil {
+        if strings.Contains(strings.ToLower(err.Error()), "unique") {
+            writeError(w, http.StatusConflict, errArtistExists)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        writeError(w, http.StatusNotFound, sql.ErrNoRows)
+        return
+    }
+    writeJSON(w, http.StatusOK, models.Artist{ID: aid, Name: name, UserID: uid})
+}
+
+// DeleteArtist deletes an artist that is in no lineup; otherwise it answers
+// 409 unless ?force=true, which removes the artist from those lineups too.
+func DeleteArtist(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    aid, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("invalid id"))
+        return
+    }
+
+    tx, err := db.Get().Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+    var lineups int
+    if err := tx.QueryRow("SELECT COUNT(*) FROM lineup_entries WHERE artist_id = ?", aid).Scan(&lineups); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    res, err := tx.Exec("DELETE FROM artists WHERE id = ? AND user_id = ?", aid, uid)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db delete error: %w", err))
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        writeError(w, http.StatusNotFound, sql.ErrNoRows)
+        return
+    }
+    if lineups > 0 && r.URL.Query().Get("force") != "true" {
+        writeError(w, http.StatusConflict, fmt.Errorf("artist is in %d lineups; use ?force=true to remove it from them", lineups))
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{"deleted": aid, "lineup_entries": lineups})
+}
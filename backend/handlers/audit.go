@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"concerts/db"
+	"concerts/models"
+)
+
+// Auth event types.
+const (
+    eventRegister        = "register"
+    eventEmailVerified   = "email_verified"
+    eventLogin           = "login"
+    eventLogout          = "logout"
+    eventLogoutAll       = "logout_all"
+    eventTokenRefresh    = "token_refresh"
+    eventTokenRejected   = "token_rejected"
+    eventSessionRevoked  = "session_revoked"
+    eventPasswordChanged = "password_changed"
+    eventPasswordReset   = "password_reset"
+    eventTOTPEnabled     = "totp_enabled"
+    eventTOTPDisabled    = "totp_disabled"
+    eventRecoveryCodes   = "recovery_codes_regenerated"
+    eventPasskeyAdded    = "passkey_added"
+    eventPasskeyRemoved  = "passkey_removed"
+    eventAccountDeleted  = "account_deleted"
+    eventUserDisabled    = "user_disabled"
+    eventUserEnabled     = "user_enabled"
+    eventUserDeleted     = "user_deleted"
+    eventRoleChanged     = "role_changed"
+    eventUserUnlocked    = "user_unlocked"
+)
+
+// Auth event outcomes. A login that still needs a second factor is a challenge.
+const (
+    outcomeSuccess   = "success"
+    outcomeFailure   = "failure"
+    outcomeChallenge = "challenge"
+)
+
+// Login methods, recorded as the detail of login events. OpenID Connect logins
+// are recorded as "oidc:<provider>".
+const (
+    loginMethodPassword     = "password"
+    loginMethodTOTP         = "totp"
+    loginMethodRecoveryCode = "recovery_code"
+    loginMethodMagicLink    = "magic_link"
+    loginMethodPasskey      = "passkey"
+)
+
+const (
+    defaultAuthEventLimit = 50
+    maxAuthEventLimit     = 200
+    maxAuthEventDetailLen = 500
+)
+
+// authEvent is one entry for the audit log. UserID is the account the event
+// is about, 0 if unknown; ActorID is who caused it when that is someone else,
+// such as an admin.
+type authEvent struct {
+    Event    string
+    Outcome  string
+    UserID   int64
+    Username string
+    ActorID  int64
+    Detail   string
+}
+
+func nullID(id int64) sql.NullInt64 {
+    return sql.NullInt64{Int64: id, Valid: id != 0}
+}
+
+// recordAuthEvent appends e to the auth_events log with the client's address
+// and user agent. The log must never turn a request into an error, so
+// failures are only logged. When only the user id is known, the username is
+// looked up so that entries stay readable after the account is deleted.
+func recordAuthEvent(r *http.Request, e authEvent) {
+    client := clientFromRequest(r)
+    if len(e.Detail) > maxAuthEventDetailLen {
+        e.Detail = e.Detail[:maxAuthEventDetailLen]
+    }
+    _, err := db.Get().Exec(
+        `INSERT INTO auth_events (created_at, event, outcome, user_id, username, actor_id, ip, user_agent, detail)
+         VALUES (?, ?, ?, ?, COALESCE(NULLIF(?, ''), (SELECT username FROM users WHERE id = ?)), ?, ?, ?, ?)`,
+        time.Now().Unix(), e.Event, e.Outcome, nullID(e.UserID), e.Username, e.UserID, nullID(e.ActorID),
+        client.ip, client.userAgent, e.Detail,
+    )
+    if err != nil {
+        log.Printf("audit: failed to record %s %s: %v", e.Event, e.Outcome, err)
+    }
+}
+
+// recordAdminEvent records an action an admin took on target's account.
+func recordAdminEvent(r *http.Request, event string, target int64, detail string) {
+    actor, _ := UserIDFromContext(r.Context())
+    recordAuthEvent(r, authEvent{Event: event, Outcome: outcomeSuccess, UserID: target, ActorID: actor, Detail: detail})
+}
+
+const authEventColumns = "id, created_at, event, outcome, user_id, COALESCE(username, ''), actor_id, ip, user_agent, detail"
+
+func scanAuthEvent(row rowScanner) (models.AuthEvent, error) {
+    var (
+        e       models.AuthEvent
+        userID  sql.NullInt64
+        actorID sql.NullInt64
+    )
+    err := row.Scan(&e.ID, &e.CreatedAt, &e.Event, &e.Outcome, &userID, &e.Username, &actorID, &e.IP, &e.UserAgent, &e.Detail)
+    if userID.Valid {
+        e.UserID = &userID.Int64
+    }
+    if actorID.Valid {
+        e.ActorID = &actorID.Int64
+    }
+    return e, err
+}
+
+// authEventPage reads the limit and before parameters shared by the event
+// listings. Pages go backwards in time; before is the id the next page
+// starts below.
+func authEventPage(q url.Values, def, max int) (limit int, before int64, err error) {
+    limit = def
+    if v := q.Get("limit"); v != "" {
+        if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > max {
+            return 0, 0, fmt.Errorf("limit must be between 1 and %d", max)
+        }
+    }
+    if v := q.Get("before"); v != "" {
+        if before, err = strconv.ParseInt(v, 10, 64); err != nil || before < 1 {
+            return 0, 0, errors.New("before must be an event id")
+        }
+    }
+    return limit, before, nil
+}
+
+// queryAuthEvents runs the listing query and sets a Link header to the next
+// page when there may be one.
+func queryAuthEvents(w http.ResponseWriter, r *http.Request, where []string, args []any, limit int) ([]models.AuthEvent, error) {
+    query := "SELECT " + authEventColumns + " FROM auth_events"
+    if len(where) > 0 {
+        query += " WHERE " + strings.Join(where, " AND ")
+    }
+    query += " ORDER BY id DESC LIMIT ?"
+    rows, err := db.Get().Query(query, append(args, limit)...)
+    if err != nil {
+        return nil, fmt.Errorf("db query error: %w", err)
+    }
+    defer rows.Close()
+    list := []models.AuthEvent{}
+    for rows.Next() {
+        e, err := scanAuthEvent(rows)
+        if err != nil {
+            return nil, fmt.Errorf("db scan error: %w", err)
+        }
+        list = append(list, e)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("db query error: %w", err)
+    }
+    if len(list) == limit {
+        next := *r.URL
+        q := next.Query()
+        q.Set("before", strconv.FormatInt(list[len(list)-1].ID, 10))
+        next.RawQuery = q.Encode()
+        w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+    }
+    return list, nil
+}
+
+// AdminListAuthEvents queries the audit log, newest first. Filters: user_id,
+// username, event, outcome, ip, and since/until as unix timestamps. Pages are
+// limited by limit (default 50, max 200) and continued with before, as given
+// in the Link header.
+func AdminListAuthEvents(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    limit, before, err := authEventPage(q, defaultAuthEventLimit, maxAuthEventLimit)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    var (
+        where []string
+        args  []any
+    )
+    if before > 0 {
+        where, args = append(where, "id < ?"), append(args, before)
+    }
+    if v := q.Get("user_id"); v != "" {
+        id, err := strconv.ParseInt(v, 10, 64)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, errors.New("user_id must be a number"))
+            return
+        }
+        where, args = append(where, "user_id = ?"), append(args, id)
+    }
+    for _, f := range []string{"username", "event", "outcome", "ip"} {
+        if v := q.Get(f); v != "" {
+            where, args = append(where, f+" = ?"), append(args, v)
+        }
+    }
+    for _, f := range []struct{ param, cond string }{{"since", "created_at >= ?"}, {"until", "created_at < ?"}} {
+        if v := q.Get(f.param); v != "" {
+            ts, err := strconv.ParseInt(v, 10, 64)
+            if err != nil {
+                writeError(w, http.StatusBadRequest, fmt.Errorf("%s must be a unix timestamp", f.param))
+                return
+            }
+            where, args = append(where, f.cond), append(args, ts)
+        }
+    }
+    list, err := queryAuthEvents(w, r, where, args, limit)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    writeJSON(w, http.StatusOK, list)
+}
+
+// ListMySecurityEvents returns the authenticated user's recent security
+// events, newest first, paged like AdminListAuthEvents (default 20, max 100).
+func ListMySecurityEvents(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    limit, before, err := authEventPage(r.URL.Query(), 20, 100)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    where, args := []string{"user_id = ?"}, []any{uid}
+    if before > 0 {
+        where, args = append(where, "id < ?"), append(args, before)
+    }
+    list, err := queryAuthEvents(w, r, where, args, limit)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    writeJSON(w, http.StatusOK, list)
+}
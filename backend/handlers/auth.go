@@ -5,67 +5,146 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
-	"time"
-
-	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 
 	"concerts/db"
+	"concerts/passwords"
 )
 
 type contextKey string
 
-const userIDContextKey contextKey = "uid"
+const (
+    userIDContextKey      contextKey = "uid"
+    tokenClaimsContextKey contextKey = "claims"
+    tokenScopesContextKey contextKey = "scopes"
+    userRoleContextKey    contextKey = "role"
+)
 
-func getJWTSecret() []byte {
-    if s := os.Getenv("JWT_SECRET"); s != "" {
-        return []byte(s)
-    }
-    return []byte("dev-secret-change-me")
-}
+// Roles a user can hold.
+const (
+    RoleUser  = "user"
+    RoleAdmin = "admin"
+)
+
+var errAccountDisabled = errors.New("account disabled")
 
 type registerRequest struct {
-    Username string `json:"username"`
-    Password string `json:"password"`
+    Username   string `json:"username"`
+    Password   string `json:"password"`
+    Email      string `json:"email"`
+    InviteCode string `json:"invite_code"`
 }
 
 type loginRequest struct {
     Username string `json:"username"`
     Password string `json:"password"`
+    // Session selects how tokens are delivered: "bearer" (default) or "cookie".
+    Session string `json:"session"`
 }
 
-// Register creates a new user with a hashed password.
+// Register creates a new user with a hashed password, subject to the
+// registration mode: invite mode requires a valid invite code, email mode
+// leaves the account inactive until the address has been verified.
 func Register(w http.ResponseWriter, r *http.Request) {
     var req registerRequest
     if err := readJSON(r, &req); err != nil {
         writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
         return
     }
-    if len(strings.TrimSpace(req.Username)) < 3 || len(req.Password) < 6 {
-        writeError(w, http.StatusBadRequest, errors.New("username must be >=3 and password >=6 characters"))
+    if len(strings.TrimSpace(req.Username)) < 3 {
+        writeError(w, http.StatusBadRequest, errors.New("username must be >=3 characters"))
+        return
+    }
+    if err := validatePassword(req.Password, req.Username); err != nil {
+        writePasswordError(w, err)
+        return
+    }
+
+    mode := registrationMode()
+    var email sql.NullString
+    if req.Email != "" {
+        normalized, err := normalizeEmail(req.Email)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, err)
+            return
+        }
+        email = sql.NullString{String: normalized, Valid: true}
+    }
+    if mode == RegistrationEmail && !email.Valid {
+        writeError(w, http.StatusBadRequest, errors.New("email is required"))
+        return
+    }
+    if mode == RegistrationInvite && req.InviteCode == "" {
+        writeError(w, http.StatusForbidden, errRegistrationClosed)
         return
     }
 
     connection := db.Get()
-    hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+    hashed, err := passwords.Hash(req.Password)
     if err != nil {
         writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to hash password: %w", err))
         return
     }
-    _, err = connection.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", req.Username, string(hashed))
+    tx, err := connection.Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+
+    var inviteID sql.NullInt64
+    if mode == RegistrationInvite {
+        id, err := redeemInvite(tx, req.InviteCode)
+        if err != nil {
+            if errors.Is(err, errInviteInvalid) {
+                writeError(w, http.StatusForbidden, err)
+                return
+            }
+            writeError(w, http.StatusInternalServerError, err)
+            return
+        }
+        inviteID = sql.NullInt64{Int64: id, Valid: true}
+    }
+    pending := mode == RegistrationEmail
+    res, err := tx.Exec(
+        "INSERT INTO users (username, password_hash, email, verification_pending, invite_id) VALUES (?, ?, ?, ?, ?)",
+        req.Username, hashed, email, pending, inviteID,
+    )
     if err != nil {
         // crude unique detection
         if strings.Contains(strings.ToLower(err.Error()), "unique") {
+            if strings.Contains(err.Error(), "users.email") {
+                writeError(w, http.StatusConflict, errors.New("email already registered"))
+                return
+            }
             writeError(w, http.StatusConflict, errors.New("username already exists"))
             return
         }
         writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to insert user: %w", err))
         return
     }
+    uid, _ := res.LastInsertId()
+    var verifyToken string
+    if pending {
+        verifyToken, err = issueOneTimeToken(tx, uid, purposeEmailVerification, getEmailVerificationTTL())
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, err)
+            return
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    recordAuthEvent(r, authEvent{Event: eventRegister, Outcome: outcomeSuccess, UserID: uid, Username: req.Username, Detail: mode})
+    if pending {
+        sendMailAsync(verificationMessage(req.Username, email.String, verifyToken))
+        writeJSON(w, http.StatusCreated, map[string]string{"message": "registered, check your email to activate the account"})
+        return
+    }
     writeJSON(w, http.StatusCreated, map[string]string{"message": "registered"})
 }
 
@@ -76,79 +155,321 @@ func Login(w http.ResponseWriter, r *http.Request) {
         writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
         return
     }
+    cookies, err := useCookieSession(req.Session)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    ip := clientIP(r)
+    wait, err := throttle.retryAfter(accountThrottleKey(req.Username), ipThrottleKey(ip))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if wait > 0 {
+        recordAuthEvent(r, authEvent{Event: eventLogin, Outcome: outcomeFailure, Username: req.Username, Detail: loginMethodPassword + ": locked out"})
+        writeLockedOut(w, wait)
+        return
+    }
+
     connection := db.Get()
     var (
         id int64
         hash string
     )
-    err := connection.QueryRow("SELECT id, password_hash FROM users WHERE username = ?", req.Username).Scan(&id, &hash)
+    err = connection.QueryRow("SELECT id, password_hash FROM users WHERE username = ?", req.Username).Scan(&id, &hash)
+    if err != nil && !errors.Is(err, sql.ErrNoRows) {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db error: %w", err))
+        return
+    }
+    var matched, rehash bool
+    if err != nil || hash == "" {
+        // Spend as long on unknown users and accounts without a password as
+        // on a wrong password, so timing does not reveal which usernames exist.
+        passwords.VerifyDummy(req.Password)
+    } else {
+        matched, rehash, err = passwords.Verify(req.Password, hash)
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, fmt.Errorf("password verification error: %w", err))
+            return
+        }
+    }
+    if !matched {
+        if err := loginFailed(req.Username, ip); err != nil {
+            writeError(w, http.StatusInternalServerError, err)
+            return
+        }
+        recordAuthEvent(r, authEvent{Event: eventLogin, Outcome: outcomeFailure, UserID: id, Username: req.Username, Detail: loginMethodPassword + ": invalid credentials"})
+        writeError(w, http.StatusUnauthorized, errors.New("invalid credentials"))
+        return
+    }
+    // Upgrade hashes made with an older algorithm or weaker parameters while
+    // the plaintext is at hand.
+    if rehash {
+        if err := setPassword(connection, id, req.Password); err != nil {
+            writeError(w, http.StatusInternalServerError, err)
+            return
+        }
+    }
+    completeLogin(w, r, id, req.Username, loginMethodPassword, cookies)
+}
+
+// completeLogin finishes a login whose first factor, named by method, has
+// been verified. Users with two-factor authentication enabled get a challenge
+// instead of tokens.
+func completeLogin(w http.ResponseWriter, r *http.Request, uid int64, username, method string, cookies bool) {
+    totpEnabled, err := checkCanLogin(uid)
     if err != nil {
-        if errors.Is(err, sql.ErrNoRows) {
-            writeError(w, http.StatusUnauthorized, errors.New("invalid credentials"))
+        if errors.Is(err, errAccountDisabled) || errors.Is(err, errEmailNotVerified) {
+            recordAuthEvent(r, authEvent{Event: eventLogin, Outcome: outcomeFailure, UserID: uid, Username: username, Detail: method + ": " + err.Error()})
+            writeError(w, http.StatusForbidden, err)
             return
         }
-        writeError(w, http.StatusInternalServerError, fmt.Errorf("db error: %w", err))
+        writeError(w, http.StatusInternalServerError, err)
         return
     }
-    if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil {
-        writeError(w, http.StatusUnauthorized, errors.New("invalid credentials"))
+    if totpEnabled {
+        recordAuthEvent(r, authEvent{Event: eventLogin, Outcome: outcomeChallenge, UserID: uid, Username: username, Detail: method})
+        writeMFAChallenge(w, uid)
         return
     }
+    startSession(w, r, uid, username, method, cookies)
+}
+
+// checkCanLogin returns errAccountDisabled or errEmailNotVerified if the
+// account may not log in, and otherwise whether it has TOTP enabled.
+func checkCanLogin(uid int64) (bool, error) {
+    var (
+        totpEnabled bool
+        pending     bool
+        disabledAt  sql.NullInt64
+    )
+    err := db.Get().QueryRow("SELECT totp_enabled, verification_pending, disabled_at FROM users WHERE id = ?", uid).Scan(&totpEnabled, &pending, &disabledAt)
+    if err != nil {
+        return false, fmt.Errorf("db query error: %w", err)
+    }
+    if disabledAt.Valid {
+        return false, errAccountDisabled
+    }
+    if pending {
+        return false, errEmailNotVerified
+    }
+    return totpEnabled, nil
+}
 
-    claims := jwt.RegisteredClaims{
-        Subject:   strconv.FormatInt(id, 10),
-        ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-        IssuedAt:  jwt.NewNumericDate(time.Now()),
+// startSession clears failed login attempts, records a new session for the
+// requesting device and responds with its token pair, in the body or as cookies.
+func startSession(w http.ResponseWriter, r *http.Request, uid int64, username, method string, cookies bool) {
+    if err := throttle.reset(accountThrottleKey(username)); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
     }
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    signed, err := token.SignedString(getJWTSecret())
+    pair, err := issueTokenPair(db.Get(), uid, "", clientFromRequest(r))
     if err != nil {
-        writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to sign token: %w", err))
+        writeError(w, http.StatusInternalServerError, err)
         return
     }
-    writeJSON(w, http.StatusOK, map[string]any{
-        "token": signed,
+    recordAuthEvent(r, authEvent{Event: eventLogin, Outcome: outcomeSuccess, UserID: uid, Username: username, Detail: method})
+    writeTokenPair(w, pair, cookies, map[string]any{
         "user": map[string]any{
-            "id":       id,
-            "username": req.Username,
+            "id":       uid,
+            "username": username,
         },
     })
 }
 
-// RequireAuth validates JWT from Authorization header and injects user id into context.
+type logoutRequest struct {
+    RefreshToken string `json:"refresh_token"`
+}
+
+// Logout revokes the access token used for the request and the session it
+// belongs to, along with the family of the refresh token if one is given.
+func Logout(w http.ResponseWriter, r *http.Request) {
+    ctx := r.Context()
+    uid, ok := UserIDFromContext(ctx)
+    claims, hasClaims := tokenClaimsFromContext(ctx)
+    if !ok || !hasClaims {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    var req logoutRequest
+    if err := readJSON(r, &req); err != nil && !errors.Is(err, io.EOF) {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    if err := denylist.revokeToken(claims.ID, uid, claims.ExpiresAt.Time); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if claims.SessionID != "" {
+        if err := revokeTokenFamily(db.Get(), claims.SessionID); err != nil {
+            writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+            return
+        }
+    }
+    if req.RefreshToken == "" {
+        if c, err := r.Cookie(refreshCookieName); err == nil {
+            req.RefreshToken = c.Value
+        }
+    }
+    if req.RefreshToken != "" {
+        connection := db.Get()
+        var family string
+        err := connection.QueryRow("SELECT family_id FROM refresh_tokens WHERE token_hash = ? AND user_id = ?", hashToken(req.RefreshToken), uid).Scan(&family)
+        if err != nil && !errors.Is(err, sql.ErrNoRows) {
+            writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+            return
+        }
+        if family != "" {
+            if err := revokeTokenFamily(connection, family); err != nil {
+                writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+                return
+            }
+        }
+    }
+    recordAuthEvent(r, authEvent{Event: eventLogout, Outcome: outcomeSuccess, UserID: uid})
+    clearSessionCookies(w)
+    writeJSON(w, http.StatusOK, map[string]string{"message": "logged out"})
+}
+
+// LogoutAll revokes every access, refresh and personal access token issued to
+// the authenticated user.
+func LogoutAll(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    if err := revokeAllSessions(db.Get(), uid); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    recordAuthEvent(r, authEvent{Event: eventLogoutAll, Outcome: outcomeSuccess, UserID: uid})
+    clearSessionCookies(w)
+    writeJSON(w, http.StatusOK, map[string]string{"message": "logged out everywhere"})
+}
+
+// RequireAuth validates a JWT or personal access token from the Authorization
+// header, or a JWT from the session cookie, and injects the user id into
+// context. Cookie-authenticated unsafe requests must carry a valid CSRF token.
+// Rejected tokens are recorded in the audit log.
 func RequireAuth(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        header := r.Header.Get("Authorization")
-        if header == "" || !strings.HasPrefix(header, "Bearer ") {
+        reject := func(status int, uid int64, err error) {
+            recordAuthEvent(r, authEvent{Event: eventTokenRejected, Outcome: outcomeFailure, UserID: uid, Detail: r.Method + " " + r.URL.Path + ": " + err.Error()})
+            writeError(w, status, err)
+        }
+        var tokenString string
+        if header := r.Header.Get("Authorization"); header != "" {
+            if !strings.HasPrefix(header, "Bearer ") {
+                writeError(w, http.StatusUnauthorized, errors.New("missing or invalid authorization header"))
+                return
+            }
+            tokenString = strings.TrimPrefix(header, "Bearer ")
+        } else if c, err := r.Cookie(accessCookieName); err == nil && c.Value != "" {
+            if !validCSRF(r) {
+                reject(http.StatusForbidden, 0, errors.New("missing or invalid csrf token"))
+                return
+            }
+            tokenString = c.Value
+        } else {
             writeError(w, http.StatusUnauthorized, errors.New("missing or invalid authorization header"))
             return
         }
-        tokenString := strings.TrimPrefix(header, "Bearer ")
-        parsed, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-            if t.Method != jwt.SigningMethodHS256 {
-                return nil, errors.New("unexpected signing method")
+        if strings.HasPrefix(tokenString, apiTokenPrefix) {
+            uid, scopes, err := authenticateAPIToken(tokenString)
+            if err != nil {
+                if errors.Is(err, errAPITokenInvalid) {
+                    reject(http.StatusUnauthorized, 0, err)
+                    return
+                }
+                writeError(w, http.StatusInternalServerError, err)
+                return
             }
-            return getJWTSecret(), nil
-        })
+            ctx := context.WithValue(r.Context(), tokenScopesContextKey, scopes)
+            serveAuthenticated(w, r.WithContext(ctx), next, uid)
+            return
+        }
+        parsed, err := parseJWT(tokenString, &accessClaims{})
         if err != nil || !parsed.Valid {
-            writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+            reject(http.StatusUnauthorized, 0, errors.New("invalid token"))
             return
         }
-        claims, ok := parsed.Claims.(*jwt.RegisteredClaims)
-        if !ok || claims.Subject == "" {
-            writeError(w, http.StatusUnauthorized, errors.New("invalid token claims"))
+        claims, ok := parsed.Claims.(*accessClaims)
+        // Access tokens carry no audience; anything else (e.g. an MFA challenge) is not a session.
+        if !ok || claims.Subject == "" || claims.ID == "" || claims.IssuedAt == nil || len(claims.Audience) > 0 {
+            reject(http.StatusUnauthorized, 0, errors.New("invalid token claims"))
             return
         }
         uid, err := strconv.ParseInt(claims.Subject, 10, 64)
         if err != nil {
-            writeError(w, http.StatusUnauthorized, errors.New("invalid subject"))
+            reject(http.StatusUnauthorized, 0, errors.New("invalid subject"))
             return
         }
-        ctx := context.WithValue(r.Context(), userIDContextKey, uid)
-        next.ServeHTTP(w, r.WithContext(ctx))
+        revoked, err := denylist.isRevoked(claims.ID, uid, claims.Generation)
+        if err != nil {
+            writeError(w, http.StatusServiceUnavailable, err)
+            return
+        }
+        if revoked {
+            reject(http.StatusUnauthorized, uid, errors.New("token revoked"))
+            return
+        }
+        if claims.SessionID != "" {
+            if err := checkSession(claims.SessionID, uid, clientFromRequest(r)); err != nil {
+                if errors.Is(err, errSessionRevoked) {
+                    reject(http.StatusUnauthorized, uid, err)
+                    return
+                }
+                writeError(w, http.StatusInternalServerError, err)
+                return
+            }
+        }
+        ctx := context.WithValue(r.Context(), tokenClaimsContextKey, claims)
+        serveAuthenticated(w, r.WithContext(ctx), next, uid)
     })
 }
 
+// serveAuthenticated checks that the user still exists and is not disabled,
+// then calls next with the user id and role in context.
+func serveAuthenticated(w http.ResponseWriter, r *http.Request, next http.Handler, uid int64) {
+    var (
+        role       string
+        disabledAt sql.NullInt64
+    )
+    err := db.Get().QueryRow("SELECT role, disabled_at FROM users WHERE id = ?", uid).Scan(&role, &disabledAt)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            writeError(w, http.StatusUnauthorized, errors.New("invalid subject"))
+            return
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if disabledAt.Valid {
+        recordAuthEvent(r, authEvent{Event: eventTokenRejected, Outcome: outcomeFailure, UserID: uid, Detail: r.Method + " " + r.URL.Path + ": " + errAccountDisabled.Error()})
+        writeError(w, http.StatusUnauthorized, errAccountDisabled)
+        return
+    }
+    ctx := context.WithValue(r.Context(), userIDContextKey, uid)
+    ctx = context.WithValue(ctx, userRoleContextKey, role)
+    next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// RequireRole rejects authenticated users that do not hold role. It must be
+// installed after RequireAuth.
+func RequireRole(role string) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if userRole, ok := UserRoleFromContext(r.Context()); !ok || userRole != role {
+                writeError(w, http.StatusForbidden, errors.New("access denied"))
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
 // thin wrappers moved to auth_ctx.go
 
 
@@ -1,6 +1,8 @@
 package handlers
 
-import "context"
+import (
+	"context"
+)
 
 // UserIDFromContext extracts the authenticated user id from context if present.
 func UserIDFromContext(ctx context.Context) (int64, bool) {
@@ -13,3 +15,22 @@ func UserIDFromContext(ctx context.Context) (int64, bool) {
 }
 
 
+
+// UserRoleFromContext extracts the authenticated user's role from context if present.
+func UserRoleFromContext(ctx context.Context) (string, bool) {
+    role, ok := ctx.Value(userRoleContextKey).(string)
+    return role, ok
+}
+
+// tokenClaimsFromContext returns the claims of the access token that authenticated the request.
+func tokenClaimsFromContext(ctx context.Context) (*accessClaims, bool) {
+    claims, ok := ctx.Value(tokenClaimsContextKey).(*accessClaims)
+    return claims, ok
+}
+
+// tokenScopesFromContext returns the scopes of the personal access token that
+// authenticated the request. It reports false for session tokens.
+func tokenScopesFromContext(ctx context.Context) ([]string, bool) {
+    scopes, ok := ctx.Value(tokenScopesContextKey).([]string)
+    return scopes, ok
+}
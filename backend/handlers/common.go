@@ -2,7 +2,11 @@ package handlers
 
 import (
 	"encoding/json"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 )
 
 type errorPayload struct {
@@ -29,4 +33,39 @@ func redirect(w http.ResponseWriter, r *http.Request, path string) {
     http.Redirect(w, r, path, http.StatusFound)
 }
 
+// clientIP returns the address of the client. TRUST_PROXY_HEADERS gives the
+// number of trusted reverse proxies in front of the server (1 for the usual
+// single proxy); X-Forwarded-For is ignored when it is unset. Each proxy
+// appends the address it received the request from, so the client is that
+// many entries from the right. Entries further left are whatever the client
+// sent and are never used.
+func clientIP(r *http.Request) string {
+    if proxies := trustedProxies(); proxies > 0 {
+        var hops []string
+        for _, h := range r.Header.Values("X-Forwarded-For") {
+            for _, ip := range strings.Split(h, ",") {
+                hops = append(hops, strings.TrimSpace(ip))
+            }
+        }
+        if len(hops) > 0 {
+            // With fewer entries than proxies, the left-most was still
+            // written by one of ours.
+            if ip := hops[max(len(hops)-proxies, 0)]; ip != "" {
+                return ip
+            }
+        }
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
 
+func trustedProxies() int {
+    n, err := strconv.Atoi(os.Getenv("TRUST_PROXY_HEADERS"))
+    if err != nil || n < 0 {
+        return 0
+    }
+    return n
+}
@@ -2,18 +2,100 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 
+	"concerts/dates"
 	"concerts/db"
 	"concerts/models"
 )
 
-// ListConcerts returns all concerts for the authenticated user.
+const concertColumns = "id, title, date, location, user_id, starts_at, ends_at, COALESCE(timezone, 'UTC'), venue_id"
+
+func scanConcert(row rowScanner) (models.Concert, error) {
+    var (
+        c            models.Concert
+        starts, ends sql.NullInt64
+        venue        sql.NullInt64
+    )
+    if err := row.Scan(&c.ID, &c.Title, &c.Date, &c.Location, &c.UserID, &starts, &ends, &c.Timezone, &venue); err != nil {
+        return c, err
+    }
+    if venue.Valid {
+        c.VenueID = &venue.Int64
+    }
+    loc, err := loadTimezone(c.Timezone)
+    if err != nil {
+        loc = time.UTC
+    }
+    if starts.Valid {
+        t := time.Unix(starts.Int64, 0).In(loc)
+        c.StartsAt = &t
+    }
+    if ends.Valid {
+        t := time.Unix(ends.Int64, 0).In(loc)
+        c.EndsAt = &t
+    }
+    return c, nil
+}
+
+func unixOrNil(t *time.Time) any {
+    if t == nil {
+        return nil
+    }
+    return t.Unix()
+}
+
+// userTimezone returns the time zone set in the user's profile, or UTC.
+func userTimezone(q queryExecer, uid int64) (*time.Location, error) {
+    var name sql.NullString
+    if err := q.QueryRow("SELECT timezone FROM users WHERE id = ?", uid).Scan(&name); err != nil {
+        return nil, fmt.Errorf("db query error: %w", err)
+    }
+    if loc, err := loadTimezone(name.String); err == nil {
+        return loc, nil
+    }
+    return time.UTC, nil
+}
+
+// parseRangeBound reads a from/to filter: an RFC 3339 time, or a date in loc.
+// A date used as the end of a range includes that whole day.
+func parseRangeBound(name, value string, loc *time.Location, end bool) (int64, error) {
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return t.Unix(), nil
+    }
+    day, err := time.ParseInLocation("2006-01-02", value, loc)
+    if err != nil {
+        return 0, fmt.Errorf("%s must be an RFC 3339 time or a YYYY-MM-DD date", name)
+    }
+    if end {
+        day = day.AddDate(0, 0, 1)
+    }
+    return day.Unix(), nil
+}
+
+// concertList is the sorting ListConcerts offers. Concerts without a start
+// time sort as the oldest; created is the order they were added in.
+var concertList = listSpec{Keys: map[string]sortKey{
+    "date":     {Expr: "COALESCE(starts_at, 0)", Numeric: true},
+    "title":    {Expr: "title COLLATE NOCASE"},
+    "location": {Expr: "location COLLATE NOCASE"},
+    "created":  {Expr: "id", Numeric: true},
+}}
+
+// ListConcerts returns a page of the authenticated user's concerts, latest
+// first. ?when=upcoming lists concerts that have not ended yet, soonest first,
+// and ?when=past those that have. ?from and ?to limit the start time to a
+// range; dates are read in the user's time zone and to includes its whole day.
+// ?title and ?location match substrings. Pages are sorted by ?sort, limited
+// by ?limit and continued with the cursor in the Link or X-Next-Cursor header.
 func ListConcerts(w http.ResponseWriter, r *http.Request) {
     ctx := r.Context()
     uid, ok := UserIDFromContext(ctx)
@@ -21,25 +103,69 @@ func ListConcerts(w http.ResponseWriter, r *http.Request) {
         writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
         return
     }
-    connection := db.Get()
-    rows, err := connection.Query("SELECT id, title, date, location, user_id FROM concerts WHERE user_id = ? ORDER BY date DESC", uid)
+    loc, err := userTimezone(db.Get(), uid)
     if err != nil {
-        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    q := r.URL.Query()
+    where, args := []string{"user_id = ?"}, []any{uid}
+    defaultSort := "-date"
+    switch q.Get("when") {
+    case "":
+    case "upcoming":
+        where, args = append(where, "COALESCE(ends_at, starts_at) >= ?"), append(args, time.Now().Unix())
+        defaultSort = "date"
+    case "past":
+        where, args = append(where, "COALESCE(ends_at, starts_at) < ?"), append(args, time.Now().Unix())
+    default:
+        writeError(w, http.StatusBadRequest, errors.New("when must be upcoming or past"))
+        return
+    }
+    for _, f := range []struct {
+        param, cond string
+        end         bool
+    }{{"from", "starts_at >= ?", false}, {"to", "starts_at < ?", true}} {
+        if v := q.Get(f.param); v != "" {
+            ts, err := parseRangeBound(f.param, v, loc, f.end)
+            if err != nil {
+                writeError(w, http.StatusBadRequest, err)
+                return
+            }
+            where, args = append(where, f.cond), append(args, ts)
+        }
+    }
+    for _, f := range []string{"title", "location"} {
+        if v := q.Get(f); v != "" {
+            where, args = append(where, f+` LIKE ? ESCAPE '\'`), append(args, likePattern(v))
+        }
+    }
+    page, err := parseListPage(q, concertList, defaultSort)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
         return
     }
-    defer rows.Close()
-    var list []models.Concert
-    for rows.Next() {
-        var c models.Concert
-        if err := rows.Scan(&c.ID, &c.Title, &c.Date, &c.Location, &c.UserID); err != nil {
-            writeError(w, http.StatusInternalServerError, fmt.Errorf("db scan error: %w", err))
+
+    list, next, err := queryPage(page, concertColumns, "concerts", where, args, scanConcert)
+    if err != nil {
+        if errors.Is(err, errInvalidCursor) {
+            writeError(w, http.StatusBadRequest, err)
             return
         }
-        list = append(list, c)
+        writeError(w, http.StatusInternalServerError, err)
+        return
     }
+    setNextPage(w, r, next)
     writeJSON(w, http.StatusOK, list)
 }
 
+// concertDetail is a concert with its lineup, as returned by GetConcert.
+type concertDetail struct {
+    models.Concert
+    Lineup []models.LineupEntry `json:"lineup"`
+}
+
+// GetConcert returns one of the authenticated user's concerts and its lineup.
 func GetConcert(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		uid, ok := UserIDFromContext(ctx)
@@ -54,20 +180,121 @@ func GetConcert(w http.ResponseWriter, r *http.Request) {
 				writeError(w, http.StatusBadRequest, errors.New("invalid id"))
 				return
 		}
-		connection := db.Get()
-		var c models.Concert
-		if err := connection.QueryRow("SELECT id, title, date, location, user_id FROM concerts WHERE id = ? AND user_id = ?", cid, uid).Scan(&c.ID, &c.Title, &c.Date, &c.Location, &c.UserID); err != nil {
+		c, err := loadConcert(db.Get(), cid, uid)
+		if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+						writeError(w, http.StatusNotFound, sql.ErrNoRows)
+						return
+				}
 				writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
 				return
 		}
-		writeJSON(w, http.StatusOK, c)
+		lineup, err := loadLineup(c)
+		if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+		}
+		writeJSON(w, http.StatusOK, concertDetail{Concert: c, Lineup: lineup})
 }
 
+// loadConcert reads a concert owned by uid. Concerts of other users are
+// reported as sql.ErrNoRows, like missing ones.
+func loadConcert(q queryExecer, cid, uid int64) (models.Concert, error) {
+    return scanConcert(q.QueryRow("SELECT "+concertColumns+" FROM concerts WHERE id = ? AND user_id = ?", cid, uid))
+}
 
 type createConcertRequest struct {
-    Title    string `json:"title"`
+    Title string `json:"title"`
+    // Date may be given instead of StartsAt, in any format dates.Parse
+    // understands, for clients that predate start times.
     Date     string `json:"date"`
+    StartsAt string `json:"starts_at"`
+    EndsAt   string `json:"ends_at"`
+    // Timezone defaults to the one in the user's profile.
+    Timezone string `json:"timezone"`
+    // Location defaults to the venue's name and city when VenueID is set.
     Location string `json:"location"`
+    VenueID  *int64 `json:"venue_id"`
+}
+
+// concert builds the concert described by a create or replace request.
+func (req createConcertRequest) concert(q queryExecer, uid int64) (models.Concert, error) {
+    c := models.Concert{Title: req.Title, Location: req.Location, UserID: uid, Timezone: req.Timezone, VenueID: req.VenueID}
+    if c.Timezone == "" {
+        loc, err := userTimezone(q, uid)
+        if err != nil {
+            return c, err
+        }
+        c.Timezone = loc.String()
+    }
+    patch := map[string]string{"starts_at": req.StartsAt, "date": req.Date, "ends_at": req.EndsAt}
+    for _, name := range []string{"starts_at", "date", "ends_at"} {
+        if patch[name] == "" || (name == "date" && req.StartsAt != "") {
+            continue
+        }
+        if err := setConcertTime(&c, name, patch[name]); err != nil {
+            return c, err
+        }
+    }
+    return c, nil
+}
+
+// setConcertTime sets the start or end of c from an RFC 3339 time, or the
+// start from a free-form date in the concert's time zone.
+func setConcertTime(c *models.Concert, name, value string) error {
+    if name == "date" {
+        loc, err := loadTimezone(c.Timezone)
+        if err != nil {
+            return err
+        }
+        t, err := dates.Parse(value, loc)
+        if err != nil {
+            return errors.New("date must be a date such as 2025-03-12, or use starts_at")
+        }
+        c.StartsAt = &t
+        return nil
+    }
+    t, err := time.Parse(time.RFC3339, value)
+    if err != nil {
+        return fmt.Errorf("%s must be an RFC 3339 time such as 2025-03-12T20:00:00+01:00", name)
+    }
+    if name == "ends_at" {
+        c.EndsAt = &t
+    } else {
+        c.StartsAt = &t
+    }
+    return nil
+}
+
+// normalizeConcert applies the rules shared by creating and updating concerts,
+// and puts the times and date in the concert's time zone. A concert from
+// before start times whose date could not be parsed keeps its free-form date
+// until a start time is set, so its other fields can still be edited.
+func normalizeConcert(c *models.Concert) error {
+    if c.Title == "" || c.Location == "" || (c.StartsAt == nil && c.Date == "") {
+        return errors.New("title, starts_at (or date), and location are required")
+    }
+    loc, err := loadTimezone(c.Timezone)
+    if err != nil {
+        return err
+    }
+    if c.StartsAt == nil {
+        if c.EndsAt != nil {
+            return errors.New("starts_at (or date) is required with ends_at")
+        }
+        return nil
+    }
+    starts := c.StartsAt.In(loc).Truncate(time.Second)
+    c.StartsAt = &starts
+    if c.EndsAt != nil {
+        ends := c.EndsAt.In(loc).Truncate(time.Second)
+        if ends.Before(starts) {
+            return errors.New("ends_at must not be before starts_at")
+        }
+        c.EndsAt = &ends
+    }
+    c.Date = starts.Format("2006-01-02")
+    return nil
 }
 
 // CreateConcert inserts a new concert for the authenticated user.
@@ -83,24 +310,218 @@ func CreateConcert(w http.ResponseWriter, r *http.Request) {
         writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
         return
     }
-    if req.Title == "" || req.Date == "" || req.Location == "" {
-        writeError(w, http.StatusBadRequest, errors.New("title, date, and location are required"))
+    connection := db.Get()
+    c, err := req.concert(connection, uid)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    if err := resolveVenue(connection, &c); err != nil {
+        if errors.Is(err, errUnknownVenue) {
+            writeError(w, http.StatusBadRequest, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
         return
     }
-    connection := db.Get()
-    res, err := connection.Exec("INSERT INTO concerts (title, date, location, user_id) VALUES (?, ?, ?, ?)", req.Title, req.Date, req.Location, uid)
+    if err := normalizeConcert(&c); err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    res, err := connection.Exec(
+        "INSERT INTO concerts (title, date, location, user_id, starts_at, ends_at, timezone, venue_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+        c.Title, c.Date, c.Location, uid, unixOrNil(c.StartsAt), unixOrNil(c.EndsAt), c.Timezone, c.VenueID,
+    )
     if err != nil {
         writeError(w, http.StatusInternalServerError, fmt.Errorf("db insert error: %w", err))
         return
     }
-    id, _ := res.LastInsertId()
-    writeJSON(w, http.StatusCreated, models.Concert{
-        ID:       id,
-        Title:    req.Title,
-        Date:     req.Date,
-        Location: req.Location,
-        UserID:   uid,
-    })
+    c.ID, _ = res.LastInsertId()
+    writeJSON(w, http.StatusCreated, c)
+}
+
+// ReplaceConcert replaces every field of a concert (PUT); the body is the
+// same as for CreateConcert. Songs are kept.
+func ReplaceConcert(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    cid, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("invalid id"))
+        return
+    }
+    var req createConcertRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    connection := db.Get()
+    c, err := req.concert(connection, uid)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    if err := resolveVenue(connection, &c); err != nil {
+        if errors.Is(err, errUnknownVenue) {
+            writeError(w, http.StatusBadRequest, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if err := normalizeConcert(&c); err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    c.ID = cid
+    if err := saveConcert(connection, c); err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            writeError(w, http.StatusNotFound, sql.ErrNoRows)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    writeJSON(w, http.StatusOK, c)
+}
+
+// UpdateConcert applies a JSON merge patch (RFC 7396) to a concert (PATCH):
+// fields in the body are replaced, absent ones are kept. Only ends_at and
+// venue_id can be removed with null. Changing the time zone alone keeps the same instants.
+func UpdateConcert(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    cid, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("invalid id"))
+        return
+    }
+    var patch map[string]json.RawMessage
+    if err := readJSON(r, &patch); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+
+    connection := db.Get()
+    tx, err := connection.Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+    c, err := loadConcert(tx, cid, uid)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            writeError(w, http.StatusNotFound, sql.ErrNoRows)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if err := applyConcertPatch(&c, patch); err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    if err := resolveVenue(tx, &c); err != nil {
+        if errors.Is(err, errUnknownVenue) {
+            writeError(w, http.StatusBadRequest, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if err := normalizeConcert(&c); err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    if err := saveConcert(tx, c); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    writeJSON(w, http.StatusOK, c)
+}
+
+// concertPatchFields lists the members a concert patch may contain, in the
+// order they are applied: the time zone comes first so that a date in the
+// same patch is read in it.
+var concertPatchFields = []string{"title", "location", "timezone", "starts_at", "date", "ends_at", "venue_id"}
+
+// applyConcertPatch merges the members of a JSON merge patch into c.
+func applyConcertPatch(c *models.Concert, patch map[string]json.RawMessage) error {
+    for name := range patch {
+        if !slices.Contains(concertPatchFields, name) {
+            return fmt.Errorf("unknown field %q", name)
+        }
+    }
+    _, hasDate := patch["date"]
+    if _, hasStart := patch["starts_at"]; hasDate && hasStart {
+        return errors.New("give either date or starts_at, not both")
+    }
+    for _, name := range concertPatchFields {
+        raw, ok := patch[name]
+        if !ok {
+            continue
+        }
+        if name == "venue_id" {
+            c.VenueID = nil
+            if string(raw) != "null" {
+                if err := json.Unmarshal(raw, &c.VenueID); err != nil {
+                    return errors.New("venue_id must be a venue id or null")
+                }
+            }
+            continue
+        }
+        if string(raw) == "null" {
+            if name != "ends_at" {
+                return fmt.Errorf("%s is required and cannot be removed", name)
+            }
+            c.EndsAt = nil
+            continue
+        }
+        var value string
+        if err := json.Unmarshal(raw, &value); err != nil {
+            return fmt.Errorf("%s must be a string", name)
+        }
+        switch name {
+        case "title":
+            c.Title = value
+        case "location":
+            c.Location = value
+        case "timezone":
+            c.Timezone = value
+        default:
+            if err := setConcertTime(c, name, value); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// saveConcert writes every field of c to its row, which must belong to
+// c.UserID; sql.ErrNoRows means it does not.
+func saveConcert(q execer, c models.Concert) error {
+    res, err := q.Exec(
+        "UPDATE concerts SET title = ?, date = ?, location = ?, starts_at = ?, ends_at = ?, timezone = ?, venue_id = ? WHERE id = ? AND user_id = ?",
+        c.Title, c.Date, c.Location, unixOrNil(c.StartsAt), unixOrNil(c.EndsAt), c.Timezone, c.VenueID, c.ID, c.UserID,
+    )
+    if err != nil {
+        return fmt.Errorf("db update error: %w", err)
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return sql.ErrNoRows
+    }
+    return nil
 }
 
 // DeleteConcert deletes a concert by id for the authenticated user.
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"concerts/db"
+	"concerts/models"
+)
+
+// withID runs handler as if the router had matched {id}.
+func withID(id int64, handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        handler(w, mux.SetURLVars(r, map[string]string{"id": strconv.FormatInt(id, 10)}))
+    }
+}
+
+func TestUpdateLegacyConcertWithoutStartTime(t *testing.T) {
+    uid := createUser(t, "legacy-concerts", "right password", "")
+    // A concert from before start times whose date the migration could not
+    // parse.
+    var cid int64
+    err := db.Get().QueryRow(
+        "INSERT INTO concerts (title, date, location, user_id) VALUES ('Spring tour', 'sometime in spring', 'Lisbn', ?) RETURNING id", uid,
+    ).Scan(&cid)
+    if err != nil {
+        t.Fatal(err)
+    }
+    update := func(patch map[string]any) *httptest.ResponseRecorder {
+        return call(t, asUser(uid, withID(cid, UpdateConcert)), http.MethodPatch, "/concerts/"+strconv.FormatInt(cid, 10), "192.0.2.130", patch)
+    }
+
+    w := update(map[string]any{"location": "Lisbon"})
+    expectStatus(t, w, http.StatusOK)
+    var c models.Concert
+    decode(t, w, &c)
+    if c.Location != "Lisbon" || c.Date != "sometime in spring" || c.StartsAt != nil {
+        t.Fatalf("unexpected concert %+v", c)
+    }
+
+    expectStatus(t, update(map[string]any{"ends_at": "2025-03-12T23:00:00Z"}), http.StatusBadRequest)
+
+    w = update(map[string]any{"date": "2025-03-12"})
+    expectStatus(t, w, http.StatusOK)
+    decode(t, w, &c)
+    if c.Date != "2025-03-12" || c.StartsAt == nil {
+        t.Fatalf("unexpected concert %+v", c)
+    }
+}
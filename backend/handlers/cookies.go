@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Cookie session mode: instead of returning tokens in the body, they are set
+// as HttpOnly cookies so that scripts cannot read them. Unsafe requests
+// authenticated by cookie must echo the csrf_token cookie in X-CSRF-Token
+// (double-submit), which a cross-site attacker cannot do.
+const (
+    accessCookieName  = "access_token"
+    refreshCookieName = "refresh_token"
+    csrfCookieName    = "csrf_token"
+    csrfHeaderName    = "X-CSRF-Token"
+
+    sessionModeBearer = "bearer"
+    sessionModeCookie = "cookie"
+)
+
+// useCookieSession interprets the "session" field of login requests.
+func useCookieSession(mode string) (bool, error) {
+    switch mode {
+    case "", sessionModeBearer:
+        return false, nil
+    case sessionModeCookie:
+        return true, nil
+    default:
+        return false, fmt.Errorf("session must be %q or %q", sessionModeBearer, sessionModeCookie)
+    }
+}
+
+// cookieSecure reports whether cookies get the Secure attribute. It defaults
+// to true when the app is served over https.
+func cookieSecure() bool {
+    switch os.Getenv("COOKIE_SECURE") {
+    case "1", "true":
+        return true
+    case "0", "false":
+        return false
+    }
+    return strings.HasPrefix(getAppBaseURL(), "https://")
+}
+
+func cookieSameSite() http.SameSite {
+    switch strings.ToLower(os.Getenv("COOKIE_SAMESITE")) {
+    case "strict":
+        return http.SameSiteStrictMode
+    case "none":
+        return http.SameSiteNoneMode
+    default:
+        return http.SameSiteLaxMode
+    }
+}
+
+func sessionCookie(name, value string, maxAge time.Duration, httpOnly bool) *http.Cookie {
+    return &http.Cookie{
+        Name:     name,
+        Value:    value,
+        Path:     "/",
+        MaxAge:   int(maxAge.Seconds()),
+        HttpOnly: httpOnly,
+        Secure:   cookieSecure(),
+        SameSite: cookieSameSite(),
+    }
+}
+
+// setSessionCookies stores a token pair in cookies and returns the new CSRF token.
+func setSessionCookies(w http.ResponseWriter, pair tokenPair) (string, error) {
+    csrf, err := randomToken(32)
+    if err != nil {
+        return "", fmt.Errorf("failed to generate csrf token: %w", err)
+    }
+    http.SetCookie(w, sessionCookie(accessCookieName, pair.AccessToken, getAccessTokenTTL(), true))
+    http.SetCookie(w, sessionCookie(refreshCookieName, pair.RefreshToken, getRefreshTokenTTL(), true))
+    http.SetCookie(w, sessionCookie(csrfCookieName, csrf, getRefreshTokenTTL(), false))
+    return csrf, nil
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+    for _, name := range []string{accessCookieName, refreshCookieName, csrfCookieName} {
+        c := sessionCookie(name, "", 0, name != csrfCookieName)
+        c.MaxAge = -1
+        http.SetCookie(w, c)
+    }
+}
+
+// writeTokenPair responds with the pair either in the body or in cookies.
+// extra fields (e.g. the user) are merged into the body.
+func writeTokenPair(w http.ResponseWriter, pair tokenPair, cookies bool, extra map[string]any) {
+    body := map[string]any{"expires_in": pair.ExpiresIn}
+    for k, v := range extra {
+        body[k] = v
+    }
+    if cookies {
+        csrf, err := setSessionCookies(w, pair)
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, err)
+            return
+        }
+        body["csrf_token"] = csrf
+    } else {
+        body["token"] = pair.AccessToken
+        body["refresh_token"] = pair.RefreshToken
+    }
+    writeJSON(w, http.StatusOK, body)
+}
+
+func isSafeMethod(method string) bool {
+    switch method {
+    case http.MethodGet, http.MethodHead, http.MethodOptions:
+        return true
+    }
+    return false
+}
+
+// validCSRF checks the double-submit token of a cookie-authenticated request.
+func validCSRF(r *http.Request) bool {
+    if isSafeMethod(r.Method) {
+        return true
+    }
+    c, err := r.Cookie(csrfCookieName)
+    if err != nil || c.Value == "" {
+        return false
+    }
+    header := r.Header.Get(csrfHeaderName)
+    return subtle.ConstantTimeCompare([]byte(header), []byte(c.Value)) == 1
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"concerts/db"
+)
+
+const denylistPruneInterval = 10 * time.Minute
+
+var errDenylistUnavailable = errors.New("token revocations could not be loaded, try again later")
+
+// accessDenylist tracks revoked access tokens. Entries are persisted in SQLite
+// and mirrored in memory so RequireAuth never has to hit the database.
+type accessDenylist struct {
+    loadMu sync.Mutex
+    loaded atomic.Bool
+    mu     sync.RWMutex
+    // tokens maps a revoked jti to the unix time its token expires.
+    tokens map[string]int64
+    // generations maps a user id to users.token_generation, for users whose
+    // tokens have been revoked at least once. Tokens carry the generation they
+    // were issued in; earlier generations are revoked.
+    generations map[int64]int64
+}
+
+var denylist = &accessDenylist{
+    tokens:      map[string]int64{},
+    generations: map[int64]int64{},
+}
+
+// ensureLoaded reads the persisted entries on first use. A failed load is
+// retried on the next call; until one succeeds tokens cannot be checked and
+// errDenylistUnavailable is returned.
+func (d *accessDenylist) ensureLoaded() error {
+    if d.loaded.Load() {
+        return nil
+    }
+    d.loadMu.Lock()
+    defer d.loadMu.Unlock()
+    if d.loaded.Load() {
+        return nil
+    }
+    if err := d.load(); err != nil {
+        log.Printf("denylist: failed to load: %v", err)
+        return errDenylistUnavailable
+    }
+    d.loaded.Store(true)
+    go func() {
+        ticker := time.NewTicker(denylistPruneInterval)
+        defer ticker.Stop()
+        for range ticker.C {
+            if err := d.prune(); err != nil {
+                log.Printf("denylist: prune failed: %v", err)
+            }
+        }
+    }()
+    return nil
+}
+
+func (d *accessDenylist) load() error {
+    connection := db.Get()
+    now := time.Now().Unix()
+    rows, err := connection.Query("SELECT jti, expires_at FROM revoked_tokens WHERE expires_at > ?", now)
+    if err != nil {
+        return fmt.Errorf("db query error: %w", err)
+    }
+    defer rows.Close()
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    for rows.Next() {
+        var (
+            jti string
+            exp int64
+        )
+        if err := rows.Scan(&jti, &exp); err != nil {
+            return fmt.Errorf("db scan error: %w", err)
+        }
+        d.tokens[jti] = exp
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    generationRows, err := connection.Query("SELECT id, token_generation FROM users WHERE token_generation > 0")
+    if err != nil {
+        return fmt.Errorf("db query error: %w", err)
+    }
+    defer generationRows.Close()
+    for generationRows.Next() {
+        var uid, generation int64
+        if err := generationRows.Scan(&uid, &generation); err != nil {
+            return fmt.Errorf("db scan error: %w", err)
+        }
+        d.generations[uid] = max(d.generations[uid], generation)
+    }
+    return generationRows.Err()
+}
+
+// prune drops entries whose tokens have expired on their own.
+func (d *accessDenylist) prune() error {
+    now := time.Now()
+    connection := db.Get()
+    if _, err := connection.Exec("DELETE FROM revoked_tokens WHERE expires_at <= ?", now.Unix()); err != nil {
+        return fmt.Errorf("db delete error: %w", err)
+    }
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    for jti, exp := range d.tokens {
+        if exp <= now.Unix() {
+            delete(d.tokens, jti)
+        }
+    }
+    return nil
+}
+
+// revokeToken denylists a single access token until it expires. The entry is
+// persisted first, so it also takes effect if the denylist is not loaded yet.
+func (d *accessDenylist) revokeToken(jti string, uid int64, expiresAt time.Time) error {
+    _, err := db.Get().Exec(
+        "INSERT INTO revoked_tokens (jti, user_id, expires_at) VALUES (?, ?, ?) ON CONFLICT(jti) DO NOTHING",
+        jti, uid, expiresAt.Unix(),
+    )
+    if err != nil {
+        return fmt.Errorf("db insert error: %w", err)
+    }
+    d.mu.Lock()
+    d.tokens[jti] = expiresAt.Unix()
+    d.mu.Unlock()
+    return nil
+}
+
+// revokeUser denylists every access token issued to the user up to now by
+// moving them to a new token generation. Tokens issued right after it, as on
+// a password change, carry the new generation and stay valid.
+func (d *accessDenylist) revokeUser(uid int64) error {
+    var generation int64
+    err := db.Get().QueryRow("UPDATE users SET token_generation = token_generation + 1 WHERE id = ? RETURNING token_generation", uid).Scan(&generation)
+    if err != nil {
+        return fmt.Errorf("db update error: %w", err)
+    }
+    d.mu.Lock()
+    d.generations[uid] = max(d.generations[uid], generation)
+    d.mu.Unlock()
+    return nil
+}
+
+// generation returns the token generation to issue uid's tokens in.
+func (d *accessDenylist) generation(uid int64) (int64, error) {
+    if err := d.ensureLoaded(); err != nil {
+        return 0, err
+    }
+    d.mu.RLock()
+    defer d.mu.RUnlock()
+    return d.generations[uid], nil
+}
+
+// isRevoked reports whether a token has been revoked. It fails with
+// errDenylistUnavailable while the denylist cannot be loaded, and callers
+// must then reject the token.
+func (d *accessDenylist) isRevoked(jti string, uid, generation int64) (bool, error) {
+    if err := d.ensureLoaded(); err != nil {
+        return false, err
+    }
+    d.mu.RLock()
+    defer d.mu.RUnlock()
+    if _, ok := d.tokens[jti]; ok {
+        return true, nil
+    }
+    if generation < d.generations[uid] {
+        return true, nil
+    }
+    return false, nil
+}
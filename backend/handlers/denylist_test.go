@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"concerts/db"
+)
+
+func TestRevokeUserKeepsTokensIssuedAfterIt(t *testing.T) {
+    uid := createUser(t, "revoked-same-second", "right password", "")
+    before, err := signAccessToken(uid, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := denylist.revokeUser(uid); err != nil {
+        t.Fatal(err)
+    }
+    // Issued within the same second as the revocation.
+    after, err := signAccessToken(uid, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for raw, want := range map[string]bool{before: true, after: false} {
+        claims := &accessClaims{}
+        if _, err := parseJWT(raw, claims); err != nil {
+            t.Fatal(err)
+        }
+        if got, err := denylist.isRevoked(claims.ID, uid, claims.Generation); err != nil || got != want {
+            t.Errorf("token of generation %d: revoked = %v, %v, want %v", claims.Generation, got, err, want)
+        }
+        // Times stay whole seconds, as other verifiers of these tokens expect.
+        payload, err := base64.RawURLEncoding.DecodeString(strings.Split(raw, ".")[1])
+        if err != nil {
+            t.Fatal(err)
+        }
+        var times map[string]any
+        dec := json.NewDecoder(bytes.NewReader(payload))
+        dec.UseNumber()
+        if err := dec.Decode(&times); err != nil {
+            t.Fatal(err)
+        }
+        for _, name := range []string{"iat", "exp"} {
+            if n, ok := times[name].(json.Number); !ok || strings.ContainsAny(n.String(), ".eE") {
+                t.Errorf("%s = %v, want whole seconds", name, times[name])
+            }
+        }
+    }
+}
+
+func TestDenylistFailsClosedUntilLoaded(t *testing.T) {
+    uid := createUser(t, "denylist-unavailable", "right password", "")
+    if err := denylist.revokeToken("revoked-before-restart", uid, time.Now().Add(time.Hour)); err != nil {
+        t.Fatal(err)
+    }
+
+    // A restarted server whose first load fails.
+    d := &accessDenylist{tokens: map[string]int64{}, generations: map[int64]int64{}}
+    if _, err := db.Get().Exec("ALTER TABLE revoked_tokens RENAME TO revoked_tokens_away"); err != nil {
+        t.Fatal(err)
+    }
+    _, err := d.isRevoked("revoked-before-restart", uid, 0)
+    if _, restoreErr := db.Get().Exec("ALTER TABLE revoked_tokens_away RENAME TO revoked_tokens"); restoreErr != nil {
+        t.Fatal(restoreErr)
+    }
+    if !errors.Is(err, errDenylistUnavailable) {
+        t.Fatalf("err = %v, want errDenylistUnavailable", err)
+    }
+
+    // The next check loads it.
+    revoked, err := d.isRevoked("revoked-before-restart", uid, 0)
+    if err != nil || !revoked {
+        t.Fatalf("revoked = %v, err = %v, want true, nil", revoked, err)
+    }
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"concerts/db"
+	"concerts/models"
+)
+
+const (
+    inviteDisplayChars = 6
+    defaultInviteDays  = 7
+    maxInviteDays      = 90
+    maxInviteUses      = 100
+)
+
+var errInviteInvalid = errors.New("invalid, expired or used up invite code")
+
+// invitesAdminOnly reports whether only admins may mint invites
+// (INVITES_ADMIN_ONLY=1). By default every user can.
+func invitesAdminOnly() bool {
+    return os.Getenv("INVITES_ADMIN_ONLY") == "1"
+}
+
+// redeemInvite uses up one use of an invite code and returns the invite id.
+func redeemInvite(q queryExecer, code string) (int64, error) {
+    var id int64
+    err := q.QueryRow(
+        `UPDATE invites SET uses = uses + 1
+         WHERE code_hash = ? AND revoked_at IS NULL AND expires_at > ? AND uses < max_uses
+         RETURNING id`,
+        hashToken(code), time.Now().Unix(),
+    ).Scan(&id)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return 0, errInviteInvalid
+        }
+        return 0, fmt.Errorf("db update error: %w", err)
+    }
+    return id, nil
+}
+
+// ListInvites returns the invites created by the authenticated user; admins
+// see every invite.
+func ListInvites(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    role, _ := UserRoleFromContext(r.Context())
+    rows, err := db.Get().Query(
+        `SELECT id, code_prefix, created_by, created_at, expires_at, max_uses, uses FROM invites
+         WHERE revoked_at IS NULL AND (created_by = ? OR ?)
+         ORDER BY created_at DESC, id DESC`,
+        uid, role == RoleAdmin,
+    )
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    defer rows.Close()
+    list := []models.Invite{}
+    for rows.Next() {
+        var inv models.Invite
+        if err := rows.Scan(&inv.ID, &inv.Prefix, &inv.CreatedBy, &inv.CreatedAt, &inv.ExpiresAt, &inv.MaxUses, &inv.Uses); err != nil {
+            writeError(w, http.StatusInternalServerError, fmt.Errorf("db scan error: %w", err))
+            return
+        }
+        list = append(list, inv)
+    }
+    writeJSON(w, http.StatusOK, list)
+}
+
+type createInviteRequest struct {
+    MaxUses       int `json:"max_uses"`
+    ExpiresInDays int `json:"expires_in_days"`
+}
+
+// CreateInvite mints an invite code. The plaintext code is only included in
+// this response.
+func CreateInvite(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    if role, _ := UserRoleFromContext(r.Context()); invitesAdminOnly() && role != RoleAdmin {
+        writeError(w, http.StatusForbidden, errors.New("only admins can create invites"))
+        return
+    }
+    var req createInviteRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    if req.MaxUses == 0 {
+        req.MaxUses = 1
+    }
+    if req.MaxUses < 0 || req.MaxUses > maxInviteUses {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("max_uses must be between 1 and %d", maxInviteUses))
+        return
+    }
+    if req.ExpiresInDays == 0 {
+        req.ExpiresInDays = defaultInviteDays
+    }
+    if req.ExpiresInDays < 0 || req.ExpiresInDays > maxInviteDays {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("expires_in_days must be between 1 and %d", maxInviteDays))
+        return
+    }
+
+    code, err := randomToken(18)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate invite code: %w", err))
+        return
+    }
+    now := time.Now()
+    inv := models.Invite{
+        Prefix:    code[:inviteDisplayChars],
+        CreatedBy: uid,
+        CreatedAt: now.Unix(),
+        ExpiresAt: now.AddDate(0, 0, req.ExpiresInDays).Unix(),
+        MaxUses:   req.MaxUses,
+    }
+    res, err := db.Get().Exec(
+        "INSERT INTO invites (code_hash, code_prefix, created_by, created_at, expires_at, max_uses) VALUES (?, ?, ?, ?, ?, ?)",
+        hashToken(code), inv.Prefix, uid, inv.CreatedAt, inv.ExpiresAt, inv.MaxUses,
+    )
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db insert error: %w", err))
+        return
+    }
+    inv.ID, _ = res.LastInsertId()
+    writeJSON(w, http.StatusCreated, map[string]any{
+        "code":   code,
+        "invite": inv,
+    })
+}
+
+// RevokeInvite revokes an invite created by the authenticated user. Admins
+// can revoke any invite.
+func RevokeInvite(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("invalid id"))
+        return
+    }
+    role, _ := UserRoleFromContext(r.Context())
+    res, err := db.Get().Exec(
+        "UPDATE invites SET revoked_at = ? WHERE id = ? AND (created_by = ? OR ?) AND revoked_at IS NULL",
+        time.Now().Unix(), id, uid, role == RoleAdmin,
+    )
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+        return
+    }
+    n, _ := res.RowsAffected()
+    if n == 0 {
+        writeError(w, http.StatusNotFound, sql.ErrNoRows)
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{"revoked": id})
+}
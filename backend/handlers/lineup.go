@@ -0,0 +1,427 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"concerts/db"
+	"concerts/models"
+)
+
+// Lineup roles. A concert may have several headliners.
+const (
+    lineupHeadliner = "headliner"
+    lineupSupport   = "support"
+)
+
+var lineupRoles = []string{lineupHeadliner, lineupSupport}
+
+const lineupColumns = "l.id, l.concert_id, l.artist_id, a.name, l.role, l.position, l.set_starts_at, l.set_ends_at"
+
+const lineupTables = "lineup_entries l JOIN artists a ON a.id = l.artist_id"
+
+func scanLineupEntry(row rowScanner, loc *time.Location) (models.LineupEntry, error) {
+    var (
+        e            models.LineupEntry
+        starts, ends sql.NullInt64
+    )
+    if err := row.Scan(&e.ID, &e.ConcertID, &e.ArtistID, &e.ArtistName, &e.Role, &e.Position, &starts, &ends); err != nil {
+        return e, err
+    }
+    if starts.Valid {
+        t := time.Unix(starts.Int64, 0).In(loc)
+        e.SetStartsAt = &t
+    }
+    if ends.Valid {
+        t := time.Unix(ends.Int64, 0).In(loc)
+        e.SetEndsAt = &t
+    }
+    return e, nil
+}
+
+// concertLocation is the time zone a concert's times are shown in.
+func concertLocation(c models.Concert) *time.Location {
+    loc, err := loadTimezone(c.Timezone)
+    if err != nil {
+        return time.UTC
+    }
+    return loc
+}
+
+// loadLineup returns the lineup of c in running order.
+func loadLineup(c models.Concert) ([]models.LineupEntry, error) {
+    rows, err := db.Get().Query(
+        "SELECT "+lineupColumns+" FROM "+lineupTables+" WHERE l.concert_id = ? ORDER BY l.position ASC, l.id ASC",
+        c.ID,
+    )
+    if err != nil {
+        return nil, fmt.Errorf("db query error: %w", err)
+    }
+    defer rows.Close()
+    loc := concertLocation(c)
+    list := []models.LineupEntry{}
+    for rows.Next() {
+        e, err := scanLineupEntry(rows, loc)
+        if err != nil {
+            return nil, fmt.Errorf("db scan error: %w", err)
+        }
+        list = append(list, e)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("db query error: %w", err)
+    }
+    return list, nil
+}
+
+func loadLineupEntry(q queryExecer, c models.Concert, id int64) (models.LineupEntry, error) {
+    return scanLineupEntry(
+        q.QueryRow("SELECT "+lineupColumns+" FROM "+lineupTables+" WHERE l.id = ? AND l.concert_id = ?", id, c.ID),
+        concertLocation(c),
+    )
+}
+
+// setLineupTime sets a set time of e from an RFC 3339 time.
+func setLineupTime(e *models.LineupEntry, name, value string) error {
+    t, err := time.Parse(time.RFC3339, value)
+    if err != nil {
+        return fmt.Errorf("%s must be an RFC 3339 time such as 2025-03-12T21:30:00+01:00", name)
+    }
+    if name == "set_ends_at" {
+        e.SetEndsAt = &t
+    } else {
+        e.SetStartsAt = &t
+    }
+    return nil
+}
+
+// validateLineupEntry checks the role and that the set does not end before
+// it starts.
+func validateLineupEntry(e models.LineupEntry) error {
+    if !slices.Contains(lineupRoles, e.Role) {
+        return errors.New("role must be headliner or support")
+    }
+    if e.SetStartsAt != nil && e.SetEndsAt != nil && e.SetEndsAt.Before(*e.SetStartsAt) {
+        return errors.New("set_ends_at must not be before set_starts_at")
+    }
+    return nil
+}
+
+// lineupConcert reads the concert id from the route and loads the concert,
+// writing the error response if that fails.
+func lineupConcert(w http.ResponseWriter, r *http.Request, q queryExecer) (models.Concert, bool) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return models.Concert{}, false
+    }
+    cid, err := strconv.ParseInt(mux.Vars(r)["concertId"], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("invalid concert id"))
+        return models.Concert{}, false
+    }
+    c, err := loadConcert(q, cid, uid)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            writeError(w, http.StatusNotFound, errors.New("concert not found"))
+            return c, false
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return c, false
+    }
+    return c, true
+}
+
+// ListLineup returns a concert's lineup in running order.
+func ListLineup(w http.ResponseWriter, r *http.Request) {
+    c, ok := lineupConcert(w, r, db.Get())
+    if !ok {
+        return
+    }
+    list, err := loadLineup(c)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    writeJSON(w, http.StatusOK, list)
+}
+
+type addLineupRequest struct {
+    // Either ArtistID or ArtistName is required; an artist named ArtistName
+    // is created unless the user already has one.
+    ArtistID   int64  `json:"artist_id"`
+    ArtistName string `json:"artist_name"`
+    // Role defaults to headliner for the first act and support afterwards.
+    Role        string `json:"role"`
+    SetStartsAt string `json:"set_starts_at"`
+    SetEndsAt   string `json:"set_ends_at"`
+}
+
+// AddLineupEntry adds an artist to the end of a concert's lineup.
+func AddLineupEntry(w http.ResponseWriter, r *http.Request) {
+    var req addLineupRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    if (req.ArtistID == 0) == (req.ArtistName == "") {
+        writeError(w, http.StatusBadRequest, errors.New("give either artist_id or artist_name"))
+        return
+    }
+
+    tx, err := db.Get().Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+    c, ok := lineupConcert(w, r, tx)
+    if !ok {
+        return
+    }
+    var count, next int
+    err = tx.QueryRow("SELECT COUNT(*), COALESCE(MAX(position), -1) + 1 FROM lineup_entries WHERE concert_id = ?", c.ID).Scan(&count, &next)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    e := models.LineupEntry{ConcertID: c.ID, Role: req.Role, Position: next}
+    if e.Role == "" {
+        e.Role = lineupSupport
+        if count == 0 {
+            e.Role = lineupHeadliner
+        }
+    }
+    for _, f := range []struct{ name, value string }{{"set_starts_at", req.SetStartsAt}, {"set_ends_at", req.SetEndsAt}} {
+        if f.value == "" {
+            continue
+        }
+        if err := setLineupTime(&e, f.name, f.value); err != nil {
+            writeError(w, http.StatusBadRequest, err)
+            return
+        }
+    }
+    if err := validateLineupEntry(e); err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+
+    if req.ArtistName != "" {
+        name, err := validateArtistName("artist_name", req.ArtistName)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, err)
+            return
+        }
+        a, err := findOrCreateArtist(tx, c.UserID, name)
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, err)
+            return
+        }
+        e.ArtistID = a.ID
+    } else {
+        var exists int
+        if err := tx.QueryRow("SELECT COUNT(*) FROM artists WHERE id = ? AND user_id = ?", req.ArtistID, c.UserID).Scan(&exists); err != nil {
+            writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+            return
+        }
+        if exists == 0 {
+            writeError(w, http.StatusBadRequest, errors.New("artist_id is not one of your artists"))
+            return
+        }
+        e.ArtistID = req.ArtistID
+    }
+
+    err = tx.QueryRow(
+        `INSERT INTO lineup_entries (concert_id, artist_id, role, position, set_starts_at, set_ends_at)
+         VALUES (?, ?, ?, ?, ?, ?) RETURNING id`,
+        c.ID, e.ArtistID, e.Role, e.Position, unixOrNil(e.SetStartsAt), unixOrNil(e.SetEndsAt),
+    ).Scan(&e.ID)
+    if err != nil {
+        if strings.Contains(strings.ToLower(err.Error()), "unique") {
+            writeError(w, http.StatusConflict, errors.New("artist is already in the lineup"))
+            return
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db insert error: %w", err))
+        return
+    }
+    e, err = loadLineupEntry(tx, c, e.ID)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    writeJSON(w, http.StatusCreated, e)
+}
+
+// lineupPatchFields lists the members a lineup entry patch may contain.
+var lineupPatchFields = []string{"role", "set_starts_at", "set_ends_at"}
+
+// UpdateLineupEntry applies a JSON merge patch to a lineup entry (PATCH). Set
+// times can be removed with null; the running order is changed with
+// UpdateLineupOrder.
+func UpdateLineupEntry(w http.ResponseWriter, r *http.Request) {
+    eid, err := strconv.ParseInt(mux.Vars(r)["entryId"], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("invalid lineup entry id"))
+        return
+    }
+    var patch map[string]json.RawMessage
+    if err := readJSON(r, &patch); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    for name := range patch {
+        if !slices.Contains(lineupPatchFields, name) {
+            writeError(w, http.StatusBadRequest, fmt.Errorf("unknown field %q", name))
+            return
+        }
+    }
+
+    tx, err := db.Get().Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+    c, ok := lineupConcert(w, r, tx)
+    if !ok {
+        return
+    }
+    e, err := loadLineupEntry(tx, c, eid)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            writeError(w, http.StatusNotFound, sql.ErrNoRows)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    for _, name := range lineupPatchFields {
+        raw, ok := patch[name]
+        if !ok {
+            continue
+        }
+        if string(raw) == "null" {
+            switch name {
+            case "set_starts_at":
+                e.SetStartsAt = nil
+            case "set_ends_at":
+                e.SetEndsAt = nil
+            default:
+                writeError(w, http.StatusBadRequest, fmt.Errorf("%s is required and cannot be removed", name))
+                return
+            }
+            continue
+        }
+        var value string
+        if err := json.Unmarshal(raw, &value); err != nil {
+            writeError(w, http.StatusBadRequest, fmt.Errorf("%s must be a string", name))
+            return
+        }
+        if name == "role" {
+            e.Role = value
+        } else if err := setLineupTime(&e, name, value); err != nil {
+            writeError(w, http.StatusBadRequest, err)
+            return
+        }
+    }
+    if err := validateLineupEntry(e); err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    _, err = tx.Exec(
+        "UPDATE lineup_entries SET role = ?, set_starts_at = ?, set_ends_at = ? WHERE id = ?",
+        e.Role, unixOrNil(e.SetStartsAt), unixOrNil(e.SetEndsAt), e.ID,
+    )
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+        return
+    }
+    e, err = loadLineupEntry(tx, c, e.ID)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    writeJSON(w, http.StatusOK, e)
+}
+
+// DeleteLineupEntry removes an act from a concert's lineup. The artist is
+// kept.
+func DeleteLineupEntry(w http.ResponseWriter, r *http.Request) {
+    eid, err := strconv.ParseInt(mux.Vars(r)["entryId"], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("invalid lineup entry id"))
+        return
+    }
+    connection := db.Get()
+    c, ok := lineupConcert(w, r, connection)
+    if !ok {
+        return
+    }
+    res, err := connection.Exec("DELETE FROM lineup_entries WHERE id = ? AND concert_id = ?", eid, c.ID)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db delete error: %w", err))
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        writeError(w, http.StatusNotFound, sql.ErrNoRows)
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{"deleted": eid})
+}
+
+// UpdateLineupOrder sets the running order of a concert's lineup, like
+// UpdateSongOrder does for setlists.
+func UpdateLineupOrder(w http.ResponseWriter, r *http.Request) {
+    type lineupOrderUpdate struct {
+        EntryID  int64 `json:"entry_id"`
+        Position int   `json:"position"`
+    }
+    var updates []lineupOrderUpdate
+    if err := readJSON(r, &updates); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+
+    tx, err := db.Get().Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+    c, ok := lineupConcert(w, r, tx)
+    if !ok {
+        return
+    }
+    for _, update := range updates {
+        res, err := tx.Exec("UPDATE lineup_entries SET position = ? WHERE id = ? AND concert_id = ?", update.Position, update.EntryID, c.ID)
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+            return
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+            writeError(w, http.StatusBadRequest, fmt.Errorf("lineup entry %d is not in this concert's lineup", update.EntryID))
+            return
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{"updated": len(updates)})
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"concerts/db"
+	"concerts/mailer"
+)
+
+const (
+    purposeMagicLink = "magic_link"
+    // magicLinkCooldown limits how often links are mailed to one account.
+    magicLinkCooldown = time.Minute
+)
+
+var errMagicLinkDisabled = errors.New("magic link login is disabled")
+
+// magicLinkEnabled reports whether passwordless login is on (MAGIC_LINK_LOGIN=1).
+func magicLinkEnabled() bool {
+    return os.Getenv("MAGIC_LINK_LOGIN") == "1"
+}
+
+func getMagicLinkTTL() time.Duration {
+    return durationFromEnv("MAGIC_LINK_TTL", 15*time.Minute)
+}
+
+type magicLinkRequest struct {
+    Email string `json:"email"`
+}
+
+// RequestMagicLink emails a single-use login link if the address belongs to
+// an active account. The response is the same either way. Requests are
+// throttled per address and per client.
+func RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+    if !magicLinkEnabled() {
+        writeError(w, http.StatusNotFound, errMagicLinkDisabled)
+        return
+    }
+    var req magicLinkRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    email, err := normalizeEmail(req.Email)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    if !allowMailRequest(w, r, email) {
+        return
+    }
+
+    accepted := map[string]string{"message": "if the account exists, a login link has been sent"}
+    connection := db.Get()
+    var (
+        uid      int64
+        username string
+        recent   bool
+    )
+    err = connection.QueryRow(
+        `SELECT u.id, u.username, EXISTS(
+             SELECT 1 FROM one_time_tokens t WHERE t.user_id = u.id AND t.purpose = ? AND t.created_at > ?)
+         FROM users u WHERE u.email = ? AND u.disabled_at IS NULL`,
+        purposeMagicLink, time.Now().Add(-magicLinkCooldown).Unix(), email,
+    ).Scan(&uid, &username, &recent)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            writeJSON(w, http.StatusAccepted, accepted)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if recent {
+        writeJSON(w, http.StatusAccepted, accepted)
+        return
+    }
+    token, err := issueOneTimeToken(connection, uid, purposeMagicLink, getMagicLinkTTL())
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    link := getAppBaseURL() + "/magic-login?token=" + url.QueryEscape(token)
+    sendMailAsync(mailer.Message{
+        To:      email,
+        Subject: "Your login link",
+        Body: fmt.Sprintf("Hi %s,\n\nUse the link below to log in. It expires in %s and can only be used once.\n\n%s\n\nIf you did not ask for this, you can ignore this email.\n",
+            username, getMagicLinkTTL(), link),
+    })
+    writeJSON(w, http.StatusAccepted, accepted)
+}
+
+type redeemMagicLinkRequest struct {
+    Token   string `json:"token"`
+    Session string `json:"session"`
+}
+
+// RedeemMagicLink logs in with a token from RequestMagicLink and responds like
+// Login. Since the link proves control of the mailbox, a pending email
+// verification is completed too.
+func RedeemMagicLink(w http.ResponseWriter, r *http.Request) {
+    if !magicLinkEnabled() {
+        writeError(w, http.StatusNotFound, errMagicLinkDisabled)
+        return
+    }
+    var req redeemMagicLinkRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    if req.Token == "" {
+        writeError(w, http.StatusBadRequest, errors.New("token is required"))
+        return
+    }
+    cookies, err := useCookieSession(req.Session)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+
+    connection := db.Get()
+    tx, err := connection.Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+    uid, err := consumeOneTimeToken(tx, req.Token, purposeMagicLink)
+    if err != nil {
+        if errors.Is(err, errOneTimeTokenInvalid) {
+            _ = tx.Rollback()
+            recordAuthEvent(r, authEvent{Event: eventLogin, Outcome: outcomeFailure, Detail: loginMethodMagicLink + ": " + err.Error()})
+            writeError(w, http.StatusUnauthorized, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    _, err = tx.Exec(
+        "UPDATE users SET email_verified_at = COALESCE(email_verified_at, ?), verification_pending = 0 WHERE id = ?",
+        time.Now().Unix(), uid,
+    )
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+        return
+    }
+    var username string
+    if err := tx.QueryRow("SELECT username FROM users WHERE id = ?", uid).Scan(&username); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    completeLogin(w, r, uid, username, loginMethodMagicLink, cookies)
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"concerts/mailer"
+)
+
+const mailSendTimeout = 30 * time.Second
+
+func getAppBaseURL() string {
+    if u := os.Getenv("APP_BASE_URL"); u != "" {
+        return strings.TrimRight(u, "/")
+    }
+    return "http://localhost:4200"
+}
+
+// sendMailAsync delivers msg in the background so that response timing does
+// not reveal whether an account exists.
+func sendMailAsync(msg mailer.Message) {
+    m := mailer.Get()
+    go func() {
+        ctx, cancel := context.WithTimeout(context.Background(), mailSendTimeout)
+        defer cancel()
+        if err := m.Send(ctx, msg); err != nil {
+            log.Printf("mail to %s failed: %v", msg.To, err)
+        }
+    }()
+}
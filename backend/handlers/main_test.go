@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"concerts/db"
+	"concerts/keys"
+	"concerts/mailer"
+	"concerts/passwords"
+)
+
+// testDir holds the database and mail outbox shared by every test in the
+// package. db.Init runs once per process, so tests keep to their own users
+// and client addresses instead of resetting the database.
+var testDir string
+
+// testOrigin is the app's address in tests, and so also the relying party.
+const testOrigin = "http://localhost:4200"
+
+func TestMain(m *testing.M) {
+    dir, err := os.MkdirTemp("", "concerts-handlers-")
+    if err != nil {
+        log.Fatal(err)
+    }
+    testDir = dir
+    os.Setenv("DB_PATH", filepath.Join(dir, "test.db"))
+    os.Setenv("APP_BASE_URL", testOrigin)
+    os.Setenv("MAIL_OUTBOX_DIR", filepath.Join(dir, "outbox"))
+    os.Setenv("PASSWORD_HASHER", "bcrypt")
+    os.Setenv("BCRYPT_COST", "10")
+    if _, err := db.Init(); err != nil {
+        log.Fatalf("db init failed: %v", err)
+    }
+    if _, err := keys.Init(); err != nil {
+        log.Fatalf("signing keys init failed: %v", err)
+    }
+    if _, err := passwords.Init(); err != nil {
+        log.Fatalf("password hasher init failed: %v", err)
+    }
+    if _, err := passwords.InitPolicy(); err != nil {
+        log.Fatalf("password policy init failed: %v", err)
+    }
+    if _, err := mailer.Init(); err != nil {
+        log.Fatalf("mailer init failed: %v", err)
+    }
+    code := m.Run()
+    os.RemoveAll(dir)
+    os.Exit(code)
+}
+
+// createUser adds an active user with the given password and, unless empty,
+// a verified email address.
+func createUser(t *testing.T, username, password, email string) int64 {
+    t.Helper()
+    hash, err := passwords.Hash(password)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var address, verifiedAt any
+    if email != "" {
+        address, verifiedAt = email, time.Now().Unix()
+    }
+    var uid int64
+    err = db.Get().QueryRow(
+        "INSERT INTO users (username, password_hash, email, email_verified_at) VALUES (?, ?, ?, ?) RETURNING id",
+        username, hash, address, verifiedAt,
+    ).Scan(&uid)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return uid
+}
+
+// call sends body as JSON to handler from the client address ip and returns
+// the recorded response.
+func call(t *testing.T, handler http.HandlerFunc, method, target, ip string, body any) *httptest.ResponseRecorder {
+    t.Helper()
+    var buf bytes.Buffer
+    if body != nil {
+        if err := json.NewEncoder(&buf).Encode(body); err != nil {
+            t.Fatal(err)
+        }
+    }
+    r := httptest.NewRequest(method, target, &buf)
+    r.RemoteAddr = ip + ":40000"
+    w := httptest.NewRecorder()
+    handler(w, r)
+    return w
+}
+
+// asUser runs handler as if RequireAuth had authenticated uid.
+func asUser(uid int64, handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        handler(w, r.WithContext(context.WithValue(r.Context(), userIDContextKey, uid)))
+    }
+}
+
+// decode unmarshals a JSON response body into v.
+func decode(t *testing.T, w *httptest.ResponseRecorder, v any) {
+    t.Helper()
+    if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+        t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+    }
+}
+
+// waitForMail returns the body of the first message sent to address, waiting
+// for sendMailAsync to deliver it.
+func waitForMail(t *testing.T, address string) string {
+    t.Helper()
+    outbox := filepath.Join(testDir, "outbox")
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        files, _ := filepath.Glob(filepath.Join(outbox, "*.eml"))
+        for _, f := range files {
+            raw, err := os.ReadFile(f)
+            if err != nil {
+                continue
+            }
+            header, body, _ := strings.Cut(string(raw), "\r\n\r\n")
+            if strings.Contains(header, "\r\nTo: "+address+"\r\n") {
+                return body
+            }
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    t.Fatalf("no mail to %s", address)
+    return ""
+}
+
+// openDB opens a second, independent connection to the test database, as a
+// restarted server would.
+func openDB(t *testing.T) *sql.DB {
+    t.Helper()
+    c, err := sql.Open("sqlite", "file:"+os.Getenv("DB_PATH")+"?mode=ro")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { c.Close() })
+    return c
+}
@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"concerts/db"
+	"concerts/oidc"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+var (
+    oidcMu        sync.RWMutex
+    oidcProviders = map[string]*oidc.Provider{}
+)
+
+// RegisterOIDCProvider makes a provider available under /oidc/{name}.
+func RegisterOIDCProvider(p *oidc.Provider) {
+    oidcMu.Lock()
+    defer oidcMu.Unlock()
+    oidcProviders[p.Name()] = p
+}
+
+func oidcProvider(name string) (*oidc.Provider, bool) {
+    oidcMu.RLock()
+    defer oidcMu.RUnlock()
+    p, ok := oidcProviders[name]
+    return p, ok
+}
+
+// ListOIDCProviders returns the names of the configured identity providers.
+func ListOIDCProviders(w http.ResponseWriter, r *http.Request) {
+    oidcMu.RLock()
+    names := make([]string, 0, len(oidcProviders))
+    for name := range oidcProviders {
+        names = append(names, name)
+    }
+    oidcMu.RUnlock()
+    sort.Strings(names)
+    writeJSON(w, http.StatusOK, names)
+}
+
+// OIDCLogin starts an authorization code flow by redirecting to the provider.
+// ?session selects how the callback delivers the tokens, as the session
+// field of Login does; browser apps use "cookie".
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+    name := mux.Vars(r)["provider"]
+    provider, ok := oidcProvider(name)
+    if !ok {
+        writeError(w, http.StatusNotFound, errors.New("unknown identity provider"))
+        return
+    }
+    session := r.URL.Query().Get("session")
+    if _, err := useCookieSession(session); err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    if session == "" {
+        session = sessionModeBearer
+    }
+    state, err := randomToken(32)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate state: %w", err))
+        return
+    }
+    nonce, err := randomToken(32)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate nonce: %w", err))
+        return
+    }
+    verifier, err := randomToken(32)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate code verifier: %w", err))
+        return
+    }
+    authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+    if err != nil {
+        writeError(w, http.StatusBadGateway, err)
+        return
+    }
+    now := time.Now()
+    _, err = db.Get().Exec(
+        "INSERT INTO oidc_login_states (state_hash, provider, nonce, code_verifier, session_mode, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+        hashToken(state), name, nonce, verifier, session, now.Add(oidcStateTTL).Unix(),
+    )
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db insert error: %w", err))
+        return
+    }
+    if _, err := db.Get().Exec("DELETE FROM oidc_login_states WHERE expires_at <= ?", now.Unix()); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db delete error: %w", err))
+        return
+    }
+    redirect(w, r, authURL)
+}
+
+// OIDCCallback completes the flow: it redeems the code, links or creates the
+// local account and responds like Login, in the session mode chosen when the
+// flow started.
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+    name := mux.Vars(r)["provider"]
+    provider, ok := oidcProvider(name)
+    if !ok {
+        writeError(w, http.StatusNotFound, errors.New("unknown identity provider"))
+        return
+    }
+    q := r.URL.Query()
+    if e := q.Get("error"); e != "" {
+        writeError(w, http.StatusUnauthorized, fmt.Errorf("identity provider returned %s: %s", e, q.Get("error_description")))
+        return
+    }
+    code, state := q.Get("code"), q.Get("state")
+    if code == "" || state == "" {
+        writeError(w, http.StatusBadRequest, errors.New("code and state are required"))
+        return
+    }
+
+    connection := db.Get()
+    var nonce, verifier, session string
+    err := connection.QueryRow(
+        "DELETE FROM oidc_login_states WHERE state_hash = ? AND provider = ? AND expires_at > ? RETURNING nonce, code_verifier, session_mode",
+        hashToken(state), name, time.Now().Unix(),
+    ).Scan(&nonce, &verifier, &session)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            writeError(w, http.StatusBadRequest, errors.New("invalid or expired state"))
+            return
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+
+    claims, err := provider.Exchange(r.Context(), code, verifier, nonce)
+    if err != nil {
+        recordAuthEvent(r, authEvent{Event: eventLogin, Outcome: outcomeFailure, Detail: "oidc:" + name + ": " + err.Error()})
+        writeError(w, http.StatusUnauthorized, err)
+        return
+    }
+    uid, username, err := linkOIDCIdentity(name, claims)
+    if err != nil {
+        if errors.Is(err, errRegistrationClosed) || errors.Is(err, errEmailNotVerified) || errors.Is(err, errEmailUnverifiedAccount) {
+            recordAuthEvent(r, authEvent{Event: eventLogin, Outcome: outcomeFailure, Detail: "oidc:" + name + ": " + err.Error()})
+            writeError(w, http.StatusForbidden, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    cookies, _ := useCookieSession(session)
+    completeLogin(w, r, uid, username, "oidc:"+name, cookies)
+}
+
+var errEmailUnverifiedAccount = errors.New("an account with this email exists but has not verified it; sign in to it and verify the address first")
+
+// linkOIDCIdentity finds the local user for an external identity. Unknown
+// identities are linked to the account with the same verified email, or get a
+// fresh account without a local password if the registration mode allows it.
+func linkOIDCIdentity(provider string, claims *oidc.Claims) (int64, string, error) {
+    connection := db.Get()
+    tx, err := connection.Begin()
+    if err != nil {
+        return 0, "", fmt.Errorf("db transaction error: %w", err)
+    }
+    defer tx.Rollback()
+
+    var (
+        uid      int64
+        username string
+    )
+    err = tx.QueryRow(
+        "SELECT u.id, u.username FROM user_identities i JOIN users u ON u.id = i.user_id WHERE i.provider = ? AND i.subject = ?",
+        provider, claims.Subject,
+    ).Scan(&uid, &username)
+    if err == nil {
+        return uid, username, nil
+    }
+    if !errors.Is(err, sql.ErrNoRows) {
+        return 0, "", fmt.Errorf("db query error: %w", err)
+    }
+
+    var email sql.NullString
+    if claims.EmailVerified {
+        if normalized, err := normalizeEmail(claims.Email); err == nil {
+            email = sql.NullString{String: normalized, Valid: true}
+        }
+    }
+    found := false
+    if email.Valid {
+        // Only an address the local user has proven to own may link: anyone
+        // can put someone else's address on their own account.
+        var verified bool
+        err = tx.QueryRow("SELECT id, username, email_verified_at IS NOT NULL FROM users WHERE email = ?", email.String).Scan(&uid, &username, &verified)
+        switch {
+        case err == nil && !verified:
+            return 0, "", errEmailUnverifiedAccount
+        case err == nil:
+            found = true
+        case !errors.Is(err, sql.ErrNoRows):
+            return 0, "", fmt.Errorf("db query error: %w", err)
+        }
+    }
+    if !found {
+        switch registrationMode() {
+        case RegistrationInvite:
+            return 0, "", errRegistrationClosed
+        case RegistrationEmail:
+            if !email.Valid {
+                return 0, "", errEmailNotVerified
+            }
+        }
+        username, err = availableUsername(tx, usernameCandidate(claims))
+        if err != nil {
+            return 0, "", err
+        }
+        var verifiedAt sql.NullInt64
+        if email.Valid {
+            verifiedAt = sql.NullInt64{Int64: time.Now().Unix(), Valid: true}
+        }
+        res, err := tx.Exec("INSERT INTO users (username, password_hash, email, email_verified_at) VALUES (?, '', ?, ?)", username, email, verifiedAt)
+        if err != nil {
+            return 0, "", fmt.Errorf("failed to insert user: %w", err)
+        }
+        uid, _ = res.LastInsertId()
+    }
+    _, err = tx.Exec(
+        "INSERT INTO user_identities (provider, subject, user_id, email, created_at) VALUES (?, ?, ?, ?, ?)",
+        provider, claims.Subject, uid, email, time.Now().Unix(),
+    )
+    if err != nil {
+        return 0, "", fmt.Errorf("db insert error: %w", err)
+    }
+    if err := tx.Commit(); err != nil {
+        return 0, "", fmt.Errorf("db commit error: %w", err)
+    }
+    return uid, username, nil
+}
+
+var usernameDisallowed = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+func usernameCandidate(claims *oidc.Claims) string {
+    candidate := claims.PreferredUsername
+    if candidate == "" && claims.Email != "" {
+        candidate, _, _ = strings.Cut(claims.Email, "@")
+    }
+    candidate = usernameDisallowed.ReplaceAllString(candidate, "")
+    if len(candidate) < 3 {
+        candidate = "user"
+    }
+    return candidate
+}
+
+// availableUsername returns base, or base with the smallest numeric suffix
+// that is not taken yet.
+func availableUsername(q queryExecer, base string) (string, error) {
+    candidate := base
+    for i := 2; ; i++ {
+        var exists bool
+        if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", candidate).Scan(&exists); err != nil {
+            return "", fmt.Errorf("db query error: %w", err)
+        }
+        if !exists {
+            return candidate, nil
+        }
+        candidate = base + strconv.Itoa(i)
+    }
+}
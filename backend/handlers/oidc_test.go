@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+
+	"concerts/db"
+	"concerts/jwk"
+	"concerts/oidc"
+)
+
+const (
+    fakeIdPClientID = "concerts"
+    oidcIP          = "192.0.2.160"
+)
+
+// fakeIdP is an OpenID provider serving discovery, its signing key and a
+// token endpoint that enforces PKCE. Codes come from authorize, which stands
+// in for the user signing in at the provider.
+type fakeIdP struct {
+    server *httptest.Server
+    key    ed25519.PrivateKey
+
+    mu     sync.Mutex
+    grants map[string]fakeGrant
+}
+
+// fakeGrant is what the provider remembers about an issued code.
+type fakeGrant struct {
+    challenge string
+    nonce     string
+    claims    jwt.MapClaims
+}
+
+// newFakeIdP starts a provider and registers it under the name "fake".
+func newFakeIdP(t *testing.T) *fakeIdP {
+    t.Helper()
+    _, key, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    idp := &fakeIdP{key: key, grants: map[string]fakeGrant{}}
+    routes := http.NewServeMux()
+    routes.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+        base := idp.server.URL
+        writeJSON(w, http.StatusOK, map[string]string{
+            "issuer":                 base,
+            "authorization_endpoint": base + "/authorize",
+            "token_endpoint":         base + "/token",
+            "jwks_uri":               base + "/jwks",
+        })
+    })
+    routes.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+        k, err := jwk.FromPublicKey("test", "EdDSA", key.Public())
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, err)
+            return
+        }
+        writeJSON(w, http.StatusOK, jwk.Set{Keys: []jwk.Key{k}})
+    })
+    routes.HandleFunc("/token", idp.token)
+    idp.server = httptest.NewServer(routes)
+    t.Cleanup(idp.server.Close)
+
+    RegisterOIDCProvider(oidc.NewProvider(oidc.Config{
+        Name:        "fake",
+        Issuer:      idp.server.URL,
+        ClientID:    fakeIdPClientID,
+        RedirectURL: testOrigin + "/oidc/fake/callback",
+    }, idp.server.Client()))
+    return idp
+}
+
+// authorize signs in at the provider as the user with the given claims and
+// returns the code and state the provider redirects back with.
+func (idp *fakeIdP) authorize(t *testing.T, authURL string, claims jwt.MapClaims) (string, string) {
+    t.Helper()
+    u, err := url.Parse(authURL)
+    if err != nil {
+        t.Fatal(err)
+    }
+    q := u.Query()
+    if !strings.HasPrefix(authURL, idp.server.URL+"/authorize?") || q.Get("client_id") != fakeIdPClientID || q.Get("code_challenge_method") != "S256" {
+        t.Fatalf("unexpected authorization request %s", authURL)
+    }
+    code, err := randomToken(16)
+    if err != nil {
+        t.Fatal(err)
+    }
+    idp.mu.Lock()
+    idp.grants[code] = fakeGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), claims: claims}
+    idp.mu.Unlock()
+    return code, q.Get("state")
+}
+
+// token redeems a code once, if the code verifier matches its challenge.
+func (idp *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+    if err := r.ParseForm(); err != nil {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+        return
+    }
+    idp.mu.Lock()
+    grant, ok := idp.grants[r.PostForm.Get("code")]
+    delete(idp.grants, r.PostForm.Get("code"))
+    idp.mu.Unlock()
+    if !ok || oidc.PKCEChallenge(r.PostForm.Get("code_verifier")) != grant.challenge {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+        return
+    }
+    now := time.Now()
+    claims := jwt.MapClaims{
+        "iss":   idp.server.URL,
+        "aud":   fakeIdPClientID,
+        "iat":   now.Unix(),
+        "exp":   now.Add(5 * time.Minute).Unix(),
+        "nonce": grant.nonce,
+    }
+    for k, v := range grant.claims {
+        claims[k] = v
+    }
+    token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+    token.Header["kid"] = "test"
+    signed, err := token.SignedString(idp.key)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]string{"id_token": signed, "token_type": "Bearer", "access_token": "unused"})
+}
+
+func oidcRoutes(w http.ResponseWriter, r *http.Request) {
+    routes := mux.NewRouter()
+    routes.HandleFunc("/oidc/{provider}/login", OIDCLogin)
+    routes.HandleFunc("/oidc/{provider}/callback", OIDCCallback)
+    routes.ServeHTTP(w, r)
+}
+
+// startOIDC begins a login and returns the provider URL it redirects to.
+func startOIDC(t *testing.T, session string) string {
+    t.Helper()
+    w := call(t, oidcRoutes, http.MethodGet, "/oidc/fake/login?session="+session, oidcIP, nil)
+    expectStatus(t, w, http.StatusFound)
+    return w.Header().Get("Location")
+}
+
+func oidcCallback(t *testing.T, code, state string) *httptest.ResponseRecorder {
+    t.Helper()
+    q := url.Values{"code": {code}, "state": {state}}
+    return call(t, oidcRoutes, http.MethodGet, "/oidc/fake/callback?"+q.Encode(), oidcIP, nil)
+}
+
+// oidcLogin runs a whole login as the user with the given claims.
+func oidcLogin(t *testing.T, idp *fakeIdP, claims jwt.MapClaims) *httptest.ResponseRecorder {
+    t.Helper()
+    code, state := idp.authorize(t, startOIDC(t, ""), claims)
+    return oidcCallback(t, code, state)
+}
+
+type oidcLoginResponse struct {
+    Token string `json:"token"`
+    User  struct {
+        ID       int64  `json:"id"`
+        Username string `json:"username"`
+    } `json:"user"`
+}
+
+func TestOIDCLoginWithPKCE(t *testing.T) {
+    idp := newFakeIdP(t)
+    claims := jwt.MapClaims{"sub": "pkce-user", "email": "pkce@example.com", "email_verified": true, "preferred_username": "pkce-user"}
+
+    w := oidcLogin(t, idp, claims)
+    expectStatus(t, w, http.StatusOK)
+    var res oidcLoginResponse
+    decode(t, w, &res)
+    if res.Token == "" || res.User.Username != "pkce-user" {
+        t.Fatalf("unexpected response %s", w.Body)
+    }
+
+    // A code issued for one flow is refused when injected into another, as
+    // the other flow's code verifier does not match.
+    victim := startOIDC(t, "")
+    code, _ := idp.authorize(t, victim, claims)
+    _, state := idp.authorize(t, startOIDC(t, ""), claims)
+    w = oidcCallback(t, code, state)
+    expectStatus(t, w, http.StatusUnauthorized)
+    if !strings.Contains(w.Body.String(), "invalid_grant") {
+        t.Fatalf("unexpected error %s", w.Body)
+    }
+}
+
+func TestOIDCLoginWithCookieSession(t *testing.T) {
+    idp := newFakeIdP(t)
+    expectStatus(t, call(t, oidcRoutes, http.MethodGet, "/oidc/fake/login?session=jar", oidcIP, nil), http.StatusBadRequest)
+
+    code, state := idp.authorize(t, startOIDC(t, sessionModeCookie), jwt.MapClaims{"sub": "cookie-user", "preferred_username": "cookie-user"})
+    w := oidcCallback(t, code, state)
+    expectStatus(t, w, http.StatusOK)
+    var res map[string]any
+    decode(t, w, &res)
+    if _, ok := res["token"]; ok {
+        t.Fatalf("token in body of a cookie session: %s", w.Body)
+    }
+    set := map[string]bool{}
+    for _, c := range w.Result().Cookies() {
+        set[c.Name] = c.Value != ""
+    }
+    if !set[accessCookieName] || !set[refreshCookieName] || !set[csrfCookieName] {
+        t.Fatalf("cookies = %v, want access, refresh and csrf cookies", set)
+    }
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+    idp := newFakeIdP(t)
+    claims := jwt.MapClaims{"sub": "state-user", "preferred_username": "state-user"}
+
+    code, _ := idp.authorize(t, startOIDC(t, ""), claims)
+    expectStatus(t, oidcCallback(t, code, "not-a-state-we-issued"), http.StatusBadRequest)
+
+    // States are single use.
+    code, state := idp.authorize(t, startOIDC(t, ""), claims)
+    expectStatus(t, oidcCallback(t, code, state), http.StatusOK)
+    code, _ = idp.authorize(t, startOIDC(t, ""), claims)
+    expectStatus(t, oidcCallback(t, code, state), http.StatusBadRequest)
+}
+
+func TestOIDCEmailLinking(t *testing.T) {
+    idp := newFakeIdP(t)
+
+    // A verified local address links the identity to that account.
+    uid := createUser(t, "linked-local", "right password", "linked@example.com")
+    w := oidcLogin(t, idp, jwt.MapClaims{"sub": "linked-sub", "email": "Linked@Example.com", "email_verified": true})
+    expectStatus(t, w, http.StatusOK)
+    var res oidcLoginResponse
+    decode(t, w, &res)
+    if res.User.ID != uid {
+        t.Fatalf("logged in as %d, want linked account %d", res.User.ID, uid)
+    }
+    // Later logins find the identity, whatever email it has by then.
+    w = oidcLogin(t, idp, jwt.MapClaims{"sub": "linked-sub", "email": "changed@example.com", "email_verified": true})
+    expectStatus(t, w, http.StatusOK)
+    decode(t, w, &res)
+    if res.User.ID != uid {
+        t.Fatalf("logged in as %d, want linked account %d", res.User.ID, uid)
+    }
+
+    // An address the provider has not verified links nothing.
+    w = oidcLogin(t, idp, jwt.MapClaims{"sub": "unverified-claim-sub", "email": "linked@example.com", "email_verified": false, "preferred_username": "claimer"})
+    expectStatus(t, w, http.StatusOK)
+    decode(t, w, &res)
+    if res.User.ID == uid {
+        t.Fatal("an unverified email claim was linked to an existing account")
+    }
+
+    // Nor does an address the local user has not verified.
+    if _, err := db.Get().Exec("INSERT INTO users (username, password_hash, email) VALUES ('unverified-local', '', 'unverified@example.com')"); err != nil {
+        t.Fatal(err)
+    }
+    w = oidcLogin(t, idp, jwt.MapClaims{"sub": "squatter-sub", "email": "unverified@example.com", "email_verified": true})
+    expectStatus(t, w, http.StatusForbidden)
+    var identities int
+    if err := openDB(t).QueryRow("SELECT COUNT(*) FROM user_identities WHERE subject = 'squatter-sub'").Scan(&identities); err != nil {
+        t.Fatal(err)
+    }
+    if identities != 0 {
+        t.Fatalf("%d identities linked for a refused login", identities)
+    }
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Purposes for single-use tokens stored in one_time_tokens.
+const (
+    purposePasswordReset = "password_reset"
+)
+
+var errOneTimeTokenInvalid = errors.New("invalid or expired token")
+
+// queryExecer is satisfied by both *sql.DB and *sql.Tx.
+type queryExecer interface {
+    execer
+    QueryRow(query string, args ...any) *sql.Row
+}
+
+// issueOneTimeToken creates a single-use token for the given purpose. Any
+// still-unused token for the same user and purpose is invalidated.
+func issueOneTimeToken(q execer, uid int64, purpose string, ttl time.Duration) (string, error) {
+    now := time.Now()
+    if _, err := q.Exec("UPDATE one_time_tokens SET used_at = ? WHERE user_id = ? AND purpose = ? AND used_at IS NULL", now.Unix(), uid, purpose); err != nil {
+        return "", fmt.Errorf("db update error: %w", err)
+    }
+    raw, err := randomToken(32)
+    if err != nil {
+        return "", fmt.Errorf("failed to generate token: %w", err)
+    }
+    _, err = q.Exec(
+        "INSERT INTO one_time_tokens (token_hash, user_id, purpose, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+        hashToken(raw), uid, purpose, now.Unix(), now.Add(ttl).Unix(),
+    )
+    if err != nil {
+        return "", fmt.Errorf("db insert error: %w", err)
+    }
+    return raw, nil
+}
+
+// consumeOneTimeToken marks a token as used and returns its user id. It fails
+// with errOneTimeTokenInvalid if the token is unknown, used or expired.
+func consumeOneTimeToken(q queryExecer, raw, purpose string) (int64, error) {
+    now := time.Now().Unix()
+    var uid int64
+    err := q.QueryRow(
+        `UPDATE one_time_tokens SET used_at = ?
+         WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+         RETURNING user_id`,
+        now, hashToken(raw), purpose, now,
+    ).Scan(&uid)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return 0, errOneTimeTokenInvalid
+        }
+        return 0, fmt.Errorf("db update error: %w", err)
+    }
+    return uid, nil
+}
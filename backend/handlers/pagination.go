@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"concerts/db"
+)
+
+const (
+    defaultPageLimit = 50
+    maxPageLimit     = 200
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// sortKey is a column a list can be sorted by. Expr must not be NULL, so that
+// rows can be compared with the values in a cursor.
+type sortKey struct {
+    Expr    string
+    Numeric bool
+}
+
+// listSpec describes the sorting a list endpoint offers. Every sort ends with
+// the id as a tie-breaker, so the order is total and pages never overlap.
+type listSpec struct {
+    Keys map[string]sortKey
+}
+
+type sortField struct {
+    name string
+    key  sortKey
+    desc bool
+}
+
+// listPage is a parsed page request: the sort, the page size, and where the
+// previous page ended.
+type listPage struct {
+    sort   string
+    fields []sortField
+    limit  int
+    after  *pageCursor
+}
+
+// pageCursor is the position after the last row of a page. It is handed to
+// clients base64url-encoded and is opaque to them.
+type pageCursor struct {
+    Sort   string            `json:"s"`
+    Values []json.RawMessage `json:"v"`
+    ID     int64             `json:"id"`
+}
+
+// parseListPage reads the sort, limit and cursor parameters. sort is a comma
+// separated list of keys, each descending when prefixed with "-"; defaultSort
+// is used when it is absent.
+func parseListPage(q url.Values, spec listSpec, defaultSort string) (listPage, error) {
+    p := listPage{sort: q.Get("sort"), limit: defaultPageLimit}
+    if p.sort == "" {
+        p.sort = defaultSort
+    }
+    seen := map[string]bool{}
+    for _, name := range strings.Split(p.sort, ",") {
+        f := sortField{name: strings.TrimSpace(name)}
+        if strings.HasPrefix(f.name, "-") {
+            f.name, f.desc = f.name[1:], true
+        }
+        key, ok := spec.Keys[f.name]
+        if !ok || seen[f.name] {
+            return p, fmt.Errorf("sort must be a list of %s, each optionally prefixed with -", strings.Join(sortKeyNames(spec), ", "))
+        }
+        seen[f.name], f.key = true, key
+        p.fields = append(p.fields, f)
+    }
+    if v := q.Get("limit"); v != "" {
+        limit, err := strconv.Atoi(v)
+        if err != nil || limit < 1 || limit > maxPageLimit {
+            return p, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+        }
+        p.limit = limit
+    }
+    if v := q.Get("cursor"); v != "" {
+        raw, err := base64.RawURLEncoding.DecodeString(v)
+        if err != nil {
+            return p, errInvalidCursor
+        }
+        var c pageCursor
+        if err := json.Unmarshal(raw, &c); err != nil || len(c.Values) != len(p.fields) {
+            return p, errInvalidCursor
+        }
+        if c.Sort != p.sort {
+            return p, errors.New("cursor was issued for a different sort")
+        }
+        p.after = &c
+    }
+    return p, nil
+}
+
+func sortKeyNames(spec listSpec) []string {
+    names := make([]string, 0, len(spec.Keys))
+    for name := range spec.Keys {
+        names = append(names, name)
+    }
+    slices.Sort(names)
+    return names
+}
+
+// orderBy returns the ORDER BY clause of the page's sort.
+func (p listPage) orderBy() string {
+    terms := make([]string, 0, len(p.fields)+1)
+    for _, f := range p.fields {
+        terms = append(terms, f.key.Expr+direction(f.desc))
+    }
+    return strings.Join(append(terms, "id"+direction(p.idDesc())), ", ")
+}
+
+// idDesc reports the direction of the id tie-breaker, which follows the last
+// sort key.
+func (p listPage) idDesc() bool {
+    return p.fields[len(p.fields)-1].desc
+}
+
+func direction(desc bool) string {
+    if desc {
+        return " DESC"
+    }
+    return " ASC"
+}
+
+// seek returns the condition selecting the rows after the cursor:
+// (k1 > v1) OR (k1 = v1 AND k2 > v2) OR ... OR (all equal AND id > last id).
+func (p listPage) seek() (string, []any, error) {
+    var (
+        alternatives []string
+        args         []any
+        equal        []string
+        equalArgs    []any
+    )
+    for i, f := range p.fields {
+        value, err := cursorValue(p.after.Values[i], f.key.Numeric)
+        if err != nil {
+            return "", nil, err
+        }
+        op := ">"
+        if f.desc {
+            op = "<"
+        }
+        alternatives = append(alternatives, "("+strings.Join(append(slices.Clone(equal), f.key.Expr+" "+op+" ?"), " AND ")+")")
+        args = append(append(args, equalArgs...), value)
+        equal, equalArgs = append(equal, f.key.Expr+" = ?"), append(equalArgs, value)
+    }
+    op := ">"
+    if p.idDesc() {
+        op = "<"
+    }
+    alternatives = append(alternatives, "("+strings.Join(append(equal, "id "+op+" ?"), " AND ")+")")
+    args = append(append(args, equalArgs...), p.after.ID)
+    return "(" + strings.Join(alternatives, " OR ") + ")", args, nil
+}
+
+func cursorValue(raw json.RawMessage, numeric bool) (any, error) {
+    if numeric {
+        var n int64
+        if err := json.Unmarshal(raw, &n); err != nil {
+            return nil, errInvalidCursor
+        }
+        return n, nil
+    }
+    var s string
+    if err := json.Unmarshal(raw, &s); err != nil {
+        return nil, errInvalidCursor
+    }
+    return s, nil
+}
+
+// keyScanner scans a row whose sort key values and id follow the columns
+// the row's own scan function reads.
+type keyScanner struct {
+    rowScanner
+    keys []any
+}
+
+func (s keyScanner) Scan(dest ...any) error {
+    return s.rowScanner.Scan(append(dest, s.keys...)...)
+}
+
+// queryPage selects one page of rows from table. columns are read by scan;
+// where and args filter the rows before the cursor is applied. The returned
+// cursor is empty on the last page.
+func queryPage[T any](p listPage, columns, table string, where []string, args []any, scan func(rowScanner) (T, error)) ([]T, string, error) {
+    if p.after != nil {
+        cond, seekArgs, err := p.seek()
+        if err != nil {
+            return nil, "", err
+        }
+        where, args = append(where, cond), append(args, seekArgs...)
+    }
+    query := "SELECT " + columns
+    for _, f := range p.fields {
+        query += ", " + f.key.Expr
+    }
+    query += ", id FROM " + table
+    if len(where) > 0 {
+        query += " WHERE " + strings.Join(where, " AND ")
+    }
+    query += " ORDER BY " + p.orderBy() + " LIMIT ?"
+    rows, err := db.Get().Query(query, append(args, p.limit+1)...)
+    if err != nil {
+        return nil, "", fmt.Errorf("db query error: %w", err)
+    }
+    defer rows.Close()
+
+    list := []T{}
+    var last pageCursor
+    for rows.Next() {
+        if len(list) == p.limit {
+            return list, encodeCursor(last), nil
+        }
+        keys := make([]any, len(p.fields)+1)
+        values := make([]any, len(p.fields))
+        for i, f := range p.fields {
+            if f.key.Numeric {
+                values[i] = new(int64)
+            } else {
+                values[i] = new(string)
+            }
+            keys[i] = values[i]
+        }
+        last = pageCursor{Sort: p.sort}
+        keys[len(p.fields)] = &last.ID
+        item, err := scan(keyScanner{rows, keys})
+        if err != nil {
+            return nil, "", fmt.Errorf("db scan error: %w", err)
+        }
+        for _, v := range values {
+            raw, _ := json.Marshal(v)
+            last.Values = append(last.Values, raw)
+        }
+        list = append(list, item)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, "", fmt.Errorf("db query error: %w", err)
+    }
+    return list, "", nil
+}
+
+func encodeCursor(c pageCursor) string {
+    raw, _ := json.Marshal(c)
+    return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// setNextPage points clients at the next page, both in a Link header and as a
+// bare cursor in X-Next-Cursor. Nothing is set on the last page.
+func setNextPage(w http.ResponseWriter, r *http.Request, cursor string) {
+    if cursor == "" {
+        return
+    }
+    next := *r.URL
+    q := next.Query()
+    q.Set("cursor", cursor)
+    next.RawQuery = q.Encode()
+    w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+    w.Header().Set("X-Next-Cursor", cursor)
+}
+
+// likePattern returns a LIKE pattern, with ESCAPE '\', matching values that
+// contain s.
+func likePattern(s string) string {
+    return "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s) + "%"
+}
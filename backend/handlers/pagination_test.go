@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"concerts/db"
+	"concerts/models"
+)
+
+func TestConcertPagesCoverEveryRowOnce(t *testing.T) {
+    uid := createUser(t, "pager", "right password", "")
+    // Few distinct values, differing only in case, so pages end inside runs
+    // of equal sort keys.
+    titles := []string{"Tour", "tour", "Encore"}
+    locations := []string{"Lisbon", "LISBON", "porto", "Porto", "Braga"}
+    starts := []int64{1_700_000_000, 1_700_086_400, 1_700_000_000, 1_700_172_800}
+    var all []models.Concert
+    for i := 0; i < 17; i++ {
+        c := models.Concert{Title: titles[i%len(titles)], Location: locations[i%len(locations)], UserID: uid}
+        var startsAt int64
+        err := db.Get().QueryRow(
+            "INSERT INTO concerts (title, date, location, user_id, starts_at, timezone) VALUES (?, '', ?, ?, ?, 'UTC') RETURNING id, starts_at",
+            c.Title, c.Location, uid, starts[i%len(starts)],
+        ).Scan(&c.ID, &startsAt)
+        if err != nil {
+            t.Fatal(err)
+        }
+        c.Date = fmt.Sprint(startsAt)
+        all = append(all, c)
+    }
+
+    keys := map[string]func(c models.Concert) string{
+        "title":    func(c models.Concert) string { return strings.ToLower(c.Title) },
+        "location": func(c models.Concert) string { return strings.ToLower(c.Location) },
+        "date":     func(c models.Concert) string { return c.Date },
+    }
+    for _, sort := range []string{"location", "-location", "title,-date", "-title,location", "date", "-date,-location,title"} {
+        for _, limit := range []int{1, 2, 5} {
+            // The order the pages must add up to, computed independently.
+            want := slices.Clone(all)
+            fields := strings.Split(sort, ",")
+            slices.SortFunc(want, func(a, b models.Concert) int {
+                desc := false
+                for _, f := range fields {
+                    name := strings.TrimPrefix(f, "-")
+                    desc = name != f
+                    if c := cmp.Compare(keys[name](a), keys[name](b)); c != 0 {
+                        if desc {
+                            return -c
+                        }
+                        return c
+                    }
+                }
+                if desc {
+                    return cmp.Compare(b.ID, a.ID)
+                }
+                return cmp.Compare(a.ID, b.ID)
+            })
+
+            var got []int64
+            cursor := ""
+            for pages := 0; ; pages++ {
+                if pages > len(all) {
+                    t.Fatalf("sort %s, limit %d: pages never end", sort, limit)
+                }
+                q := url.Values{"sort": {sort}, "limit": {fmt.Sprint(limit)}}
+                if cursor != "" {
+                    q.Set("cursor", cursor)
+                }
+                w := call(t, asUser(uid, ListConcerts), http.MethodGet, "/concerts?"+q.Encode(), "192.0.2.170", nil)
+                expectStatus(t, w, http.StatusOK)
+                var page []models.Concert
+                decode(t, w, &page)
+                for _, c := range page {
+                    got = append(got, c.ID)
+                }
+                if cursor = w.Header().Get("X-Next-Cursor"); cursor == "" {
+                    break
+                }
+            }
+            wantIDs := make([]int64, len(want))
+            for i, c := range want {
+                wantIDs[i] = c.ID
+            }
+            if !slices.Equal(got, wantIDs) {
+                t.Errorf("sort %s, limit %d: got ids %v, want %v", sort, limit, got, wantIDs)
+            }
+        }
+    }
+
+    // A cursor only continues the sort it was issued for.
+    w := call(t, asUser(uid, ListConcerts), http.MethodGet, "/concerts?sort=location&limit=2", "192.0.2.170", nil)
+    expectStatus(t, w, http.StatusOK)
+    cursor := w.Header().Get("X-Next-Cursor")
+    expectStatus(t, call(t, asUser(uid, ListConcerts), http.MethodGet, "/concerts?sort=-location&limit=2&cursor="+cursor, "192.0.2.170", nil), http.StatusBadRequest)
+    expectStatus(t, call(t, asUser(uid, ListConcerts), http.MethodGet, "/concerts?sort=location&cursor=bm9wZQ", "192.0.2.170", nil), http.StatusBadRequest)
+}
@@ -0,0 +1,523 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"concerts/db"
+	"concerts/models"
+	"concerts/webauthn"
+)
+
+const (
+    purposePasskeyRegistration = "registration"
+    purposePasskeyLogin        = "login"
+    maxPasskeysPerUser         = 20
+    maxPasskeyNameLen          = 100
+    userHandleBytes            = 32
+)
+
+// knownTransports are the AuthenticatorTransport values kept from
+// registration responses and passed back to browsers as hints.
+var knownTransports = []string{"ble", "hybrid", "internal", "nfc", "smart-card", "usb"}
+
+var errPasskeyInvalid = errors.New("invalid or expired passkey response")
+
+// relyingParty describes this site to authenticators: WEBAUTHN_RP_ID
+// (defaults to the host of APP_BASE_URL), WEBAUTHN_RP_NAME and the comma
+// separated WEBAUTHN_ORIGINS (defaults to APP_BASE_URL).
+func relyingParty() *webauthn.RelyingParty {
+    base := getAppBaseURL()
+    rp := &webauthn.RelyingParty{ID: os.Getenv("WEBAUTHN_RP_ID"), Name: os.Getenv("WEBAUTHN_RP_NAME")}
+    if rp.ID == "" {
+        if u, err := url.Parse(base); err == nil {
+            rp.ID = u.Hostname()
+        }
+    }
+    if rp.Name == "" {
+        rp.Name = "Concerts"
+    }
+    list := os.Getenv("WEBAUTHN_ORIGINS")
+    if list == "" {
+        list = base
+    }
+    for _, o := range strings.Split(list, ",") {
+        if o = strings.TrimRight(strings.TrimSpace(o), "/"); o != "" {
+            rp.Origins = append(rp.Origins, o)
+        }
+    }
+    return rp
+}
+
+// decodeBase64URL accepts base64url with or without padding, as browsers and
+// libraries differ.
+func decodeBase64URL(s string) ([]byte, error) {
+    return webauthn.Encoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// storeChallenge saves a new ceremony challenge. uid is nil for logins, where
+// the user is not known until the assertion arrives.
+func storeChallenge(q execer, uid *int64, purpose string) ([]byte, error) {
+    challenge, err := webauthn.NewChallenge()
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now()
+    if _, err := q.Exec("DELETE FROM webauthn_challenges WHERE expires_at <= ?", now.Unix()); err != nil {
+        return nil, fmt.Errorf("db delete error: %w", err)
+    }
+    _, err = q.Exec(
+        "INSERT INTO webauthn_challenges (challenge_hash, user_id, purpose, expires_at) VALUES (?, ?, ?, ?)",
+        hashToken(webauthn.Encoding.EncodeToString(challenge)), uid, purpose, now.Add(webauthn.Timeout).Unix(),
+    )
+    if err != nil {
+        return nil, fmt.Errorf("db insert error: %w", err)
+    }
+    return challenge, nil
+}
+
+// consumeChallenge deletes the unexpired challenge a response was made for
+// and returns it with its user. Each challenge can be answered only once.
+func consumeChallenge(q queryExecer, clientDataJSON []byte, purpose string) ([]byte, sql.NullInt64, error) {
+    var uid sql.NullInt64
+    challenge, err := webauthn.ClientChallenge(clientDataJSON)
+    if err != nil {
+        return nil, uid, errPasskeyInvalid
+    }
+    err = q.QueryRow(
+        "DELETE FROM webauthn_challenges WHERE challenge_hash = ? AND purpose = ? AND expires_at > ? RETURNING user_id",
+        hashToken(webauthn.Encoding.EncodeToString(challenge)), purpose, time.Now().Unix(),
+    ).Scan(&uid)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return nil, uid, errPasskeyInvalid
+        }
+        return nil, uid, fmt.Errorf("db query error: %w", err)
+    }
+    return challenge, uid, nil
+}
+
+// userHandle returns the user's WebAuthn user handle, creating it on first use.
+func userHandle(q queryExecer, uid int64) ([]byte, error) {
+    fresh, err := randomToken(userHandleBytes)
+    if err != nil {
+        return nil, err
+    }
+    var handle string
+    err = q.QueryRow("UPDATE users SET webauthn_handle = COALESCE(webauthn_handle, ?) WHERE id = ? RETURNING webauthn_handle", fresh, uid).Scan(&handle)
+    if err != nil {
+        return nil, fmt.Errorf("db update error: %w", err)
+    }
+    return decodeBase64URL(handle)
+}
+
+func splitTransports(s string) []string {
+    if s == "" {
+        return []string{}
+    }
+    return strings.Split(s, ",")
+}
+
+// BeginPasskeyRegistration starts registering a passkey for the authenticated
+// user and returns the options for navigator.credentials.create.
+func BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    connection := db.Get()
+    user, err := loadUser(connection, uid)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    handle, err := userHandle(connection, uid)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+
+    rows, err := connection.Query("SELECT credential_id, transports FROM webauthn_credentials WHERE user_id = ?", uid)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    defer rows.Close()
+    exclude := []webauthn.CredentialDescriptor{}
+    for rows.Next() {
+        var id, transports string
+        if err := rows.Scan(&id, &transports); err != nil {
+            writeError(w, http.StatusInternalServerError, fmt.Errorf("db scan error: %w", err))
+            return
+        }
+        exclude = append(exclude, webauthn.CredentialDescriptor{Type: "public-key", ID: id, Transports: splitTransports(transports)})
+    }
+    if err := rows.Err(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if len(exclude) >= maxPasskeysPerUser {
+        writeError(w, http.StatusConflict, fmt.Errorf("at most %d passkeys can be registered", maxPasskeysPerUser))
+        return
+    }
+
+    challenge, err := storeChallenge(connection, &uid, purposePasskeyRegistration)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    displayName := user.Username
+    if user.DisplayName != "" {
+        displayName = user.DisplayName
+    }
+    rp := relyingParty()
+    writeJSON(w, http.StatusOK, rp.CreationOptions(challenge, webauthn.User{
+        Handle:      handle,
+        Name:        user.Username,
+        DisplayName: displayName,
+    }, exclude))
+}
+
+// registrationCredential is a PublicKeyCredential from navigator.credentials.create,
+// serialized as by its toJSON method.
+type registrationCredential struct {
+    ID       string `json:"id"`
+    Type     string `json:"type"`
+    Response struct {
+        ClientDataJSON    string   `json:"clientDataJSON"`
+        AttestationObject string   `json:"attestationObject"`
+        Transports        []string `json:"transports"`
+    } `json:"response"`
+}
+
+type finishPasskeyRegistrationRequest struct {
+    Name string `json:"name"`
+    // Credential is decoded leniently, browsers add fields over time.
+    Credential json.RawMessage `json:"credential"`
+}
+
+// FinishPasskeyRegistration verifies the authenticator's response and stores
+// the new passkey.
+func FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    var req finishPasskeyRegistrationRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    name := strings.TrimSpace(req.Name)
+    if name == "" {
+        name = "Passkey"
+    }
+    if len(name) > maxPasskeyNameLen {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("name must be <=%d characters", maxPasskeyNameLen))
+        return
+    }
+    var cred registrationCredential
+    if err := json.Unmarshal(req.Credential, &cred); err != nil || cred.Type != "public-key" {
+        writeError(w, http.StatusBadRequest, errors.New("credential must be a public-key credential"))
+        return
+    }
+    clientDataJSON, err1 := decodeBase64URL(cred.Response.ClientDataJSON)
+    attestationObject, err2 := decodeBase64URL(cred.Response.AttestationObject)
+    if err1 != nil || err2 != nil {
+        writeError(w, http.StatusBadRequest, errors.New("credential response must be base64url encoded"))
+        return
+    }
+
+    // The challenge is used up whether or not the response verifies.
+    connection := db.Get()
+    challenge, owner, err := consumeChallenge(connection, clientDataJSON, purposePasskeyRegistration)
+    if err == nil && owner.Int64 != uid {
+        err = errPasskeyInvalid
+    }
+    if err != nil {
+        if errors.Is(err, errPasskeyInvalid) {
+            writeError(w, http.StatusBadRequest, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    credential, err := relyingParty().VerifyRegistration(challenge, clientDataJSON, attestationObject)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    credentialID := webauthn.Encoding.EncodeToString(credential.ID)
+    if cred.ID != "" && strings.TrimRight(cred.ID, "=") != credentialID {
+        writeError(w, http.StatusBadRequest, errors.New("credential id does not match the authenticator data"))
+        return
+    }
+    transports := []string{}
+    for _, t := range cred.Response.Transports {
+        if slices.Contains(knownTransports, t) && !slices.Contains(transports, t) {
+            transports = append(transports, t)
+        }
+    }
+
+    passkey := models.Passkey{
+        Name:           name,
+        Transports:     transports,
+        BackupEligible: credential.BackupEligible,
+        BackedUp:       credential.BackedUp,
+        CreatedAt:      time.Now().Unix(),
+    }
+    err = connection.QueryRow(
+        `INSERT INTO webauthn_credentials (user_id, credential_id, public_key, algorithm, sign_count, name, transports, backup_eligible, backed_up, created_at)
+         VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(credential_id) DO NOTHING RETURNING id`,
+        uid, credentialID, credential.PublicKey, credential.Algorithm, credential.SignCount, name,
+        strings.Join(transports, ","), passkey.BackupEligible, passkey.BackedUp, passkey.CreatedAt,
+    ).Scan(&passkey.ID)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            writeError(w, http.StatusConflict, errors.New("passkey is already registered"))
+            return
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db insert error: %w", err))
+        return
+    }
+    recordAuthEvent(r, authEvent{Event: eventPasskeyAdded, Outcome: outcomeSuccess, UserID: uid, Detail: name})
+    writeJSON(w, http.StatusCreated, passkey)
+}
+
+// ListPasskeys returns the authenticated user's passkeys.
+func ListPasskeys(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    rows, err := db.Get().Query(
+        `SELECT id, name, transports, backup_eligible, backed_up, created_at, last_used_at
+         FROM webauthn_credentials WHERE user_id = ? ORDER BY created_at DESC, id DESC`,
+        uid,
+    )
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    defer rows.Close()
+    list := []models.Passkey{}
+    for rows.Next() {
+        var (
+            p          models.Passkey
+            transports string
+            lastUsed   sql.NullInt64
+        )
+        if err := rows.Scan(&p.ID, &p.Name, &transports, &p.BackupEligible, &p.BackedUp, &p.CreatedAt, &lastUsed); err != nil {
+            writeError(w, http.StatusInternalServerError, fmt.Errorf("db scan error: %w", err))
+            return
+        }
+        p.Transports = splitTransports(transports)
+        if lastUsed.Valid {
+            p.LastUsedAt = &lastUsed.Int64
+        }
+        list = append(list, p)
+    }
+    writeJSON(w, http.StatusOK, list)
+}
+
+// DeletePasskey removes one of the authenticated user's passkeys. The
+// authenticator keeps its copy, but it can no longer be used to log in.
+func DeletePasskey(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("invalid passkey id"))
+        return
+    }
+    var name string
+    err = db.Get().QueryRow("DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ? RETURNING name", id, uid).Scan(&name)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            writeError(w, http.StatusNotFound, sql.ErrNoRows)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db delete error: %w", err))
+        return
+    }
+    recordAuthEvent(r, authEvent{Event: eventPasskeyRemoved, Outcome: outcomeSuccess, UserID: uid, Detail: name})
+    writeJSON(w, http.StatusOK, map[string]any{"deleted": id})
+}
+
+// BeginPasskeyLogin returns the options for navigator.credentials.get. No
+// username is asked for: the user picks one of their passkeys for this site.
+// As anyone can start a login, every challenge handed out counts against the
+// client's address in the login throttle until a passkey login succeeds.
+func BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+    ip := clientIP(r)
+    wait, err := throttle.retryAfter(ipThrottleKey(ip), passkeyThrottleKey(ip))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if wait > 0 {
+        writeLockedOut(w, wait)
+        return
+    }
+    if _, err := throttle.recordFailure(passkeyThrottleKey(ip), throttle.maxIPFailures); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    challenge, err := storeChallenge(db.Get(), nil, purposePasskeyLogin)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    writeJSON(w, http.StatusOK, relyingParty().RequestOptions(challenge, nil))
+}
+
+// assertionCredential is a PublicKeyCredential from navigator.credentials.get,
+// serialized as by its toJSON method.
+type assertionCredential struct {
+    ID       string `json:"id"`
+    Type     string `json:"type"`
+    Response struct {
+        ClientDataJSON    string `json:"clientDataJSON"`
+        AuthenticatorData string `json:"authenticatorData"`
+        Signature         string `json:"signature"`
+        UserHandle        string `json:"userHandle"`
+    } `json:"response"`
+}
+
+type finishPasskeyLoginRequest struct {
+    Credential json.RawMessage `json:"credential"`
+    Session    string          `json:"session"`
+}
+
+// FinishPasskeyLogin verifies an assertion and responds like Login. A passkey
+// with user verification already combines possession with a PIN or
+// biometric, so no TOTP challenge follows.
+func FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+    var req finishPasskeyLoginRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    cookies, err := useCookieSession(req.Session)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    var cred assertionCredential
+    if err := json.Unmarshal(req.Credential, &cred); err != nil || cred.Type != "public-key" || cred.ID == "" {
+        writeError(w, http.StatusBadRequest, errors.New("credential must be a public-key credential"))
+        return
+    }
+    clientDataJSON, err1 := decodeBase64URL(cred.Response.ClientDataJSON)
+    authData, err2 := decodeBase64URL(cred.Response.AuthenticatorData)
+    signature, err3 := decodeBase64URL(cred.Response.Signature)
+    handle, err4 := decodeBase64URL(cred.Response.UserHandle)
+    if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+        writeError(w, http.StatusBadRequest, errors.New("credential response must be base64url encoded"))
+        return
+    }
+
+    // The challenge is used up even if the assertion turns out to be
+    // invalid, so it is consumed outside the transaction below.
+    connection := db.Get()
+    challenge, _, err := consumeChallenge(connection, clientDataJSON, purposePasskeyLogin)
+    if err != nil {
+        if errors.Is(err, errPasskeyInvalid) {
+            recordAuthEvent(r, authEvent{Event: eventLogin, Outcome: outcomeFailure, Detail: loginMethodPasskey + ": " + err.Error()})
+            writeError(w, http.StatusUnauthorized, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    tx, err := connection.Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+    // fail rejects the assertion; the transaction is rolled back first so
+    // that the audit log can be written.
+    fail := func(uid int64, err error) {
+        _ = tx.Rollback()
+        recordAuthEvent(r, authEvent{Event: eventLogin, Outcome: outcomeFailure, UserID: uid, Detail: loginMethodPasskey + ": " + err.Error()})
+        writeError(w, http.StatusUnauthorized, err)
+    }
+    var (
+        id, uid      int64
+        username     string
+        storedHandle sql.NullString
+        publicKey    []byte
+        signCount    int64
+    )
+    err = tx.QueryRow(
+        `SELECT c.id, c.user_id, u.username, u.webauthn_handle, c.public_key, c.sign_count
+         FROM webauthn_credentials c JOIN users u ON u.id = c.user_id WHERE c.credential_id = ?`,
+        strings.TrimRight(cred.ID, "="),
+    ).Scan(&id, &uid, &username, &storedHandle, &publicKey, &signCount)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            fail(0, errors.New("unknown passkey"))
+            return
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if len(handle) > 0 && webauthn.Encoding.EncodeToString(handle) != storedHandle.String {
+        fail(uid, errors.New("passkey does not belong to this account"))
+        return
+    }
+    assertion, err := relyingParty().VerifyAssertion(challenge, publicKey, uint32(signCount), clientDataJSON, authData, signature)
+    if err != nil {
+        if errors.Is(err, webauthn.ErrVerification) {
+            fail(uid, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    _, err = tx.Exec(
+        "UPDATE webauthn_credentials SET sign_count = ?, backed_up = ?, last_used_at = ? WHERE id = ?",
+        assertion.SignCount, assertion.BackedUp, time.Now().Unix(), id,
+    )
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+
+    if _, err := checkCanLogin(uid); err != nil {
+        if errors.Is(err, errAccountDisabled) || errors.Is(err, errEmailNotVerified) {
+            recordAuthEvent(r, authEvent{Event: eventLogin, Outcome: outcomeFailure, UserID: uid, Username: username, Detail: loginMethodPasskey + ": " + err.Error()})
+            writeError(w, http.StatusForbidden, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if err := throttle.reset(passkeyThrottleKey(clientIP(r))); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    startSession(w, r, uid, username, loginMethodPasskey, cookies)
+}
@@ -0,0 +1,409 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"concerts/webauthn"
+)
+
+// softAuthenticator is an in-memory passkey authenticator. It answers
+// ceremonies the way a browser and authenticator would, signing with an
+// ES256 or Ed25519 key. Tests change origin, rpID, flags or signCount to
+// produce responses a real client would not.
+type softAuthenticator struct {
+    alg          int64
+    ecKey        *ecdsa.PrivateKey
+    edKey        ed25519.PrivateKey
+    credentialID []byte
+    userHandle   []byte
+    origin       string
+    rpID         string
+    flags        byte
+    signCount    uint32
+}
+
+const (
+    flagUP = 0x01
+    flagUV = 0x04
+    flagAT = 0x40
+)
+
+func newSoftAuthenticator(t *testing.T, alg int64) *softAuthenticator {
+    t.Helper()
+    a := &softAuthenticator{alg: alg, credentialID: make([]byte, 16), origin: testOrigin, rpID: "localhost", flags: flagUP | flagUV}
+    if _, err := rand.Read(a.credentialID); err != nil {
+        t.Fatal(err)
+    }
+    var err error
+    switch alg {
+    case webauthn.AlgES256:
+        a.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    case webauthn.AlgEdDSA:
+        _, a.edKey, err = ed25519.GenerateKey(rand.Reader)
+    default:
+        t.Fatalf("unsupported algorithm %d", alg)
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    return a
+}
+
+// CBOR encoding of the few item types WebAuthn responses need.
+
+func cborHead(major byte, n uint64) []byte {
+    switch {
+    case n < 24:
+        return []byte{major<<5 | byte(n)}
+    case n <= 0xff:
+        return []byte{major<<5 | 24, byte(n)}
+    case n <= 0xffff:
+        return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+    default:
+        return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+    }
+}
+
+func cborInt(n int64) []byte {
+    if n < 0 {
+        return cborHead(1, uint64(-1-n))
+    }
+    return cborHead(0, uint64(n))
+}
+
+func cborBytes(b []byte) []byte {
+    return append(cborHead(2, uint64(len(b))), b...)
+}
+
+func cborText(s string) []byte {
+    return append(cborHead(3, uint64(len(s))), s...)
+}
+
+// cborMap encodes a map from alternating, already encoded keys and values.
+func cborMap(items ...[]byte) []byte {
+    out := cborHead(5, uint64(len(items)/2))
+    for _, item := range items {
+        out = append(out, item...)
+    }
+    return out
+}
+
+// coseKey returns the credential public key as a COSE_Key.
+func (a *softAuthenticator) coseKey(t *testing.T) []byte {
+    t.Helper()
+    if a.alg == webauthn.AlgEdDSA {
+        return cborMap(
+            cborInt(1), cborInt(1),
+            cborInt(3), cborInt(webauthn.AlgEdDSA),
+            cborInt(-1), cborInt(6),
+            cborInt(-2), cborBytes(a.edKey.Public().(ed25519.PublicKey)),
+        )
+    }
+    pub, err := a.ecKey.PublicKey.ECDH()
+    if err != nil {
+        t.Fatal(err)
+    }
+    point := pub.Bytes()
+    return cborMap(
+        cborInt(1), cborInt(2),
+        cborInt(3), cborInt(webauthn.AlgES256),
+        cborInt(-1), cborInt(1),
+        cborInt(-2), cborBytes(point[1:33]),
+        cborInt(-3), cborBytes(point[33:]),
+    )
+}
+
+func (a *softAuthenticator) sign(t *testing.T, message []byte) []byte {
+    t.Helper()
+    if a.alg == webauthn.AlgEdDSA {
+        return ed25519.Sign(a.edKey, message)
+    }
+    digest := sha256.Sum256(message)
+    sig, err := ecdsa.SignASN1(rand.Reader, a.ecKey, digest[:])
+    if err != nil {
+        t.Fatal(err)
+    }
+    return sig
+}
+
+// authenticatorData builds authenticator data, with the attested credential
+// when attested is set.
+func (a *softAuthenticator) authenticatorData(t *testing.T, attested bool) []byte {
+    t.Helper()
+    rpIDHash := sha256.Sum256([]byte(a.rpID))
+    flags := a.flags
+    if attested {
+        flags |= flagAT
+    }
+    data := append(rpIDHash[:], flags)
+    data = binary.BigEndian.AppendUint32(data, a.signCount)
+    if attested {
+        data = append(data, make([]byte, 16)...)
+        data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+        data = append(data, a.credentialID...)
+        data = append(data, a.coseKey(t)...)
+    }
+    return data
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, typ, challenge string) []byte {
+    t.Helper()
+    raw, err := json.Marshal(map[string]any{"type": typ, "challenge": challenge, "origin": a.origin, "crossOrigin": false})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return raw
+}
+
+// create answers navigator.credentials.create with a "none" attestation and
+// returns the credential as serialized by its toJSON method.
+func (a *softAuthenticator) create(t *testing.T, options webauthn.CreationOptions) json.RawMessage {
+    t.Helper()
+    handle, err := webauthn.Encoding.DecodeString(options.User.ID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    a.userHandle = handle
+    attestation := cborMap(
+        cborText("fmt"), cborText("none"),
+        cborText("attStmt"), cborMap(),
+        cborText("authData"), cborBytes(a.authenticatorData(t, true)),
+    )
+    return marshalCredential(t, map[string]any{
+        "id":   webauthn.Encoding.EncodeToString(a.credentialID),
+        "type": "public-key",
+        "response": map[string]any{
+            "clientDataJSON":    webauthn.Encoding.EncodeToString(a.clientData(t, "webauthn.create", options.Challenge)),
+            "attestationObject": webauthn.Encoding.EncodeToString(attestation),
+            "transports":        []string{"internal"},
+        },
+    })
+}
+
+// get answers navigator.credentials.get, advancing the signature counter.
+func (a *softAuthenticator) get(t *testing.T, options webauthn.RequestOptions) json.RawMessage {
+    t.Helper()
+    a.signCount++
+    clientData := a.clientData(t, "webauthn.get", options.Challenge)
+    data := a.authenticatorData(t, false)
+    clientDataHash := sha256.Sum256(clientData)
+    return marshalCredential(t, map[string]any{
+        "id":   webauthn.Encoding.EncodeToString(a.credentialID),
+        "type": "public-key",
+        "response": map[string]any{
+            "clientDataJSON":    webauthn.Encoding.EncodeToString(clientData),
+            "authenticatorData": webauthn.Encoding.EncodeToString(data),
+            "signature":         webauthn.Encoding.EncodeToString(a.sign(t, append(data, clientDataHash[:]...))),
+            "userHandle":        webauthn.Encoding.EncodeToString(a.userHandle),
+        },
+    })
+}
+
+func marshalCredential(t *testing.T, v any) json.RawMessage {
+    t.Helper()
+    raw, err := json.Marshal(v)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return raw
+}
+
+const passkeyIP = "192.0.2.150"
+
+// registerPasskey runs a registration ceremony for uid and returns the
+// response to its finish request.
+func registerPasskey(t *testing.T, uid int64, a *softAuthenticator) *httptest.ResponseRecorder {
+    t.Helper()
+    w := call(t, asUser(uid, BeginPasskeyRegistration), http.MethodPost, "/me/passkeys/register/begin", passkeyIP, nil)
+    expectStatus(t, w, http.StatusOK)
+    var options webauthn.CreationOptions
+    decode(t, w, &options)
+    return call(t, asUser(uid, FinishPasskeyRegistration), http.MethodPost, "/me/passkeys/register/finish", passkeyIP,
+        finishPasskeyRegistrationRequest{Name: "test key", Credential: a.create(t, options)})
+}
+
+// beginPasskeyLogin starts a login ceremony and returns its options.
+func beginPasskeyLogin(t *testing.T) webauthn.RequestOptions {
+    t.Helper()
+    w := call(t, BeginPasskeyLogin, http.MethodPost, "/passkeys/login/begin", passkeyIP, nil)
+    expectStatus(t, w, http.StatusOK)
+    var options webauthn.RequestOptions
+    decode(t, w, &options)
+    return options
+}
+
+func finishPasskeyLogin(t *testing.T, credential json.RawMessage) *httptest.ResponseRecorder {
+    t.Helper()
+    return call(t, FinishPasskeyLogin, http.MethodPost, "/passkeys/login/finish", passkeyIP, finishPasskeyLoginRequest{Credential: credential})
+}
+
+// passkeyUser creates a user with a registered passkey.
+func passkeyUser(t *testing.T, username string, alg int64) *softAuthenticator {
+    t.Helper()
+    uid := createUser(t, username, "right password", "")
+    a := newSoftAuthenticator(t, alg)
+    expectStatus(t, registerPasskey(t, uid, a), http.StatusCreated)
+    return a
+}
+
+func TestPasskeyRegisterAndLogin(t *testing.T) {
+    for name, alg := range map[string]int64{"ES256": webauthn.AlgES256, "Ed25519": webauthn.AlgEdDSA} {
+        t.Run(name, func(t *testing.T) {
+            uid := createUser(t, "passkey-"+name, "right password", "")
+            a := newSoftAuthenticator(t, alg)
+            w := registerPasskey(t, uid, a)
+            expectStatus(t, w, http.StatusCreated)
+
+            // The same authenticator cannot be registered twice.
+            expectStatus(t, registerPasskey(t, uid, a), http.StatusConflict)
+
+            for i := 0; i < 2; i++ {
+                w = finishPasskeyLogin(t, a.get(t, beginPasskeyLogin(t)))
+                expectStatus(t, w, http.StatusOK)
+                var pair struct {
+                    Token string `json:"token"`
+                }
+                decode(t, w, &pair)
+                if pair.Token == "" {
+                    t.Fatalf("no access token in %s", w.Body)
+                }
+            }
+
+            var stored uint32
+            var algorithm int64
+            if err := openDB(t).QueryRow("SELECT sign_count, algorithm FROM webauthn_credentials WHERE user_id = ?", uid).Scan(&stored, &algorithm); err != nil {
+                t.Fatal(err)
+            }
+            if stored != 2 || algorithm != alg {
+                t.Fatalf("sign_count = %d, algorithm = %d, want 2, %d", stored, algorithm, alg)
+            }
+        })
+    }
+}
+
+func TestPasskeyRejectsWrongOrigin(t *testing.T) {
+    uid := createUser(t, "passkey-origin", "right password", "")
+    a := newSoftAuthenticator(t, webauthn.AlgES256)
+    a.origin = "https://concerts.example.net"
+    expectStatus(t, registerPasskey(t, uid, a), http.StatusBadRequest)
+
+    a = passkeyUser(t, "passkey-origin-login", webauthn.AlgES256)
+    a.origin = "https://concerts.example.net"
+    expectStatus(t, finishPasskeyLogin(t, a.get(t, beginPasskeyLogin(t))), http.StatusUnauthorized)
+}
+
+func TestPasskeyRejectsWrongRPIDHash(t *testing.T) {
+    uid := createUser(t, "passkey-rpid", "right password", "")
+    a := newSoftAuthenticator(t, webauthn.AlgEdDSA)
+    a.rpID = "example.net"
+    expectStatus(t, registerPasskey(t, uid, a), http.StatusBadRequest)
+
+    a = passkeyUser(t, "passkey-rpid-login", webauthn.AlgEdDSA)
+    a.rpID = "example.net"
+    expectStatus(t, finishPasskeyLogin(t, a.get(t, beginPasskeyLogin(t))), http.StatusUnauthorized)
+}
+
+func TestPasskeyRequiresUserVerification(t *testing.T) {
+    uid := createUser(t, "passkey-uv", "right password", "")
+    a := newSoftAuthenticator(t, webauthn.AlgES256)
+    a.flags = flagUP
+    expectStatus(t, registerPasskey(t, uid, a), http.StatusBadRequest)
+
+    a = passkeyUser(t, "passkey-uv-login", webauthn.AlgES256)
+    a.flags = flagUP
+    expectStatus(t, finishPasskeyLogin(t, a.get(t, beginPasskeyLogin(t))), http.StatusUnauthorized)
+}
+
+func TestPasskeyRejectsCounterRegression(t *testing.T) {
+    a := passkeyUser(t, "passkey-counter", webauthn.AlgES256)
+    a.signCount = 10
+    expectStatus(t, finishPasskeyLogin(t, a.get(t, beginPasskeyLogin(t))), http.StatusOK)
+
+    // A clone still at an older counter value.
+    a.signCount = 5
+    expectStatus(t, finishPasskeyLogin(t, a.get(t, beginPasskeyLogin(t))), http.StatusUnauthorized)
+    a.signCount = 10
+    expectStatus(t, finishPasskeyLogin(t, a.get(t, beginPasskeyLogin(t))), http.StatusUnauthorized)
+
+    expectStatus(t, finishPasskeyLogin(t, a.get(t, beginPasskeyLogin(t))), http.StatusOK)
+}
+
+func TestPasskeyChallengeReplay(t *testing.T) {
+    uid := createUser(t, "passkey-replay", "right password", "")
+    a := newSoftAuthenticator(t, webauthn.AlgEdDSA)
+    w := call(t, asUser(uid, BeginPasskeyRegistration), http.MethodPost, "/me/passkeys/register/begin", passkeyIP, nil)
+    var creation webauthn.CreationOptions
+    decode(t, w, &creation)
+    registration := finishPasskeyRegistrationRequest{Credential: a.create(t, creation)}
+    expectStatus(t, call(t, asUser(uid, FinishPasskeyRegistration), http.MethodPost, "/me/passkeys/register/finish", passkeyIP, registration), http.StatusCreated)
+    expectStatus(t, call(t, asUser(uid, FinishPasskeyRegistration), http.MethodPost, "/me/passkeys/register/finish", passkeyIP, registration), http.StatusBadRequest)
+
+    assertion := a.get(t, beginPasskeyLogin(t))
+    expectStatus(t, finishPasskeyLogin(t, assertion), http.StatusOK)
+    expectStatus(t, finishPasskeyLogin(t, assertion), http.StatusUnauthorized)
+
+    // A fresh signature over a used challenge does not help either.
+    options := beginPasskeyLogin(t)
+    expectStatus(t, finishPasskeyLogin(t, a.get(t, options)), http.StatusOK)
+    expectStatus(t, finishPasskeyLogin(t, a.get(t, options)), http.StatusUnauthorized)
+
+    // A challenge is used up by a response that fails verification, too.
+    options = beginPasskeyLogin(t)
+    a.origin = "https://concerts.example.net"
+    expectStatus(t, finishPasskeyLogin(t, a.get(t, options)), http.StatusUnauthorized)
+    a.origin = testOrigin
+    expectStatus(t, finishPasskeyLogin(t, a.get(t, options)), http.StatusUnauthorized)
+
+    other := newSoftAuthenticator(t, webauthn.AlgES256)
+    w = call(t, asUser(uid, BeginPasskeyRegistration), http.MethodPost, "/me/passkeys/register/begin", passkeyIP, nil)
+    decode(t, w, &creation)
+    other.flags = flagUP
+    expectStatus(t, call(t, asUser(uid, FinishPasskeyRegistration), http.MethodPost, "/me/passkeys/register/finish", passkeyIP,
+        finishPasskeyRegistrationRequest{Credential: other.create(t, creation)}), http.StatusBadRequest)
+    other.flags = flagUP | flagUV
+    expectStatus(t, call(t, asUser(uid, FinishPasskeyRegistration), http.MethodPost, "/me/passkeys/register/finish", passkeyIP,
+        finishPasskeyRegistrationRequest{Credential: other.create(t, creation)}), http.StatusBadRequest)
+
+    // Nor does a challenge issued for registration.
+    w = call(t, asUser(uid, BeginPasskeyRegistration), http.MethodPost, "/me/passkeys/register/begin", passkeyIP, nil)
+    decode(t, w, &creation)
+    expectStatus(t, finishPasskeyLogin(t, a.get(t, webauthn.RequestOptions{Challenge: creation.Challenge})), http.StatusUnauthorized)
+}
+
+func TestBeginPasskeyLoginIsRateLimited(t *testing.T) {
+    clock := useTestThrottle(t)
+    a := passkeyUser(t, "passkey-throttle", webauthn.AlgEdDSA)
+    begin := func(ip string) *httptest.ResponseRecorder {
+        return call(t, BeginPasskeyLogin, http.MethodPost, "/passkeys/login/begin", ip, nil)
+    }
+
+    // Abandoned ceremonies pile up until the address is locked out.
+    for i := 0; i < 5; i++ {
+        expectStatus(t, begin("198.51.100.77"), http.StatusOK)
+    }
+    expectLockedOut(t, begin("198.51.100.77"), 30)
+    expectStatus(t, begin("198.51.100.78"), http.StatusOK)
+
+    // A successful login starts the count over.
+    clock.advance(30 * time.Second)
+    w := begin("198.51.100.77")
+    expectStatus(t, w, http.StatusOK)
+    var options webauthn.RequestOptions
+    decode(t, w, &options)
+    w = call(t, FinishPasskeyLogin, http.MethodPost, "/passkeys/login/finish", "198.51.100.77", finishPasskeyLoginRequest{Credential: a.get(t, options)})
+    expectStatus(t, w, http.StatusOK)
+    for i := 0; i < 5; i++ {
+        expectStatus(t, begin("198.51.100.77"), http.StatusOK)
+    }
+    expectLockedOut(t, begin("198.51.100.77"), 30)
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"concerts/db"
+	"concerts/mailer"
+	"concerts/passwords"
+)
+
+func getPasswordResetTTL() time.Duration {
+    return durationFromEnv("PASSWORD_RESET_TTL", time.Hour)
+}
+
+type changePasswordRequest struct {
+    CurrentPassword string `json:"current_password"`
+    NewPassword     string `json:"new_password"`
+}
+
+// ChangePassword replaces the authenticated user's password after verifying
+// the current one. All existing sessions are signed out and personal access
+// tokens revoked.
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    var req changePasswordRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+
+    connection := db.Get()
+    var username, hash string
+    if err := connection.QueryRow("SELECT username, password_hash FROM users WHERE id = ?", uid).Scan(&username, &hash); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if ok, err := verifyPassword(hash, req.CurrentPassword); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    } else if !ok {
+        recordAuthEvent(r, authEvent{Event: eventPasswordChanged, Outcome: outcomeFailure, UserID: uid, Username: username, Detail: "current password is incorrect"})
+        writeError(w, http.StatusForbidden, errors.New("current password is incorrect"))
+        return
+    }
+    if err := validatePassword(req.NewPassword, username); err != nil {
+        writePasswordError(w, err)
+        return
+    }
+    if err := setPassword(connection, uid, req.NewPassword); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if err := revokeAllSessions(connection, uid); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    recordAuthEvent(r, authEvent{Event: eventPasswordChanged, Outcome: outcomeSuccess, UserID: uid, Username: username})
+    writeJSON(w, http.StatusOK, map[string]string{"message": "password changed, please log in again"})
+}
+
+type forgotPasswordRequest struct {
+    Email string `json:"email"`
+}
+
+// ForgotPassword emails a password reset link if the address belongs to an
+// account. The response is the same either way. Requests are throttled per
+// address and per client.
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+    var req forgotPasswordRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    email, err := normalizeEmail(req.Email)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    if !allowMailRequest(w, r, email) {
+        return
+    }
+
+    accepted := map[string]string{"message": "if the account exists, a reset link has been sent"}
+    connection := db.Get()
+    var (
+        uid      int64
+        username string
+    )
+    err = connection.QueryRow("SELECT id, username FROM users WHERE email = ?", email).Scan(&uid, &username)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            writeJSON(w, http.StatusAccepted, accepted)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    token, err := issueOneTimeToken(connection, uid, purposePasswordReset, getPasswordResetTTL())
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    link := getAppBaseURL() + "/reset-password?token=" + url.QueryEscape(token)
+    sendMailAsync(mailer.Message{
+        To:      email,
+        Subject: "Reset your password",
+        Body: fmt.Sprintf("Hi %s,\n\nUse the link below to choose a new password. It expires in %s and can only be used once.\n\n%s\n\nIf you did not ask for this, you can ignore this email.\n",
+            username, getPasswordResetTTL(), link),
+    })
+    writeJSON(w, http.StatusAccepted, accepted)
+}
+
+type resetPasswordRequest struct {
+    Token       string `json:"token"`
+    NewPassword string `json:"new_password"`
+}
+
+// ResetPassword sets a new password using a token from ForgotPassword, signing
+// out all sessions and revoking personal access tokens.
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+    var req resetPasswordRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    if req.Token == "" {
+        writeError(w, http.StatusBadRequest, errors.New("token is required"))
+        return
+    }
+
+    connection := db.Get()
+    tx, err := connection.Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+    uid, err := consumeOneTimeToken(tx, req.Token, purposePasswordReset)
+    if err != nil {
+        if errors.Is(err, errOneTimeTokenInvalid) {
+            writeError(w, http.StatusBadRequest, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    // The token stays unused if the new password is rejected.
+    var username string
+    if err := tx.QueryRow("SELECT username FROM users WHERE id = ?", uid).Scan(&username); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if err := validatePassword(req.NewPassword, username); err != nil {
+        writePasswordError(w, err)
+        return
+    }
+    if err := setPassword(tx, uid, req.NewPassword); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    if err := revokeAllSessions(connection, uid); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    // Proving control of the mailbox is enough to lift a lockout as well.
+    if err := unlockUser(uid); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    recordAuthEvent(r, authEvent{Event: eventPasswordReset, Outcome: outcomeSuccess, UserID: uid, Username: username})
+    writeJSON(w, http.StatusOK, map[string]string{"message": "password reset"})
+}
+
+// validatePassword checks a new password against the password policy.
+func validatePassword(password, username string) error {
+    return passwords.GetPolicy().Check(password, username)
+}
+
+// writePasswordError responds to a rejected password, listing every broken
+// rule for *passwords.PolicyError.
+func writePasswordError(w http.ResponseWriter, err error) {
+    var policyErr *passwords.PolicyError
+    if errors.As(err, &policyErr) {
+        writeJSON(w, http.StatusBadRequest, map[string]any{
+            "error":      policyErr.Error(),
+            "violations": policyErr.Violations,
+        })
+        return
+    }
+    writeError(w, http.StatusBadRequest, err)
+}
+
+// setPassword hashes and stores a new password for the user.
+func setPassword(q execer, uid int64, password string) error {
+    hashed, err := passwords.Hash(password)
+    if err != nil {
+        return fmt.Errorf("failed to hash password: %w", err)
+    }
+    if _, err := q.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hashed, uid); err != nil {
+        return fmt.Errorf("db update error: %w", err)
+    }
+    return nil
+}
+
+// verifyPassword reports whether password matches the stored hash.
+func verifyPassword(hash, password string) (bool, error) {
+    ok, _, err := passwords.Verify(password, hash)
+    if err != nil {
+        return false, fmt.Errorf("password verification error: %w", err)
+    }
+    return ok, nil
+}
+
+// normalizeEmail validates a bare email address and lowercases it.
+func normalizeEmail(s string) (string, error) {
+    s = strings.TrimSpace(s)
+    addr, err := mail.ParseAddress(s)
+    if err != nil || addr.Address != s {
+        return "", errors.New("invalid email address")
+    }
+    return strings.ToLower(addr.Address), nil
+}
@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"concerts/db"
+	"concerts/models"
+)
+
+const (
+    maxDisplayNameLen = 100
+    maxAvatarURLLen   = 2048
+)
+
+// localePattern accepts BCP 47 style tags such as "en", "pt-PT" or "zh-Hant-TW".
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// userColumns are the columns read by scanUser, in order.
+const userColumns = "id, username, email, email_verified_at, display_name, timezone, locale, avatar_url, role, disabled_at"
+
+type rowScanner interface {
+    Scan(dest ...any) error
+}
+
+var errInvalidTimezone = errors.New("timezone must be an IANA time zone such as Europe/Lisbon")
+
+// loadTimezone loads an IANA time zone. "Local" is refused since it depends
+// on the server.
+func loadTimezone(name string) (*time.Location, error) {
+    if name == "" || name == "Local" {
+        return nil, errInvalidTimezone
+    }
+    loc, err := time.LoadLocation(name)
+    if err != nil {
+        return nil, errInvalidTimezone
+    }
+    return loc, nil
+}
+
+func scanUser(row rowScanner) (models.User, error) {
+    var (
+        u                           models.User
+        email, displayName          sql.NullString
+        timezone, locale, avatarURL sql.NullString
+        emailVerifiedAt, disabledAt sql.NullInt64
+    )
+    err := row.Scan(&u.ID, &u.Username, &email, &emailVerifiedAt, &displayName, &timezone, &locale, &avatarURL, &u.Role, &disabledAt)
+    if err != nil {
+        return u, err
+    }
+    u.Email = email.String
+    u.DisplayName = displayName.String
+    u.Timezone = timezone.String
+    u.Locale = locale.String
+    u.AvatarURL = avatarURL.String
+    if emailVerifiedAt.Valid {
+        u.EmailVerifiedAt = &emailVerifiedAt.Int64
+    }
+    if disabledAt.Valid {
+        u.DisabledAt = &disabledAt.Int64
+    }
+    return u, nil
+}
+
+func loadUser(q queryExecer, uid int64) (models.User, error) {
+    return scanUser(q.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", uid))
+}
+
+// GetMe returns the authenticated user's profile.
+func GetMe(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    u, err := loadUser(db.Get(), uid)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    writeJSON(w, http.StatusOK, u)
+}
+
+// updateMeRequest holds the fields to change; omitted fields are left alone
+// and an empty string clears an optional field.
+type updateMeRequest struct {
+    Username    *string `json:"username"`
+    Email       *string `json:"email"`
+    DisplayName *string `json:"display_name"`
+    Timezone    *string `json:"timezone"`
+    Locale      *string `json:"locale"`
+    AvatarURL   *string `json:"avatar_url"`
+}
+
+// UpdateMe changes the authenticated user's profile. A new email address has
+// to be verified again.
+func UpdateMe(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    var req updateMeRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+
+    var (
+        sets []string
+        args []any
+    )
+    set := func(column string, value any) {
+        sets = append(sets, column+" = ?")
+        args = append(args, value)
+    }
+    // optional maps "" to NULL.
+    optional := func(s string) sql.NullString {
+        return sql.NullString{String: s, Valid: s != ""}
+    }
+
+    if req.Username != nil {
+        if len(*req.Username) < 3 || strings.TrimSpace(*req.Username) != *req.Username {
+            writeError(w, http.StatusBadRequest, errors.New("username must be >=3 characters without surrounding spaces"))
+            return
+        }
+        set("username", *req.Username)
+    }
+    var newEmail string
+    if req.Email != nil {
+        if *req.Email != "" {
+            normalized, err := normalizeEmail(*req.Email)
+            if err != nil {
+                writeError(w, http.StatusBadRequest, err)
+                return
+            }
+            newEmail = normalized
+        } else if registrationMode() == RegistrationEmail {
+            writeError(w, http.StatusBadRequest, errors.New("email is required"))
+            return
+        }
+    }
+    if req.DisplayName != nil {
+        name := strings.TrimSpace(*req.DisplayName)
+        if utf8.RuneCountInString(name) > maxDisplayNameLen {
+            writeError(w, http.StatusBadRequest, fmt.Errorf("display_name must be <=%d characters", maxDisplayNameLen))
+            return
+        }
+        set("display_name", optional(name))
+    }
+    if req.Timezone != nil {
+        if *req.Timezone != "" {
+            if _, err := loadTimezone(*req.Timezone); err != nil {
+                writeError(w, http.StatusBadRequest, err)
+                return
+            }
+        }
+        set("timezone", optional(*req.Timezone))
+    }
+    if req.Locale != nil {
+        if *req.Locale != "" && !localePattern.MatchString(*req.Locale) {
+            writeError(w, http.StatusBadRequest, errors.New("locale must be a language tag such as en or pt-PT"))
+            return
+        }
+        set("locale", optional(*req.Locale))
+    }
+    if req.AvatarURL != nil {
+        if *req.AvatarURL != "" {
+            u, err := url.Parse(*req.AvatarURL)
+            if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(*req.AvatarURL) > maxAvatarURLLen {
+                writeError(w, http.StatusBadRequest, errors.New("avatar_url must be an http(s) URL"))
+                return
+            }
+        }
+        set("avatar_url", optional(*req.AvatarURL))
+    }
+
+    connection := db.Get()
+    tx, err := connection.Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+
+    current, err := loadUser(tx, uid)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    var verifyToken string
+    if req.Email != nil && newEmail != current.Email {
+        set("email", optional(newEmail))
+        set("email_verified_at", nil)
+        if newEmail != "" {
+            verifyToken, err = issueOneTimeToken(tx, uid, purposeEmailVerification, getEmailVerificationTTL())
+            if err != nil {
+                writeError(w, http.StatusInternalServerError, err)
+                return
+            }
+        }
+    }
+    if len(sets) > 0 {
+        _, err = tx.Exec("UPDATE users SET "+strings.Join(sets, ", ")+" WHERE id = ?", append(args, uid)...)
+        if err != nil {
+            if strings.Contains(strings.ToLower(err.Error()), "unique") {
+                if strings.Contains(err.Error(), "users.email") {
+                    writeError(w, http.StatusConflict, errors.New("email already registered"))
+                    return
+                }
+                writeError(w, http.StatusConflict, errors.New("username already exists"))
+                return
+            }
+            writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+            return
+        }
+    }
+    updated, err := loadUser(tx, uid)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    if verifyToken != "" {
+        sendMailAsync(verificationMessage(updated.Username, updated.Email, verifyToken))
+    }
+    writeJSON(w, http.StatusOK, updated)
+}
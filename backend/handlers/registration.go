@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"concerts/db"
+	"concerts/mailer"
+)
+
+// Registration modes, selected with REGISTRATION_MODE.
+const (
+    // RegistrationOpen lets anyone sign up and log in right away.
+    RegistrationOpen = "open"
+    // RegistrationEmail requires an email address; the account stays
+    // inactive until the emailed verification link is confirmed.
+    RegistrationEmail = "email"
+    // RegistrationInvite requires an invite code minted by an existing user.
+    RegistrationInvite = "invite"
+)
+
+const purposeEmailVerification = "email_verification"
+
+var (
+    errRegistrationClosed = errors.New("registration requires an invite")
+    errEmailNotVerified   = errors.New("email address not verified")
+)
+
+// RegistrationMode returns the configured registration mode.
+func RegistrationMode() (string, error) {
+    switch mode := os.Getenv("REGISTRATION_MODE"); mode {
+    case "", RegistrationOpen:
+        return RegistrationOpen, nil
+    case RegistrationEmail, RegistrationInvite:
+        return mode, nil
+    default:
+        return "", fmt.Errorf("REGISTRATION_MODE must be %q, %q or %q", RegistrationOpen, RegistrationEmail, RegistrationInvite)
+    }
+}
+
+// registrationMode is RegistrationMode for request handlers; the value is
+// validated at startup, so an invalid mode falls back to the strictest one.
+func registrationMode() string {
+    mode, err := RegistrationMode()
+    if err != nil {
+        return RegistrationInvite
+    }
+    return mode
+}
+
+func getEmailVerificationTTL() time.Duration {
+    return durationFromEnv("EMAIL_VERIFICATION_TTL", 48*time.Hour)
+}
+
+// sendVerificationEmail emails uid a link that activates the account.
+func sendVerificationEmail(q execer, uid int64, username, email string) error {
+    token, err := issueOneTimeToken(q, uid, purposeEmailVerification, getEmailVerificationTTL())
+    if err != nil {
+        return err
+    }
+    sendMailAsync(verificationMessage(username, email, token))
+    return nil
+}
+
+func verificationMessage(username, email, token string) mailer.Message {
+    link := getAppBaseURL() + "/verify-email?token=" + url.QueryEscape(token)
+    return mailer.Message{
+        To:      email,
+        Subject: "Confirm your email address",
+        Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address to activate your account. The link expires in %s.\n\n%s\n\nIf you did not sign up, you can ignore this email.\n",
+            username, getEmailVerificationTTL(), link),
+    }
+}
+
+type verifyEmailRequest struct {
+    Token string `json:"token"`
+}
+
+// VerifyEmail confirms an email address using the token from the
+// verification email and activates the account.
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+    var req verifyEmailRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    if req.Token == "" {
+        writeError(w, http.StatusBadRequest, errors.New("token is required"))
+        return
+    }
+    connection := db.Get()
+    tx, err := connection.Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+    uid, err := consumeOneTimeToken(tx, req.Token, purposeEmailVerification)
+    if err != nil {
+        if errors.Is(err, errOneTimeTokenInvalid) {
+            writeError(w, http.StatusBadRequest, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if _, err := tx.Exec("UPDATE users SET email_verified_at = ?, verification_pending = 0 WHERE id = ?", time.Now().Unix(), uid); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    recordAuthEvent(r, authEvent{Event: eventEmailVerified, Outcome: outcomeSuccess, UserID: uid})
+    writeJSON(w, http.StatusOK, map[string]string{"message": "email verified"})
+}
+
+type resendVerificationRequest struct {
+    Email string `json:"email"`
+}
+
+// ResendVerification sends a new verification link to an account that is
+// still waiting for one. The response is the same either way. Requests are
+// throttled per address and per client.
+func ResendVerification(w http.ResponseWriter, r *http.Request) {
+    var req resendVerificationRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    email, err := normalizeEmail(req.Email)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    if !allowMailRequest(w, r, email) {
+        return
+    }
+
+    accepted := map[string]string{"message": "if the account is awaiting verification, a new link has been sent"}
+    connection := db.Get()
+    var (
+        uid      int64
+        username string
+    )
+    err = connection.QueryRow("SELECT id, username FROM users WHERE email = ? AND verification_pending = 1", email).Scan(&uid, &username)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            writeJSON(w, http.StatusAccepted, accepted)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if err := sendVerificationEmail(connection, uid, username, email); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    writeJSON(w, http.StatusAccepted, accepted)
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"concerts/db"
+	"concerts/models"
+)
+
+const (
+    defaultSearchLimit = 20
+    maxSearchLimit     = 100
+    maxSearchTerms     = 10
+)
+
+// Search hit types.
+const (
+    hitConcert = "concert"
+    hitSong    = "song"
+)
+
+const concertHits = `SELECT 'concert', c.id, c.id, highlight(concerts_fts, 0, char(2), char(3)),
+        snippet(concerts_fts, %d, char(2), char(3), '…', 16), c.title, c.date, concerts_fts.rank AS score
+    FROM concerts_fts JOIN concerts c ON c.id = concerts_fts.rowid
+    WHERE concerts_fts MATCH ? AND c.user_id = ?`
+
+// markStart and markEnd delimit matched terms in highlight and snippet
+// output. They are control characters that HTML escaping leaves alone, so
+// markHTML can escape the stored text first and add the <mark> tags after.
+const (
+    markStart = "\x02"
+    markEnd   = "\x03"
+)
+
+var marks = strings.NewReplacer(markStart, "<mark>", markEnd, "</mark>")
+
+// markHTML escapes highlighted text for HTML and wraps the matched terms in
+// <mark> tags.
+func markHTML(s string) string {
+    return marks.Replace(html.EscapeString(s))
+}
+
+// concertSearch returns the query part for concert hits and its arguments.
+// Without the songs:read scope, concerts neither match on nor show the song
+// titles indexed with them; the snippet then comes from the location.
+func concertSearch(match string, uid int64, songs bool) (string, []any) {
+    if songs {
+        return fmt.Sprintf(concertHits, -1), []any{match, uid}
+    }
+    return fmt.Sprintf(concertHits, 1), []any{"{title location} : (" + match + ")", uid}
+}
+
+const songHits = `SELECT 'song', s.id, s.concert_id, highlight(songs_fts, 0, char(2), char(3)),
+        snippet(songs_fts, 1, char(2), char(3), '…', 16), c.title, c.date, songs_fts.rank AS score
+    FROM songs_fts JOIN songs s ON s.id = songs_fts.rowid JOIN concerts c ON c.id = s.concert_id
+    WHERE songs_fts MATCH ? AND c.user_id = ?`
+
+// searchQuery turns free text into an FTS5 query matching rows that contain
+// every word, each as a prefix. Punctuation is dropped, so the FTS5 query
+// syntax cannot be used (or misused) from outside.
+func searchQuery(text string) string {
+    words := strings.FieldsFunc(text, func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+    })
+    if len(words) > maxSearchTerms {
+        words = words[:maxSearchTerms]
+    }
+    terms := make([]string, len(words))
+    for i, w := range words {
+        terms[i] = `"` + w + `"*`
+    }
+    return strings.Join(terms, " ")
+}
+
+// Search finds the authenticated user's concerts and songs matching ?q, best
+// matches first. A concert matches on its title, location and the titles of
+// its songs, so "yesterday lisbon" finds the Lisbon show where Yesterday was
+// played. ?type limits hits to concerts or songs; ?limit defaults to 20.
+// Song hits, and concert matches on song titles, need the songs:read scope.
+func Search(w http.ResponseWriter, r *http.Request) {
+    ctx := r.Context()
+    uid, ok := UserIDFromContext(ctx)
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    q := r.URL.Query()
+    match := searchQuery(q.Get("q"))
+    if match == "" {
+        writeError(w, http.StatusBadRequest, errors.New("q must contain at least one word"))
+        return
+    }
+    limit := defaultSearchLimit
+    if v := q.Get("limit"); v != "" {
+        var err error
+        if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxSearchLimit {
+            writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxSearchLimit))
+            return
+        }
+    }
+    songs := hasScope(ctx, ScopeSongsRead)
+    var parts []string
+    var args []any
+    switch q.Get("type") {
+    case "":
+        part, partArgs := concertSearch(match, uid, songs)
+        parts, args = []string{part}, partArgs
+        if songs {
+            parts, args = append(parts, songHits), append(args, match, uid)
+        }
+    case hitConcert:
+        part, partArgs := concertSearch(match, uid, songs)
+        parts, args = []string{part}, partArgs
+    case hitSong:
+        if !songs {
+            writeError(w, http.StatusForbidden, fmt.Errorf("token lacks required scope %q", ScopeSongsRead))
+            return
+        }
+        parts, args = []string{songHits}, []any{match, uid}
+    default:
+        writeError(w, http.StatusBadRequest, errors.New("type must be concert or song"))
+        return
+    }
+
+    rows, err := db.Get().Query(strings.Join(parts, " UNION ALL ")+" ORDER BY score LIMIT ?", append(args, limit)...)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    defer rows.Close()
+    list := []models.SearchHit{}
+    for rows.Next() {
+        var h models.SearchHit
+        if err := rows.Scan(&h.Type, &h.ID, &h.ConcertID, &h.Title, &h.Snippet, &h.ConcertTitle, &h.Date, &h.Rank); err != nil {
+            writeError(w, http.StatusInternalServerError, fmt.Errorf("db scan error: %w", err))
+            return
+        }
+        h.Title, h.Snippet = markHTML(h.Title), markHTML(h.Snippet)
+        list = append(list, h)
+    }
+    if err := rows.Err(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    writeJSON(w, http.StatusOK, list)
+}
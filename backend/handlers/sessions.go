@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"concerts/db"
+	"concerts/models"
+)
+
+const (
+    maxUserAgentLen = 512
+    // sessionTouchInterval limits how often requests update last_seen_at.
+    sessionTouchInterval = time.Minute
+)
+
+var errSessionRevoked = errors.New("session revoked")
+
+// sessionClient describes the device a session was used from.
+type sessionClient struct {
+    userAgent string
+    ip        string
+}
+
+func clientFromRequest(r *http.Request) sessionClient {
+    ua := r.UserAgent()
+    if len(ua) > maxUserAgentLen {
+        ua = ua[:maxUserAgentLen]
+    }
+    return sessionClient{userAgent: ua, ip: clientIP(r)}
+}
+
+// touchSession records a session when its tokens are issued. Existing
+// sessions get their last-seen time, client and expiry refreshed.
+func touchSession(q execer, sid string, uid int64, client sessionClient, expiresAt int64) error {
+    now := time.Now().Unix()
+    _, err := q.Exec(
+        `INSERT INTO sessions (id, user_id, user_agent, ip, created_at, last_seen_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+         ON CONFLICT(id) DO UPDATE SET user_agent = excluded.user_agent, ip = excluded.ip,
+             last_seen_at = excluded.last_seen_at, expires_at = excluded.expires_at`,
+        sid, uid, client.userAgent, client.ip, now, now, expiresAt,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to store session: %w", err)
+    }
+    return nil
+}
+
+// checkSession fails with errSessionRevoked unless the session is still
+// active, and bumps its last-seen time now and then.
+func checkSession(sid string, uid int64, client sessionClient) error {
+    connection := db.Get()
+    var (
+        lastSeen  int64
+        revokedAt sql.NullInt64
+    )
+    err := connection.QueryRow("SELECT last_seen_at, revoked_at FROM sessions WHERE id = ? AND user_id = ?", sid, uid).Scan(&lastSeen, &revokedAt)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return errSessionRevoked
+        }
+        return fmt.Errorf("db query error: %w", err)
+    }
+    if revokedAt.Valid {
+        return errSessionRevoked
+    }
+    now := time.Now()
+    if now.Sub(time.Unix(lastSeen, 0)) >= sessionTouchInterval {
+        _, err := connection.Exec("UPDATE sessions SET last_seen_at = ?, ip = ? WHERE id = ?", now.Unix(), client.ip, sid)
+        if err != nil {
+            return fmt.Errorf("db update error: %w", err)
+        }
+    }
+    return nil
+}
+
+// ListSessions returns the authenticated user's active sessions, most
+// recently used first. The one making the request is marked current.
+func ListSessions(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    var current string
+    if claims, ok := tokenClaimsFromContext(r.Context()); ok {
+        current = claims.SessionID
+    }
+    rows, err := db.Get().Query(
+        `SELECT id, user_agent, ip, created_at, last_seen_at, expires_at FROM sessions
+         WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+         ORDER BY last_seen_at DESC, created_at DESC`,
+        uid, time.Now().Unix(),
+    )
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    defer rows.Close()
+    list := []models.Session{}
+    for rows.Next() {
+        var s models.Session
+        if err := rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt); err != nil {
+            writeError(w, http.StatusInternalServerError, fmt.Errorf("db scan error: %w", err))
+            return
+        }
+        s.Current = s.ID == current
+        list = append(list, s)
+    }
+    writeJSON(w, http.StatusOK, list)
+}
+
+// RevokeSession signs out one of the authenticated user's sessions. Its
+// access tokens stop working immediately and its refresh token is revoked.
+func RevokeSession(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    sid := mux.Vars(r)["id"]
+    connection := db.Get()
+    tx, err := connection.Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+    var exists bool
+    err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM sessions WHERE id = ? AND user_id = ? AND revoked_at IS NULL)", sid, uid).Scan(&exists)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if !exists {
+        writeError(w, http.StatusNotFound, sql.ErrNoRows)
+        return
+    }
+    if err := revokeTokenFamily(tx, sid); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    if claims, ok := tokenClaimsFromContext(r.Context()); ok && claims.SessionID == sid {
+        clearSessionCookies(w)
+    }
+    recordAuthEvent(r, authEvent{Event: eventSessionRevoked, Outcome: outcomeSuccess, UserID: uid, Detail: sid})
+    writeJSON(w, http.StatusOK, map[string]any{"revoked": sid})
+}
@@ -13,7 +13,43 @@ import (
 	"concerts/models"
 )
 
-// ListSongs returns all songs for a specific concert.
+// songList is the sorting ListSongs offers; order is the setlist order.
+var songList = listSpec{Keys: map[string]sortKey{
+    "order":   {Expr: "song_order", Numeric: true},
+    "title":   {Expr: "title COLLATE NOCASE"},
+    "created": {Expr: "id", Numeric: true},
+}}
+
+func scanSong(row rowScanner) (models.Song, error) {
+    var song models.Song
+    err := row.Scan(&song.ID, &song.Title, &song.Notes, &song.ConcertID, &song.Order)
+    return song, err
+}
+
+// loadSongs returns the songs of a concert in setlist order.
+func loadSongs(concertID int64) ([]models.Song, error) {
+    rows, err := db.Get().Query("SELECT id, title, COALESCE(notes, ''), concert_id, song_order FROM songs WHERE concert_id = ? ORDER BY song_order ASC, id ASC", concertID)
+    if err != nil {
+        return nil, fmt.Errorf("db query error: %w", err)
+    }
+    defer rows.Close()
+    list := []models.Song{}
+    for rows.Next() {
+        s, err := scanSong(rows)
+        if err != nil {
+            return nil, fmt.Errorf("db scan error: %w", err)
+        }
+        list = append(list, s)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("db query error: %w", err)
+    }
+    return list, nil
+}
+
+// ListSongs returns a page of the songs of a specific concert, in setlist
+// order unless ?sort says otherwise. ?title and ?notes match substrings;
+// paging works as for ListConcerts.
 func ListSongs(w http.ResponseWriter, r *http.Request) {
     ctx := r.Context()
     uid, ok := UserIDFromContext(ctx)
@@ -48,24 +84,29 @@ func ListSongs(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // Get songs for the concert
-    rows, err := connection.Query("SELECT id, title, notes, concert_id, song_order FROM songs WHERE concert_id = ? ORDER BY song_order ASC, id ASC", concertID)
+    q := r.URL.Query()
+    page, err := parseListPage(q, songList, "order")
     if err != nil {
-        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        writeError(w, http.StatusBadRequest, err)
         return
     }
-    defer rows.Close()
+    where, args := []string{"concert_id = ?"}, []any{concertID}
+    for _, f := range []string{"title", "notes"} {
+        if v := q.Get(f); v != "" {
+            where, args = append(where, f+` LIKE ? ESCAPE '\'`), append(args, likePattern(v))
+        }
+    }
 
-    var list []models.Song
-    for rows.Next() {
-        var song models.Song
-        if err := rows.Scan(&song.ID, &song.Title, &song.Notes, &song.ConcertID, &song.Order); err != nil {
-            writeError(w, http.StatusInternalServerError, fmt.Errorf("db scan error: %w", err))
+    list, next, err := queryPage(page, "id, title, COALESCE(notes, ''), concert_id, song_order", "songs", where, args, scanSong)
+    if err != nil {
+        if errors.Is(err, errInvalidCursor) {
+            writeError(w, http.StatusBadRequest, err)
             return
         }
-        list = append(list, song)
+        writeError(w, http.StatusInternalServerError, err)
+        return
     }
-
+    setNextPage(w, r, next)
     writeJSON(w, http.StatusOK, list)
 }
 
@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"concerts/db"
+	"concerts/mailer"
+)
+
+const purposeAccountUnlock = "account_unlock"
+
+// loginThrottle tracks failed logins per account and per client IP. After
+// maxFailures consecutive failures a key is locked for baseLockout, doubling
+// with every further failure up to maxLockout. Counters reset once no failure
+// has been seen for window.
+type loginThrottle struct {
+    maxAccountFailures int
+    maxIPFailures      int
+    baseLockout        time.Duration
+    maxLockout         time.Duration
+    window             time.Duration
+    now                func() time.Time
+}
+
+func newLoginThrottle() *loginThrottle {
+    return &loginThrottle{
+        maxAccountFailures: intFromEnv("LOGIN_MAX_ACCOUNT_FAILURES", 5),
+        maxIPFailures:      intFromEnv("LOGIN_MAX_IP_FAILURES", 20),
+        baseLockout:        durationFromEnv("LOGIN_LOCKOUT_BASE", 30*time.Second),
+        maxLockout:         durationFromEnv("LOGIN_LOCKOUT_MAX", time.Hour),
+        window:             durationFromEnv("LOGIN_FAILURE_WINDOW", 24*time.Hour),
+        now:                time.Now,
+    }
+}
+
+var throttle = newLoginThrottle()
+
+func intFromEnv(name string, def int) int {
+    if v := os.Getenv(name); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n > 0 {
+            return n
+        }
+    }
+    return def
+}
+
+func accountThrottleKey(username string) string {
+    return "user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+func ipThrottleKey(ip string) string {
+    return "ip:" + ip
+}
+
+// mailThrottleKey counts the requests that may send mail to an address.
+func mailThrottleKey(email string) string {
+    return "mail:" + email
+}
+
+// mailIPThrottleKey counts the requests that may send mail from a client
+// address, whatever address they send to.
+func mailIPThrottleKey(ip string) string {
+    return "mail-ip:" + ip
+}
+
+// passkeyThrottleKey counts the passkey login challenges a client address has
+// requested.
+func passkeyThrottleKey(ip string) string {
+    return "passkey:" + ip
+}
+
+// retryAfter returns how long the caller must wait before trying any of the
+// given keys again, or zero if none is locked.
+func (t *loginThrottle) retryAfter(keys ...string) (time.Duration, error) {
+    connection := db.Get()
+    now := t.now()
+    var wait time.Duration
+    for _, key := range keys {
+        var lockedUntil int64
+        err := connection.QueryRow("SELECT locked_until FROM login_attempts WHERE key = ?", key).Scan(&lockedUntil)
+        if err != nil {
+            if errors.Is(err, sql.ErrNoRows) {
+                continue
+            }
+            return 0, fmt.Errorf("db query error: %w", err)
+        }
+        if d := time.Unix(lockedUntil, 0).Sub(now); d > wait {
+            wait = d
+        }
+    }
+    return wait, nil
+}
+
+// recordFailure counts a failed attempt against key and locks it once the
+// threshold is reached. It reports whether this failure started a new lockout.
+func (t *loginThrottle) recordFailure(key string, threshold int) (bool, error) {
+    connection := db.Get()
+    now := t.now()
+    var failures int
+    err := connection.QueryRow(
+        `INSERT INTO login_attempts (key, failures, locked_until, last_failure_at) VALUES (?, 1, 0, ?)
+         ON CONFLICT(key) DO UPDATE SET
+             failures = CASE WHEN last_failure_at < ? THEN 1 ELSE failures + 1 END,
+             last_failure_at = excluded.last_failure_at
+         RETURNING failures`,
+        key, now.Unix(), now.Add(-t.window).Unix(),
+    ).Scan(&failures)
+    if err != nil {
+        return false, fmt.Errorf("db upsert error: %w", err)
+    }
+    if failures < threshold {
+        return false, nil
+    }
+    lockout := t.lockoutFor(failures - threshold)
+    if _, err := connection.Exec("UPDATE login_attempts SET locked_until = ? WHERE key = ?", now.Add(lockout).Unix(), key); err != nil {
+        return false, fmt.Errorf("db update error: %w", err)
+    }
+    return failures == threshold, nil
+}
+
+func (t *loginThrottle) lockoutFor(excess int) time.Duration {
+    d := float64(t.baseLockout) * math.Pow(2, float64(excess))
+    if d > float64(t.maxLockout) {
+        return t.maxLockout
+    }
+    return time.Duration(d)
+}
+
+// reset clears the failure history for key.
+func (t *loginThrottle) reset(key string) error {
+    if _, err := db.Get().Exec("DELETE FROM login_attempts WHERE key = ?", key); err != nil {
+        return fmt.Errorf("db delete error: %w", err)
+    }
+    return nil
+}
+
+// writeLockedOut responds with 429 and a Retry-After header.
+func writeLockedOut(w http.ResponseWriter, wait time.Duration) {
+    writeRetryAfter(w, wait, errors.New("too many failed login attempts, try again later"))
+}
+
+func writeRetryAfter(w http.ResponseWriter, wait time.Duration, err error) {
+    w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+    writeError(w, http.StatusTooManyRequests, err)
+}
+
+// allowMailRequest counts an unauthenticated request that may mail a link to
+// email, per address and per client, and reports whether it may go ahead.
+// Otherwise it has already responded with 429. Requests count whether or not
+// the address has an account, so the limit does not tell which ones do.
+func allowMailRequest(w http.ResponseWriter, r *http.Request, email string) bool {
+    ip := clientIP(r)
+    wait, err := throttle.retryAfter(mailThrottleKey(email), mailIPThrottleKey(ip))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return false
+    }
+    if wait > 0 {
+        writeRetryAfter(w, wait, errors.New("too many requests, try again later"))
+        return false
+    }
+    if _, err := throttle.recordFailure(mailThrottleKey(email), throttle.maxAccountFailures); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return false
+    }
+    if _, err := throttle.recordFailure(mailIPThrottleKey(ip), throttle.maxIPFailures); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return false
+    }
+    return true
+}
+
+// loginFailed records a failed attempt for the account and client IP. When the
+// account becomes locked its owner is emailed an unlock link.
+func loginFailed(username, ip string) error {
+    locked, err := throttle.recordFailure(accountThrottleKey(username), throttle.maxAccountFailures)
+    if err != nil {
+        return err
+    }
+    if _, err := throttle.recordFailure(ipThrottleKey(ip), throttle.maxIPFailures); err != nil {
+        return err
+    }
+    if locked {
+        return sendUnlockEmail(username)
+    }
+    return nil
+}
+
+func sendUnlockEmail(username string) error {
+    connection := db.Get()
+    var (
+        uid   int64
+        email sql.NullString
+    )
+    err := connection.QueryRow("SELECT id, email FROM users WHERE username = ?", username).Scan(&uid, &email)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return nil
+        }
+        return fmt.Errorf("db query error: %w", err)
+    }
+    if !email.Valid {
+        return nil
+    }
+    token, err := issueOneTimeToken(connection, uid, purposeAccountUnlock, getPasswordResetTTL())
+    if err != nil {
+        return err
+    }
+    link := getAppBaseURL() + "/unlock-account?token=" + url.QueryEscape(token)
+    sendMailAsync(mailer.Message{
+        To:      email.String,
+        Subject: "Your account has been temporarily locked",
+        Body: fmt.Sprintf("Hi %s,\n\nWe blocked further sign-in attempts to your account after several failed passwords.\nIf this was you, use the link below to unlock it right away:\n\n%s\n\nIf it was not you, consider resetting your password.\n",
+            username, link),
+    })
+    return nil
+}
+
+type unlockRequest struct {
+    Token string `json:"token"`
+}
+
+// UnlockAccount lifts a login lockout using the token from the lockout email.
+func UnlockAccount(w http.ResponseWriter, r *http.Request) {
+    var req unlockRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    if req.Token == "" {
+        writeError(w, http.StatusBadRequest, errors.New("token is required"))
+        return
+    }
+    connection := db.Get()
+    uid, err := consumeOneTimeToken(connection, req.Token, purposeAccountUnlock)
+    if err != nil {
+        if errors.Is(err, errOneTimeTokenInvalid) {
+            writeError(w, http.StatusBadRequest, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if err := unlockUser(uid); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    recordAuthEvent(r, authEvent{Event: eventUserUnlocked, Outcome: outcomeSuccess, UserID: uid, Detail: "unlock link"})
+    writeJSON(w, http.StatusOK, map[string]string{"message": "account unlocked"})
+}
+
+// unlockUser clears the account lockout for the given user id.
+func unlockUser(uid int64) error {
+    var username string
+    if err := db.Get().QueryRow("SELECT username FROM users WHERE id = ?", uid).Scan(&username); err != nil {
+        return fmt.Errorf("db query error: %w", err)
+    }
+    return throttle.reset(accountThrottleKey(username))
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClock is a manually advanced clock for the throttle's now hook.
+type testClock struct {
+    t time.Time
+}
+
+func (c *testClock) now() time.Time {
+    return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+    c.t = c.t.Add(d)
+}
+
+// testThrottle returns a throttle on a fresh test clock: accounts lock after
+// 3 failures, client addresses after 5, for 30s doubling up to 4m.
+func testThrottle(clock *testClock) *loginThrottle {
+    return &loginThrottle{
+        maxAccountFailures: 3,
+        maxIPFailures:      5,
+        baseLockout:        30 * time.Second,
+        maxLockout:         4 * time.Minute,
+        window:             time.Hour,
+        now:                clock.now,
+    }
+}
+
+// useTestThrottle replaces the login throttle for the duration of the test.
+func useTestThrottle(t *testing.T) *testClock {
+    t.Helper()
+    clock := &testClock{t: time.Unix(1_700_000_000, 0)}
+    saved := throttle
+    throttle = testThrottle(clock)
+    t.Cleanup(func() { throttle = saved })
+    return clock
+}
+
+func login(t *testing.T, ip, username, password string) *httptest.ResponseRecorder {
+    t.Helper()
+    return call(t, Login, http.MethodPost, "/login", ip, loginRequest{Username: username, Password: password})
+}
+
+// expectLockedOut checks for a 429 whose Retry-After is the given number of
+// seconds.
+func expectLockedOut(t *testing.T, w *httptest.ResponseRecorder, retryAfter int) {
+    t.Helper()
+    if w.Code != http.StatusTooManyRequests {
+        t.Fatalf("status = %d, want 429: %s", w.Code, w.Body)
+    }
+    if got := w.Header().Get("Retry-After"); got != fmt.Sprint(retryAfter) {
+        t.Fatalf("Retry-After = %q, want %d", got, retryAfter)
+    }
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+    t.Helper()
+    if w.Code != status {
+        t.Fatalf("status = %d, want %d: %s", w.Code, status, w.Body)
+    }
+}
+
+func TestLoginCredentialStuffing(t *testing.T) {
+    clock := useTestThrottle(t)
+    createUser(t, "stuffed", "right password", "")
+
+    // Every guess comes from another address, so only the account counts.
+    for i := 1; i <= 3; i++ {
+        expectStatus(t, login(t, fmt.Sprintf("198.51.100.%d", i), "stuffed", "guess"), http.StatusUnauthorized)
+    }
+    expectLockedOut(t, login(t, "198.51.100.10", "stuffed", "right password"), 30)
+    expectLockedOut(t, login(t, "198.51.100.10", "STUFFED ", "right password"), 30)
+
+    clock.advance(10 * time.Second)
+    expectLockedOut(t, login(t, "198.51.100.10", "stuffed", "right password"), 20)
+
+    clock.advance(20 * time.Second)
+    expectStatus(t, login(t, "198.51.100.10", "stuffed", "right password"), http.StatusOK)
+
+    // A successful login clears the history.
+    expectStatus(t, login(t, "198.51.100.11", "stuffed", "guess"), http.StatusUnauthorized)
+    expectStatus(t, login(t, "198.51.100.11", "stuffed", "right password"), http.StatusOK)
+}
+
+func TestLoginPasswordSpraying(t *testing.T) {
+    clock := useTestThrottle(t)
+    createUser(t, "sprayed", "right password", "")
+
+    // One guess per account, all from one address.
+    for i := 1; i <= 5; i++ {
+        expectStatus(t, login(t, "203.0.113.7", fmt.Sprintf("spray-target-%d", i), "Summer2024!"), http.StatusUnauthorized)
+    }
+    expectLockedOut(t, login(t, "203.0.113.7", "sprayed", "right password"), 30)
+
+    // The accounts themselves are not locked.
+    expectStatus(t, login(t, "203.0.113.8", "sprayed", "right password"), http.StatusOK)
+
+    clock.advance(30 * time.Second)
+    expectStatus(t, login(t, "203.0.113.7", "sprayed", "right password"), http.StatusOK)
+}
+
+func TestLoginLockoutGrows(t *testing.T) {
+    clock := useTestThrottle(t)
+    createUser(t, "persistent", "right password", "")
+
+    for i := 0; i < 3; i++ {
+        expectStatus(t, login(t, fmt.Sprintf("192.0.2.%d", i), "persistent", "guess"), http.StatusUnauthorized)
+    }
+    expectLockedOut(t, login(t, "192.0.2.50", "persistent", "guess"), 30)
+
+    // Each failure after a lockout doubles the next one, up to the maximum.
+    for i, want := range []int{60, 120, 240, 240} {
+        clock.advance(5 * time.Minute)
+        expectStatus(t, login(t, fmt.Sprintf("192.0.2.%d", 10+i), "persistent", "guess"), http.StatusUnauthorized)
+        expectLockedOut(t, login(t, "192.0.2.50", "persistent", "right password"), want)
+    }
+
+    // Once the window passes without failures, counting starts over.
+    clock.advance(2 * time.Hour)
+    expectStatus(t, login(t, "192.0.2.60", "persistent", "guess"), http.StatusUnauthorized)
+    expectStatus(t, login(t, "192.0.2.60", "persistent", "right password"), http.StatusOK)
+}
+
+func TestUnlockAccount(t *testing.T) {
+    useTestThrottle(t)
+    createUser(t, "unlocker", "right password", "unlocker@example.com")
+
+    for i := 0; i < 3; i++ {
+        expectStatus(t, login(t, "192.0.2.100", "unlocker", "guess"), http.StatusUnauthorized)
+    }
+    expectLockedOut(t, login(t, "192.0.2.100", "unlocker", "right password"), 30)
+
+    body := waitForMail(t, "unlocker@example.com")
+    start := strings.Index(body, "http")
+    if start < 0 {
+        t.Fatalf("no link in %q", body)
+    }
+    link, err := url.Parse(strings.Fields(body[start:])[0])
+    if err != nil {
+        t.Fatal(err)
+    }
+    token := link.Query().Get("token")
+
+    expectStatus(t, call(t, UnlockAccount, http.MethodPost, "/unlock-account", "192.0.2.100", unlockRequest{Token: token}), http.StatusOK)
+    expectStatus(t, login(t, "192.0.2.101", "unlocker", "right password"), http.StatusOK)
+
+    // The link works once.
+    expectStatus(t, call(t, UnlockAccount, http.MethodPost, "/unlock-account", "192.0.2.100", unlockRequest{Token: token}), http.StatusBadRequest)
+}
+
+func TestThrottleStateSurvivesReload(t *testing.T) {
+    clock := useTestThrottle(t)
+    createUser(t, "reloaded", "right password", "")
+
+    for i := 0; i < 3; i++ {
+        expectStatus(t, login(t, "192.0.2.200", "reloaded", "guess"), http.StatusUnauthorized)
+    }
+
+    // The lockout is on disk, where a new connection finds it...
+    var failures int
+    var lockedUntil int64
+    err := openDB(t).QueryRow("SELECT failures, locked_until FROM login_attempts WHERE key = ?", accountThrottleKey("reloaded")).Scan(&failures, &lockedUntil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := clock.now().Add(30 * time.Second).Unix(); failures != 3 || lockedUntil != want {
+        t.Fatalf("failures = %d, locked_until = %d, want 3, %d", failures, lockedUntil, want)
+    }
+
+    // ...and a throttle set up from scratch, as after a restart, enforces it.
+    restarted := &testClock{t: clock.now().Add(10 * time.Second)}
+    throttle = testThrottle(restarted)
+    expectLockedOut(t, login(t, "192.0.2.201", "reloaded", "right password"), 20)
+
+    restarted.advance(20 * time.Second)
+    expectStatus(t, login(t, "192.0.2.201", "reloaded", "right password"), http.StatusOK)
+}
+
+func TestLoginIgnoresForgedForwardedFor(t *testing.T) {
+    clock := useTestThrottle(t)
+    t.Setenv("TRUST_PROXY_HEADERS", "1")
+    createUser(t, "forwarded", "right password", "")
+
+    // The proxy at 10.0.0.1 appends the attacker's real address to whatever
+    // X-Forwarded-For the attacker sent, which changes on every request.
+    forwarded := func(forged, password string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(fmt.Sprintf(`{"username":"spray-forwarded-%s","password":%q}`, forged, password)))
+        r.RemoteAddr = "10.0.0.1:40000"
+        r.Header.Set("X-Forwarded-For", forged+", 203.0.113.99")
+        w := httptest.NewRecorder()
+        Login(w, r)
+        return w
+    }
+    for i := 1; i <= 5; i++ {
+        expectStatus(t, forwarded(fmt.Sprintf("198.18.0.%d", i), "Summer2024!"), http.StatusUnauthorized)
+    }
+    expectLockedOut(t, forwarded("198.18.0.6", "Summer2024!"), 30)
+
+    clock.advance(30 * time.Second)
+    expectStatus(t, forwarded("198.18.0.7", "Summer2024!"), http.StatusUnauthorized)
+}
+
+func TestClientIP(t *testing.T) {
+    for _, tc := range []struct {
+        trust     string
+        forwarded []string
+        want      string
+    }{
+        {"", []string{"198.18.0.1"}, "10.0.0.1"},
+        {"1", nil, "10.0.0.1"},
+        {"1", []string{"198.18.0.1, 203.0.113.1"}, "203.0.113.1"},
+        {"1", []string{"198.18.0.1", "203.0.113.1"}, "203.0.113.1"},
+        {"2", []string{"198.18.0.1, 203.0.113.1, 10.0.0.2"}, "203.0.113.1"},
+        {"2", []string{"203.0.113.1"}, "203.0.113.1"},
+        {"yes", []string{"198.18.0.1"}, "10.0.0.1"},
+    } {
+        t.Setenv("TRUST_PROXY_HEADERS", tc.trust)
+        r := httptest.NewRequest(http.MethodGet, "/", nil)
+        r.RemoteAddr = "10.0.0.1:40000"
+        for _, f := range tc.forwarded {
+            r.Header.Add("X-Forwarded-For", f)
+        }
+        if got := clientIP(r); got != tc.want {
+            t.Errorf("TRUST_PROXY_HEADERS=%q, X-Forwarded-For %q: clientIP = %s, want %s", tc.trust, tc.forwarded, got, tc.want)
+        }
+    }
+}
+
+func TestMailRequestsAreThrottled(t *testing.T) {
+    clock := useTestThrottle(t)
+    t.Setenv("MAGIC_LINK_LOGIN", "1")
+    createUser(t, "bombed", "right password", "bombed@example.com")
+
+    // Every endpoint that mails a link counts against the same address, from
+    // whichever client.
+    forgot := func(ip, email string) *httptest.ResponseRecorder {
+        return call(t, ForgotPassword, http.MethodPost, "/password/forgot", ip, forgotPasswordRequest{Email: email})
+    }
+    expectStatus(t, forgot("198.51.100.30", "bombed@example.com"), http.StatusAccepted)
+    expectStatus(t, call(t, RequestMagicLink, http.MethodPost, "/magic-link", "198.51.100.31", magicLinkRequest{Email: "bombed@example.com"}), http.StatusAccepted)
+    expectStatus(t, call(t, ResendVerification, http.MethodPost, "/verify-email/resend", "198.51.100.32", resendVerificationRequest{Email: "bombed@example.com"}), http.StatusAccepted)
+    expectLockedOut(t, forgot("198.51.100.33", "bombed@example.com"), 30)
+    expectLockedOut(t, forgot("198.51.100.33", "Bombed@Example.com"), 30)
+
+    clock.advance(30 * time.Second)
+    expectStatus(t, forgot("198.51.100.33", "bombed@example.com"), http.StatusAccepted)
+
+    // One client spreading requests over many addresses, with or without
+    // accounts, is limited too.
+    for i := 1; i <= 5; i++ {
+        expectStatus(t, forgot("198.51.100.40", fmt.Sprintf("nobody-%d@example.com", i)), http.StatusAccepted)
+    }
+    expectLockedOut(t, forgot("198.51.100.40", "nobody-6@example.com"), 30)
+}
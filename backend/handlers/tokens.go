@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"concerts/db"
+	"concerts/keys"
+)
+
+var (
+    errRefreshTokenInvalid = errors.New("invalid refresh token")
+    errRefreshTokenRevoked = errors.New("refresh token revoked")
+    errRefreshTokenExpired = errors.New("refresh token expired")
+    errRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+func getAccessTokenTTL() time.Duration {
+    return durationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+}
+
+func getRefreshTokenTTL() time.Duration {
+    return durationFromEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+}
+
+func durationFromEnv(name string, def time.Duration) time.Duration {
+    if v := os.Getenv(name); v != "" {
+        if d, err := time.ParseDuration(v); err == nil && d > 0 {
+            return d
+        }
+    }
+    return def
+}
+
+// randomToken returns n random bytes encoded as unpadded base64url.
+func randomToken(n int) (string, error) {
+    b := make([]byte, n)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex encoded SHA-256 of an opaque token. Only hashes are
+// ever stored in the database.
+func hashToken(raw string) string {
+    sum := sha256.Sum256([]byte(raw))
+    return hex.EncodeToString(sum[:])
+}
+
+// accessClaims are the claims of an access token. SessionID is the login
+// session (refresh token family) the token belongs to; Generation is the
+// user's token generation at issue, see accessDenylist.revokeUser.
+type accessClaims struct {
+    jwt.RegisteredClaims
+    SessionID  string `json:"sid,omitempty"`
+    Generation int64  `json:"gen,omitempty"`
+}
+
+// signAccessToken issues a short-lived access JWT for the given user and session.
+func signAccessToken(uid int64, sid string) (string, error) {
+    jti, err := randomToken(16)
+    if err != nil {
+        return "", err
+    }
+    generation, err := denylist.generation(uid)
+    if err != nil {
+        return "", err
+    }
+    now := time.Now()
+    claims := accessClaims{
+        RegisteredClaims: jwt.RegisteredClaims{
+            ID:        jti,
+            Subject:   strconv.FormatInt(uid, 10),
+            ExpiresAt: jwt.NewNumericDate(now.Add(getAccessTokenTTL())),
+            IssuedAt:  jwt.NewNumericDate(now),
+        },
+        SessionID:  sid,
+        Generation: generation,
+    }
+    return signJWT(claims)
+}
+
+// signJWT signs claims with the active key of the keyring.
+func signJWT(claims jwt.Claims) (string, error) {
+    return keys.Get().Sign(claims)
+}
+
+// parseJWT verifies a token against any key in the keyring.
+func parseJWT(raw string, claims jwt.Claims, opts ...jwt.ParserOption) (*jwt.Token, error) {
+    ring := keys.Get()
+    opts = append(opts, jwt.WithValidMethods(ring.Methods()))
+    return jwt.ParseWithClaims(raw, claims, ring.Keyfunc, opts...)
+}
+
+// JWKS publishes the public verification keys so that other services can
+// validate tokens issued here.
+func JWKS(w http.ResponseWriter, r *http.Request) {
+    set, err := keys.Get().JWKS()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    w.Header().Set("Cache-Control", "public, max-age=300")
+    writeJSON(w, http.StatusOK, set)
+}
+
+type tokenPair struct {
+    AccessToken  string
+    RefreshToken string
+    ExpiresIn    int64
+}
+
+// issueTokenPair signs an access token and stores a new refresh token. An empty
+// family starts a new token family (i.e. a new login). The family doubles as
+// the session id; its session record is created or refreshed with client.
+func issueTokenPair(q execer, uid int64, family string, client sessionClient) (tokenPair, error) {
+    if family == "" {
+        f, err := randomToken(16)
+        if err != nil {
+            return tokenPair{}, fmt.Errorf("failed to generate token family: %w", err)
+        }
+        family = f
+    }
+    refresh, err := randomToken(32)
+    if err != nil {
+        return tokenPair{}, fmt.Errorf("failed to generate refresh token: %w", err)
+    }
+    now := time.Now()
+    expiresAt := now.Add(getRefreshTokenTTL()).Unix()
+    _, err = q.Exec(
+        "INSERT INTO refresh_tokens (user_id, family_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+        uid, family, hashToken(refresh), now.Unix(), expiresAt,
+    )
+    if err != nil {
+        return tokenPair{}, fmt.Errorf("failed to store refresh token: %w", err)
+    }
+    if err := touchSession(q, family, uid, client, expiresAt); err != nil {
+        return tokenPair{}, err
+    }
+    access, err := signAccessToken(uid, family)
+    if err != nil {
+        return tokenPair{}, fmt.Errorf("failed to sign token: %w", err)
+    }
+    return tokenPair{
+        AccessToken:  access,
+        RefreshToken: refresh,
+        ExpiresIn:    int64(getAccessTokenTTL().Seconds()),
+    }, nil
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+    Exec(query string, args ...any) (sql.Result, error)
+}
+
+// revokeTokenFamily revokes every refresh token descending from the same
+// login, and with them the session.
+func revokeTokenFamily(q execer, family string) error {
+    now := time.Now().Unix()
+    if _, err := q.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL", now, family); err != nil {
+        return err
+    }
+    _, err := q.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", now, family)
+    return err
+}
+
+// revokeAllSessions signs the user out everywhere: outstanding access tokens
+// are denylisted and every refresh token and personal access token is
+// revoked, so a token minted by someone who briefly held a session does not
+// outlive the recovery steps.
+func revokeAllSessions(q execer, uid int64) error {
+    if err := denylist.revokeUser(uid); err != nil {
+        return err
+    }
+    now := time.Now().Unix()
+    if _, err := q.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", now, uid); err != nil {
+        return fmt.Errorf("db update error: %w", err)
+    }
+    if _, err := q.Exec("UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", now, uid); err != nil {
+        return fmt.Errorf("db update error: %w", err)
+    }
+    if _, err := q.Exec("UPDATE api_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", now, uid); err != nil {
+        return fmt.Errorf("db update error: %w", err)
+    }
+    return nil
+}
+
+// rotateRefreshToken consumes a refresh token and returns a fresh pair from the
+// same family. Presenting an already used token revokes the whole family.
+func rotateRefreshToken(raw string, client sessionClient) (tokenPair, error) {
+    connection := db.Get()
+    tx, err := connection.Begin()
+    if err != nil {
+        return tokenPair{}, fmt.Errorf("db transaction error: %w", err)
+    }
+    defer tx.Rollback()
+
+    var (
+        id        int64
+        uid       int64
+        family    string
+        expiresAt int64
+        usedAt    sql.NullInt64
+        revokedAt sql.NullInt64
+        disabled  sql.NullInt64
+    )
+    err = tx.QueryRow(
+        `SELECT rt.id, rt.user_id, rt.family_id, rt.expires_at, rt.used_at, rt.revoked_at, u.disabled_at
+         FROM refresh_tokens rt JOIN users u ON u.id = rt.user_id
+         WHERE rt.token_hash = ?`,
+        hashToken(raw),
+    ).Scan(&id, &uid, &family, &expiresAt, &usedAt, &revokedAt, &disabled)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return tokenPair{}, errRefreshTokenInvalid
+        }
+        return tokenPair{}, fmt.Errorf("db query error: %w", err)
+    }
+    if usedAt.Valid {
+        if err := revokeTokenFamily(tx, family); err != nil {
+            return tokenPair{}, fmt.Errorf("db update error: %w", err)
+        }
+        if err := tx.Commit(); err != nil {
+            return tokenPair{}, fmt.Errorf("db commit error: %w", err)
+        }
+        return tokenPair{}, errRefreshTokenReused
+    }
+    if revokedAt.Valid {
+        return tokenPair{}, errRefreshTokenRevoked
+    }
+    if disabled.Valid {
+        return tokenPair{}, errAccountDisabled
+    }
+    now := time.Now()
+    if now.Unix() >= expiresAt {
+        return tokenPair{}, errRefreshTokenExpired
+    }
+
+    res, err := tx.Exec("UPDATE refresh_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL", now.Unix(), id)
+    if err != nil {
+        return tokenPair{}, fmt.Errorf("db update error: %w", err)
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return tokenPair{}, errRefreshTokenReused
+    }
+    pair, err := issueTokenPair(tx, uid, family, client)
+    if err != nil {
+        return tokenPair{}, err
+    }
+    if err := tx.Commit(); err != nil {
+        return tokenPair{}, fmt.Errorf("db commit error: %w", err)
+    }
+    return pair, nil
+}
+
+type refreshRequest struct {
+    RefreshToken string `json:"refresh_token"`
+}
+
+// refreshTokenOwner returns the user a refresh token was issued to, or 0.
+func refreshTokenOwner(raw string) int64 {
+    var uid int64
+    _ = db.Get().QueryRow("SELECT user_id FROM refresh_tokens WHERE token_hash = ?", hashToken(raw)).Scan(&uid)
+    return uid
+}
+
+// RefreshToken exchanges a refresh token for a new access/refresh token pair.
+// Without a refresh_token in the body the refresh cookie is used, and the new
+// pair is returned as cookies again.
+func RefreshToken(w http.ResponseWriter, r *http.Request) {
+    var req refreshRequest
+    if err := readJSON(r, &req); err != nil && !errors.Is(err, io.EOF) {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    cookies := false
+    if req.RefreshToken == "" {
+        if c, err := r.Cookie(refreshCookieName); err == nil && c.Value != "" {
+            if !validCSRF(r) {
+                writeError(w, http.StatusForbidden, errors.New("missing or invalid csrf token"))
+                return
+            }
+            req.RefreshToken = c.Value
+            cookies = true
+        }
+    }
+    if req.RefreshToken == "" {
+        writeError(w, http.StatusBadRequest, errors.New("refresh_token is required"))
+        return
+    }
+    pair, err := rotateRefreshToken(req.RefreshToken, clientFromRequest(r))
+    if err != nil {
+        switch {
+        case errors.Is(err, errRefreshTokenInvalid), errors.Is(err, errRefreshTokenRevoked),
+            errors.Is(err, errRefreshTokenExpired), errors.Is(err, errRefreshTokenReused),
+            errors.Is(err, errAccountDisabled):
+            recordAuthEvent(r, authEvent{Event: eventTokenRefresh, Outcome: outcomeFailure, UserID: refreshTokenOwner(req.RefreshToken), Detail: err.Error()})
+            writeError(w, http.StatusUnauthorized, err)
+        default:
+            writeError(w, http.StatusInternalServerError, err)
+        }
+        return
+    }
+    writeTokenPair(w, pair, cookies, nil)
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"concerts/db"
+)
+
+const refreshIP = "192.0.2.150"
+
+type tokenResponse struct {
+    Token        string `json:"token"`
+    RefreshToken string `json:"refresh_token"`
+}
+
+// loginTokens logs in as a new user and returns the token pair.
+func loginTokens(t *testing.T, username string) tokenResponse {
+    t.Helper()
+    createUser(t, username, "right password", "")
+    w := login(t, refreshIP, username, "right password")
+    expectStatus(t, w, http.StatusOK)
+    var pair tokenResponse
+    decode(t, w, &pair)
+    if pair.Token == "" || pair.RefreshToken == "" {
+        t.Fatalf("no token pair in %s", w.Body)
+    }
+    return pair
+}
+
+func refresh(t *testing.T, raw string) *httptest.ResponseRecorder {
+    t.Helper()
+    return call(t, RefreshToken, http.MethodPost, "/refresh", refreshIP, refreshRequest{RefreshToken: raw})
+}
+
+// authenticated reports the status RequireAuth gives an access token.
+func authenticated(t *testing.T, access string) int {
+    t.Helper()
+    handler := RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNoContent)
+    }))
+    r := httptest.NewRequest(http.MethodGet, "/me", nil)
+    r.RemoteAddr = refreshIP + ":40000"
+    r.Header.Set("Authorization", "Bearer "+access)
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, r)
+    return w.Code
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+    first := loginTokens(t, "refresh-rotate")
+
+    w := refresh(t, first.RefreshToken)
+    expectStatus(t, w, http.StatusOK)
+    var second tokenResponse
+    decode(t, w, &second)
+    if second.RefreshToken == "" || second.RefreshToken == first.RefreshToken || second.Token == "" {
+        t.Fatalf("refresh did not rotate: %s", w.Body)
+    }
+    if got := authenticated(t, second.Token); got != http.StatusNoContent {
+        t.Fatalf("new access token: status = %d", got)
+    }
+
+    // The next rotation works from the new token; the old one is spent.
+    expectStatus(t, refresh(t, second.RefreshToken), http.StatusOK)
+    expectStatus(t, refresh(t, first.RefreshToken), http.StatusUnauthorized)
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+    first := loginTokens(t, "refresh-reuse")
+    w := refresh(t, first.RefreshToken)
+    expectStatus(t, w, http.StatusOK)
+    var second tokenResponse
+    decode(t, w, &second)
+
+    // Someone replays the used token: the whole login is revoked, including
+    // the tokens the legitimate client holds now.
+    w = refresh(t, first.RefreshToken)
+    expectStatus(t, w, http.StatusUnauthorized)
+    if !containsError(w, errRefreshTokenReused) {
+        t.Fatalf("unexpected error %s", w.Body)
+    }
+    expectStatus(t, refresh(t, second.RefreshToken), http.StatusUnauthorized)
+    if got := authenticated(t, second.Token); got != http.StatusUnauthorized {
+        t.Fatalf("access token of the revoked session: status = %d, want 401", got)
+    }
+
+    var live, sessions int
+    err := db.Get().QueryRow(
+        `SELECT (SELECT COUNT(*) FROM refresh_tokens WHERE token_hash IN (?, ?) AND revoked_at IS NULL),
+                (SELECT COUNT(*) FROM sessions s JOIN refresh_tokens rt ON rt.family_id = s.id WHERE rt.token_hash = ? AND s.revoked_at IS NULL)`,
+        hashToken(first.RefreshToken), hashToken(second.RefreshToken), hashToken(second.RefreshToken),
+    ).Scan(&live, &sessions)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if live != 0 || sessions != 0 {
+        t.Fatalf("%d refresh tokens and %d sessions still live", live, sessions)
+    }
+}
+
+func TestRefreshTokenExpired(t *testing.T) {
+    pair := loginTokens(t, "refresh-expired")
+    if _, err := db.Get().Exec("UPDATE refresh_tokens SET expires_at = 1 WHERE token_hash = ?", hashToken(pair.RefreshToken)); err != nil {
+        t.Fatal(err)
+    }
+    w := refresh(t, pair.RefreshToken)
+    expectStatus(t, w, http.StatusUnauthorized)
+    if !containsError(w, errRefreshTokenExpired) {
+        t.Fatalf("unexpected error %s", w.Body)
+    }
+
+    expectStatus(t, refresh(t, "not-a-refresh-token"), http.StatusUnauthorized)
+}
+
+func containsError(w *httptest.ResponseRecorder, err error) bool {
+    var payload errorPayload
+    if e := json.Unmarshal(w.Body.Bytes(), &payload); e != nil {
+        return false
+    }
+    return payload.Error == err.Error()
+}
@@ -0,0 +1,560 @@
+package handlers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"concerts/db"
+	"concerts/totp"
+)
+
+const (
+    mfaChallengeAudience = "mfa"
+    mfaChallengeTTL      = 5 * time.Minute
+    recoveryCodeCount    = 10
+    // totpSkew is the number of 30s steps of clock drift tolerated either way.
+    totpSkew = 1
+)
+
+var errInvalidSecondFactor = errors.New("invalid authentication code")
+
+// totpSealedPrefix marks an encrypted users.totp_secret. Base32 secrets
+// never contain a colon.
+const totpSealedPrefix = "v1:"
+
+// totpCipher returns the AEAD that encrypts TOTP secrets at rest, or nil if
+// TOTP_ENCRYPTION_KEY (32 bytes, base64) is not set. Without it secrets are
+// stored in plaintext, and anyone holding a copy of the database can generate
+// codes for every account with two-factor authentication.
+func totpCipher() (cipher.AEAD, error) {
+    v := os.Getenv("TOTP_ENCRYPTION_KEY")
+    if v == "" {
+        return nil, nil
+    }
+    key, err := base64.StdEncoding.DecodeString(v)
+    if err != nil || len(key) != 32 {
+        return nil, errors.New("TOTP_ENCRYPTION_KEY must be 32 bytes, base64 encoded")
+    }
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+// sealTOTPSecret returns secret as it is to be stored.
+func sealTOTPSecret(uid int64, secret string) (string, error) {
+    aead, err := totpCipher()
+    if err != nil || aead == nil {
+        return secret, err
+    }
+    nonce := make([]byte, aead.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+        return "", err
+    }
+    // The user id is authenticated too, so a secret cannot be copied to
+    // another account.
+    sealed := aead.Seal(nonce, nonce, []byte(secret), []byte(strconv.FormatInt(uid, 10)))
+    return totpSealedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// openTOTPSecret reverses sealTOTPSecret. Secrets stored before encryption
+// was configured are returned as they are.
+func openTOTPSecret(uid int64, stored string) (string, error) {
+    if !strings.HasPrefix(stored, totpSealedPrefix) {
+        return stored, nil
+    }
+    aead, err := totpCipher()
+    if err != nil {
+        return "", err
+    }
+    if aead == nil {
+        return "", errors.New("TOTP secret is encrypted but TOTP_ENCRYPTION_KEY is not set")
+    }
+    sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(stored, totpSealedPrefix))
+    if err != nil || len(sealed) < aead.NonceSize() {
+        return "", errors.New("malformed encrypted TOTP secret")
+    }
+    secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(strconv.FormatInt(uid, 10)))
+    if err != nil {
+        return "", fmt.Errorf("failed to decrypt TOTP secret: %w", err)
+    }
+    return string(secret), nil
+}
+
+// EncryptTOTPSecrets checks TOTP_ENCRYPTION_KEY and, when it is set, encrypts
+// any secrets still stored in plaintext.
+func EncryptTOTPSecrets() error {
+    aead, err := totpCipher()
+    if err != nil {
+        return err
+    }
+    if aead == nil {
+        log.Printf("TOTP_ENCRYPTION_KEY not set, TOTP secrets are stored unencrypted")
+        return nil
+    }
+    connection := db.Get()
+    rows, err := connection.Query("SELECT id, totp_secret FROM users WHERE totp_secret IS NOT NULL AND totp_secret NOT LIKE ?", totpSealedPrefix+"%")
+    if err != nil {
+        return fmt.Errorf("db query error: %w", err)
+    }
+    plain := map[int64]string{}
+    for rows.Next() {
+        var (
+            uid    int64
+            secret string
+        )
+        if err := rows.Scan(&uid, &secret); err != nil {
+            rows.Close()
+            return fmt.Errorf("db scan error: %w", err)
+        }
+        plain[uid] = secret
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    for uid, secret := range plain {
+        sealed, err := sealTOTPSecret(uid, secret)
+        if err != nil {
+            return err
+        }
+        if _, err := connection.Exec("UPDATE users SET totp_secret = ? WHERE id = ? AND totp_secret = ?", sealed, uid, secret); err != nil {
+            return fmt.Errorf("db update error: %w", err)
+        }
+    }
+    if len(plain) > 0 {
+        log.Printf("encrypted %d TOTP secrets", len(plain))
+    }
+    return nil
+}
+
+func getTOTPIssuer() string {
+    if s := os.Getenv("TOTP_ISSUER"); s != "" {
+        return s
+    }
+    return "Concerts"
+}
+
+// writeMFAChallenge responds with a short-lived challenge token that can only
+// be exchanged for a session at /login/2fa.
+func writeMFAChallenge(w http.ResponseWriter, uid int64) {
+    jti, err := randomToken(16)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate token id: %w", err))
+        return
+    }
+    generation, err := denylist.generation(uid)
+    if err != nil {
+        writeError(w, http.StatusServiceUnavailable, err)
+        return
+    }
+    now := time.Now()
+    claims := accessClaims{
+        RegisteredClaims: jwt.RegisteredClaims{
+            ID:        jti,
+            Subject:   strconv.FormatInt(uid, 10),
+            Audience:  jwt.ClaimStrings{mfaChallengeAudience},
+            ExpiresAt: jwt.NewNumericDate(now.Add(mfaChallengeTTL)),
+            IssuedAt:  jwt.NewNumericDate(now),
+        },
+        Generation: generation,
+    }
+    signed, err := signJWT(claims)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to sign token: %w", err))
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{
+        "mfa_required":    true,
+        "challenge_token": signed,
+        "expires_in":      int64(mfaChallengeTTL.Seconds()),
+    })
+}
+
+type twoFactorLoginRequest struct {
+    ChallengeToken string `json:"challenge_token"`
+    Code           string `json:"code"`
+    RecoveryCode   string `json:"recovery_code"`
+    Session        string `json:"session"`
+}
+
+// LoginTwoFactor completes a login by exchanging a challenge token and a TOTP
+// or recovery code for a token pair.
+func LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+    var req twoFactorLoginRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    if req.Code == "" && req.RecoveryCode == "" {
+        writeError(w, http.StatusBadRequest, errors.New("code or recovery_code is required"))
+        return
+    }
+    cookies, err := useCookieSession(req.Session)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    parsed, err := parseJWT(req.ChallengeToken, &accessClaims{}, jwt.WithAudience(mfaChallengeAudience))
+    if err != nil || !parsed.Valid {
+        writeError(w, http.StatusUnauthorized, errors.New("invalid or expired challenge token"))
+        return
+    }
+    claims := parsed.Claims.(*accessClaims)
+    uid, err := strconv.ParseInt(claims.Subject, 10, 64)
+    if err != nil || claims.ID == "" || claims.IssuedAt == nil {
+        writeError(w, http.StatusUnauthorized, errors.New("invalid challenge token"))
+        return
+    }
+    revoked, err := denylist.isRevoked(claims.ID, uid, claims.Generation)
+    if err != nil {
+        writeError(w, http.StatusServiceUnavailable, err)
+        return
+    }
+    if revoked {
+        writeError(w, http.StatusUnauthorized, errors.New("challenge token already used"))
+        return
+    }
+
+    connection := db.Get()
+    var username string
+    if err := connection.QueryRow("SELECT username FROM users WHERE id = ?", uid).Scan(&username); err != nil {
+        writeError(w, http.StatusUnauthorized, errors.New("invalid challenge token"))
+        return
+    }
+    ip := clientIP(r)
+    wait, err := throttle.retryAfter(accountThrottleKey(username), ipThrottleKey(ip))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    method := loginMethodTOTP
+    if req.Code == "" {
+        method = loginMethodRecoveryCode
+    }
+    if wait > 0 {
+        recordAuthEvent(r, authEvent{Event: eventLogin, Outcome: outcomeFailure, UserID: uid, Username: username, Detail: method + ": locked out"})
+        writeLockedOut(w, wait)
+        return
+    }
+
+    if req.Code != "" {
+        err = verifyTOTP(connection, uid, req.Code)
+    } else {
+        err = useRecoveryCode(connection, uid, req.RecoveryCode)
+    }
+    if err != nil {
+        if errors.Is(err, errInvalidSecondFactor) {
+            if err := loginFailed(username, ip); err != nil {
+                writeError(w, http.StatusInternalServerError, err)
+                return
+            }
+            recordAuthEvent(r, authEvent{Event: eventLogin, Outcome: outcomeFailure, UserID: uid, Username: username, Detail: method + ": " + err.Error()})
+            writeError(w, http.StatusUnauthorized, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if err := denylist.revokeToken(claims.ID, uid, claims.ExpiresAt.Time); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    startSession(w, r, uid, username, method, cookies)
+}
+
+// SetupTOTP generates a new, not yet active, TOTP secret for the user.
+func SetupTOTP(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    connection := db.Get()
+    var (
+        username string
+        enabled  bool
+    )
+    if err := connection.QueryRow("SELECT username, totp_enabled FROM users WHERE id = ?", uid).Scan(&username, &enabled); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if enabled {
+        writeError(w, http.StatusConflict, errors.New("two-factor authentication is already enabled"))
+        return
+    }
+    secret, err := totp.GenerateSecret()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate secret: %w", err))
+        return
+    }
+    sealed, err := sealTOTPSecret(uid, secret)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to encrypt secret: %w", err))
+        return
+    }
+    if _, err := connection.Exec("UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?", sealed, uid); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]string{
+        "secret":      secret,
+        "otpauth_uri": totp.URI(getTOTPIssuer(), username, secret),
+    })
+}
+
+type totpCodeRequest struct {
+    Code string `json:"code"`
+}
+
+// EnableTOTP activates the pending secret after the user proves their
+// authenticator produces valid codes, and returns fresh recovery codes.
+func EnableTOTP(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    var req totpCodeRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    connection := db.Get()
+    var (
+        secret  sql.NullString
+        enabled bool
+    )
+    if err := connection.QueryRow("SELECT totp_secret, totp_enabled FROM users WHERE id = ?", uid).Scan(&secret, &enabled); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if enabled {
+        writeError(w, http.StatusConflict, errors.New("two-factor authentication is already enabled"))
+        return
+    }
+    if !secret.Valid {
+        writeError(w, http.StatusBadRequest, errors.New("call setup first"))
+        return
+    }
+    plain, err := openTOTPSecret(uid, secret.String)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    step, ok := totp.Validate(plain, req.Code, time.Now(), totpSkew)
+    if !ok {
+        writeError(w, http.StatusBadRequest, errInvalidSecondFactor)
+        return
+    }
+
+    tx, err := connection.Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+    if _, err := tx.Exec("UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ?", step, uid); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+        return
+    }
+    codes, err := replaceRecoveryCodes(tx, uid)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    recordAuthEvent(r, authEvent{Event: eventTOTPEnabled, Outcome: outcomeSuccess, UserID: uid})
+    writeJSON(w, http.StatusOK, map[string]any{"enabled": true, "recovery_codes": codes})
+}
+
+type disableTOTPRequest struct {
+    Password string `json:"password"`
+    Code     string `json:"code"`
+}
+
+// DisableTOTP turns two-factor authentication off. Both the password and a
+// current code are required.
+func DisableTOTP(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    var req disableTOTPRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    connection := db.Get()
+    var hash string
+    if err := connection.QueryRow("SELECT password_hash FROM users WHERE id = ?", uid).Scan(&hash); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if ok, err := verifyPassword(hash, req.Password); err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    } else if !ok {
+        writeError(w, http.StatusForbidden, errors.New("password is incorrect"))
+        return
+    }
+    if err := verifyTOTP(connection, uid, req.Code); err != nil {
+        if errors.Is(err, errInvalidSecondFactor) {
+            writeError(w, http.StatusForbidden, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+
+    tx, err := connection.Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+    if _, err := tx.Exec("UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_step = 0 WHERE id = ?", uid); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+        return
+    }
+    if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", uid); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db delete error: %w", err))
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    recordAuthEvent(r, authEvent{Event: eventTOTPDisabled, Outcome: outcomeSuccess, UserID: uid})
+    writeJSON(w, http.StatusOK, map[string]bool{"enabled": false})
+}
+
+// RegenerateRecoveryCodes invalidates all recovery codes and issues new ones.
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    var req totpCodeRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    connection := db.Get()
+    if err := verifyTOTP(connection, uid, req.Code); err != nil {
+        if errors.Is(err, errInvalidSecondFactor) {
+            writeError(w, http.StatusForbidden, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    tx, err := connection.Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+    codes, err := replaceRecoveryCodes(tx, uid)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    recordAuthEvent(r, authEvent{Event: eventRecoveryCodes, Outcome: outcomeSuccess, UserID: uid})
+    writeJSON(w, http.StatusOK, map[string]any{"recovery_codes": codes})
+}
+
+// verifyTOTP checks a code against the user's active secret. Each time step can
+// only be used once.
+func verifyTOTP(q queryExecer, uid int64, code string) error {
+    var (
+        secret  sql.NullString
+        enabled bool
+    )
+    if err := q.QueryRow("SELECT totp_secret, totp_enabled FROM users WHERE id = ?", uid).Scan(&secret, &enabled); err != nil {
+        return fmt.Errorf("db query error: %w", err)
+    }
+    if !enabled || !secret.Valid {
+        return errInvalidSecondFactor
+    }
+    plain, err := openTOTPSecret(uid, secret.String)
+    if err != nil {
+        return err
+    }
+    step, ok := totp.Validate(plain, code, time.Now(), totpSkew)
+    if !ok {
+        return errInvalidSecondFactor
+    }
+    res, err := q.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, uid, step)
+    if err != nil {
+        return fmt.Errorf("db update error: %w", err)
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return errInvalidSecondFactor
+    }
+    return nil
+}
+
+// useRecoveryCode consumes one of the user's unused recovery codes.
+func useRecoveryCode(q execer, uid int64, code string) error {
+    res, err := q.Exec(
+        "UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+        time.Now().Unix(), uid, hashToken(normalizeRecoveryCode(code)),
+    )
+    if err != nil {
+        return fmt.Errorf("db update error: %w", err)
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return errInvalidSecondFactor
+    }
+    return nil
+}
+
+// replaceRecoveryCodes deletes the user's recovery codes and stores a new set,
+// returning the plaintext codes. They are never retrievable again.
+func replaceRecoveryCodes(q execer, uid int64) ([]string, error) {
+    if _, err := q.Exec("DELETE FROM recovery_codes WHERE user_id = ?", uid); err != nil {
+        return nil, fmt.Errorf("db delete error: %w", err)
+    }
+    codes := make([]string, 0, recoveryCodeCount)
+    for i := 0; i < recoveryCodeCount; i++ {
+        raw, err := totp.GenerateSecret()
+        if err != nil {
+            return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+        }
+        code := strings.ToLower(raw[:5] + "-" + raw[5:10])
+        if _, err := q.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", uid, hashToken(normalizeRecoveryCode(code))); err != nil {
+            return nil, fmt.Errorf("db insert error: %w", err)
+        }
+        codes = append(codes, code)
+    }
+    return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+    code = strings.ToLower(strings.TrimSpace(code))
+    return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
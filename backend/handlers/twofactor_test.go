@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"concerts/db"
+	"concerts/totp"
+)
+
+func useTOTPKey(t *testing.T) {
+    t.Helper()
+    key := make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("TOTP_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key))
+}
+
+func storedTOTPSecret(t *testing.T, uid int64) string {
+    t.Helper()
+    var stored string
+    if err := db.Get().QueryRow("SELECT totp_secret FROM users WHERE id = ?", uid).Scan(&stored); err != nil {
+        t.Fatal(err)
+    }
+    return stored
+}
+
+func TestTOTPSecretIsEncryptedAtRest(t *testing.T) {
+    useTOTPKey(t)
+    uid := createUser(t, "totp-sealed", "right password", "")
+
+    w := call(t, asUser(uid, SetupTOTP), http.MethodPost, "/2fa/totp/setup", "192.0.2.140", nil)
+    expectStatus(t, w, http.StatusOK)
+    var setup struct {
+        Secret string `json:"secret"`
+    }
+    decode(t, w, &setup)
+    stored := storedTOTPSecret(t, uid)
+    if !strings.HasPrefix(stored, totpSealedPrefix) || strings.Contains(stored, setup.Secret) {
+        t.Fatalf("secret stored as %q", stored)
+    }
+
+    code, err := totp.Code(setup.Secret, totp.Step(time.Now()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    expectStatus(t, call(t, asUser(uid, EnableTOTP), http.MethodPost, "/2fa/totp/enable", "192.0.2.140", totpCodeRequest{Code: code}), http.StatusOK)
+
+    // A sealed secret only opens for its own account.
+    if _, err := openTOTPSecret(uid+1, stored); err == nil {
+        t.Fatal("secret opened for another account")
+    }
+}
+
+func TestEncryptTOTPSecrets(t *testing.T) {
+    uid := createUser(t, "totp-plaintext", "right password", "")
+    secret, err := totp.GenerateSecret()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := db.Get().Exec("UPDATE users SET totp_secret = ? WHERE id = ?", secret, uid); err != nil {
+        t.Fatal(err)
+    }
+
+    useTOTPKey(t)
+    if err := EncryptTOTPSecrets(); err != nil {
+        t.Fatal(err)
+    }
+    stored := storedTOTPSecret(t, uid)
+    if !strings.HasPrefix(stored, totpSealedPrefix) {
+        t.Fatalf("secret still stored as %q", stored)
+    }
+    if got, err := openTOTPSecret(uid, stored); err != nil || got != secret {
+        t.Fatalf("opened %q, %v, want %q", got, err, secret)
+    }
+}
@@ -0,0 +1,475 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"concerts/db"
+	"concerts/models"
+	"concerts/venues"
+)
+
+var (
+    errUnknownVenue   = errors.New("venue_id is not one of your venues")
+    errUnknownConcert = errors.New("concert_ids contains concerts that are not yours")
+)
+
+const venueColumns = "id, name, address, city, country, capacity, latitude, longitude, user_id"
+
+func scanVenue(row rowScanner) (models.Venue, error) {
+    var (
+        v                   models.Venue
+        capacity            sql.NullInt64
+        latitude, longitude sql.NullFloat64
+    )
+    if err := row.Scan(&v.ID, &v.Name, &v.Address, &v.City, &v.Country, &capacity, &latitude, &longitude, &v.UserID); err != nil {
+        return v, err
+    }
+    if capacity.Valid {
+        v.Capacity = &capacity.Int64
+    }
+    if latitude.Valid && longitude.Valid {
+        v.Latitude, v.Longitude = &latitude.Float64, &longitude.Float64
+    }
+    return v, nil
+}
+
+// venueLabel is how a venue reads as a concert location.
+func venueLabel(v models.Venue) string {
+    if v.City == "" {
+        return v.Name
+    }
+    return v.Name + ", " + v.City
+}
+
+// resolveVenue checks that the venue c refers to belongs to c's owner, and
+// fills in the location from it when none was given.
+func resolveVenue(q queryExecer, c *models.Concert) error {
+    if c.VenueID == nil {
+        return nil
+    }
+    v, err := scanVenue(q.QueryRow("SELECT "+venueColumns+" FROM venues WHERE id = ? AND user_id = ?", *c.VenueID, c.UserID))
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return errUnknownVenue
+        }
+        return fmt.Errorf("db query error: %w", err)
+    }
+    if c.Location == "" {
+        c.Location = venueLabel(v)
+    }
+    return nil
+}
+
+type venueRequest struct {
+    Name      string   `json:"name"`
+    Address   string   `json:"address"`
+    City      string   `json:"city"`
+    Country   string   `json:"country"`
+    Capacity  *int64   `json:"capacity"`
+    Latitude  *float64 `json:"latitude"`
+    Longitude *float64 `json:"longitude"`
+    // ConcertIDs are linked to the venue, such as the concerts of a
+    // confirmed candidate from ListVenueCandidates.
+    ConcertIDs []int64 `json:"concert_ids"`
+}
+
+// venue validates the request and builds the venue it describes.
+func (req venueRequest) venue(uid int64) (models.Venue, error) {
+    v := models.Venue{
+        Name:      strings.TrimSpace(req.Name),
+        Address:   strings.TrimSpace(req.Address),
+        City:      strings.TrimSpace(req.City),
+        Country:   strings.TrimSpace(req.Country),
+        Capacity:  req.Capacity,
+        Latitude:  req.Latitude,
+        Longitude: req.Longitude,
+        UserID:    uid,
+    }
+    if v.Name == "" {
+        return v, errors.New("name is required")
+    }
+    if v.Capacity != nil && *v.Capacity < 1 {
+        return v, errors.New("capacity must be positive")
+    }
+    if (v.Latitude == nil) != (v.Longitude == nil) {
+        return v, errors.New("latitude and longitude must be given together")
+    }
+    if v.Latitude != nil && (*v.Latitude < -90 || *v.Latitude > 90 || *v.Longitude < -180 || *v.Longitude > 180) {
+        return v, errors.New("latitude must be within ±90 and longitude within ±180")
+    }
+    return v, nil
+}
+
+// linkConcerts points the given concerts of uid at a venue. Any id that is
+// not one of uid's concerts fails with errUnknownConcert.
+func linkConcerts(q execer, uid, venueID int64, ids []int64) (int64, error) {
+    ids = slices.Compact(slices.Sorted(slices.Values(ids)))
+    if len(ids) == 0 {
+        return 0, nil
+    }
+    args := []any{venueID, uid}
+    for _, id := range ids {
+        args = append(args, id)
+    }
+    res, err := q.Exec(
+        "UPDATE concerts SET venue_id = ? WHERE user_id = ? AND id IN (?"+strings.Repeat(", ?", len(ids)-1)+")",
+        args...,
+    )
+    if err != nil {
+        return 0, fmt.Errorf("db update error: %w", err)
+    }
+    n, _ := res.RowsAffected()
+    if n != int64(len(ids)) {
+        return 0, errUnknownConcert
+    }
+    return n, nil
+}
+
+// venueList is the sorting ListVenues offers.
+var venueList = listSpec{Keys: map[string]sortKey{
+    "name":    {Expr: "name COLLATE NOCASE"},
+    "city":    {Expr: "city COLLATE NOCASE"},
+    "country": {Expr: "country COLLATE NOCASE"},
+    "created": {Expr: "id", Numeric: true},
+}}
+
+// ListVenues returns a page of the authenticated user's venues, by name.
+// ?name, ?city and ?country match substrings; paging works as for
+// ListConcerts.
+func ListVenues(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    q := r.URL.Query()
+    page, err := parseListPage(q, venueList, "name")
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    where, args := []string{"user_id = ?"}, []any{uid}
+    for _, f := range []string{"name", "city", "country"} {
+        if v := q.Get(f); v != "" {
+            where, args = append(where, f+` LIKE ? ESCAPE '\'`), append(args, likePattern(v))
+        }
+    }
+    list, next, err := queryPage(page, venueColumns, "venues", where, args, scanVenue)
+    if err != nil {
+        if errors.Is(err, errInvalidCursor) {
+            writeError(w, http.StatusBadRequest, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    setNextPage(w, r, next)
+    writeJSON(w, http.StatusOK, list)
+}
+
+// CreateVenue adds a venue for the authenticated user and links the concerts
+// listed in concert_ids to it.
+func CreateVenue(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    var req venueRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    v, err := req.venue(uid)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+
+    tx, err := db.Get().Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+    err = tx.QueryRow(
+        `INSERT INTO venues (user_id, name, address, city, country, capacity, latitude, longitude)
+         VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+        uid, v.Name, v.Address, v.City, v.Country, v.Capacity, v.Latitude, v.Longitude,
+    ).Scan(&v.ID)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db insert error: %w", err))
+        return
+    }
+    if _, err := linkConcerts(tx, uid, v.ID, req.ConcertIDs); err != nil {
+        if errors.Is(err, errUnknownConcert) {
+            writeError(w, http.StatusBadRequest, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    writeJSON(w, http.StatusCreated, v)
+}
+
+// GetVenue returns one of the authenticated user's venues.
+func GetVenue(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    vid, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("invalid id"))
+        return
+    }
+    v, err := scanVenue(db.Get().QueryRow("SELECT "+venueColumns+" FROM venues WHERE id = ? AND user_id = ?", vid, uid))
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            writeError(w, http.StatusNotFound, sql.ErrNoRows)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    writeJSON(w, http.StatusOK, v)
+}
+
+// ReplaceVenue replaces every field of a venue (PUT). Concerts in
+// concert_ids are linked to it; those already linked stay linked.
+func ReplaceVenue(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    vid, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("invalid id"))
+        return
+    }
+    var req venueRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    v, err := req.venue(uid)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    v.ID = vid
+
+    tx, err := db.Get().Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+    res, err := tx.Exec(
+        `UPDATE venues SET name = ?, address = ?, city = ?, country = ?, capacity = ?, latitude = ?, longitude = ?
+         WHERE id = ? AND user_id = ?`,
+        v.Name, v.Address, v.City, v.Country, v.Capacity, v.Latitude, v.Longitude, vid, uid,
+    )
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db update error: %w", err))
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        writeError(w, http.StatusNotFound, sql.ErrNoRows)
+        return
+    }
+    if _, err := linkConcerts(tx, uid, vid, req.ConcertIDs); err != nil {
+        if errors.Is(err, errUnknownConcert) {
+            writeError(w, http.StatusBadRequest, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    writeJSON(w, http.StatusOK, v)
+}
+
+// DeleteVenue deletes a venue. Its concerts keep their location text and
+// lose the link.
+func DeleteVenue(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    vid, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("invalid id"))
+        return
+    }
+    res, err := db.Get().Exec("DELETE FROM venues WHERE id = ? AND user_id = ?", vid, uid)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db delete error: %w", err))
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        writeError(w, http.StatusNotFound, sql.ErrNoRows)
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{"deleted": vid})
+}
+
+type linkConcertsRequest struct {
+    ConcertIDs []int64 `json:"concert_ids"`
+}
+
+// LinkVenueConcerts links concerts to an existing venue, such as those of a
+// candidate that turned out to be a venue the user already has.
+func LinkVenueConcerts(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    vid, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("invalid id"))
+        return
+    }
+    var req linkConcertsRequest
+    if err := readJSON(r, &req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %w", err))
+        return
+    }
+    if len(req.ConcertIDs) == 0 {
+        writeError(w, http.StatusBadRequest, errors.New("concert_ids is required"))
+        return
+    }
+
+    tx, err := db.Get().Begin()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db transaction error: %w", err))
+        return
+    }
+    defer tx.Rollback()
+    var exists int
+    if err := tx.QueryRow("SELECT COUNT(*) FROM venues WHERE id = ? AND user_id = ?", vid, uid).Scan(&exists); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    if exists == 0 {
+        writeError(w, http.StatusNotFound, sql.ErrNoRows)
+        return
+    }
+    n, err := linkConcerts(tx, uid, vid, req.ConcertIDs)
+    if err != nil {
+        if errors.Is(err, errUnknownConcert) {
+            writeError(w, http.StatusBadRequest, err)
+            return
+        }
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db commit error: %w", err))
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{"linked": n})
+}
+
+// venueCandidate is a suggested venue. VenueID is set when the locations
+// look like a venue the user already has.
+type venueCandidate struct {
+    venues.Candidate
+    VenueID *int64 `json:"venue_id"`
+}
+
+// ListVenueCandidates groups the locations of the authenticated user's
+// concerts that have no venue yet into likely venues, for the user to confirm
+// with CreateVenue or LinkVenueConcerts. Nothing is changed until then.
+func ListVenueCandidates(w http.ResponseWriter, r *http.Request) {
+    uid, ok := UserIDFromContext(r.Context())
+    if !ok {
+        writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+        return
+    }
+    connection := db.Get()
+    rows, err := connection.Query("SELECT id, location FROM concerts WHERE user_id = ? AND venue_id IS NULL ORDER BY id", uid)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    defer rows.Close()
+    var (
+        locations []venues.Location
+        byText    = map[string]int{}
+    )
+    for rows.Next() {
+        var (
+            id   int64
+            text string
+        )
+        if err := rows.Scan(&id, &text); err != nil {
+            writeError(w, http.StatusInternalServerError, fmt.Errorf("db scan error: %w", err))
+            return
+        }
+        i, ok := byText[text]
+        if !ok {
+            i = len(locations)
+            byText[text] = i
+            locations = append(locations, venues.Location{Text: text})
+        }
+        locations[i].ConcertIDs = append(locations[i].ConcertIDs, id)
+    }
+    if err := rows.Err(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    rows.Close()
+
+    rows, err = connection.Query("SELECT "+venueColumns+" FROM venues WHERE user_id = ?", uid)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+    defer rows.Close()
+    var known []models.Venue
+    for rows.Next() {
+        v, err := scanVenue(rows)
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, fmt.Errorf("db scan error: %w", err))
+            return
+        }
+        known = append(known, v)
+    }
+    if err := rows.Err(); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("db query error: %w", err))
+        return
+    }
+
+    list := []venueCandidate{}
+    for _, c := range venues.Cluster(locations) {
+        vc := venueCandidate{Candidate: c}
+        for _, v := range known {
+            if venues.Match(c.Name, v.Name) || venues.Match(c.Name, venueLabel(v)) {
+                vc.VenueID = &v.ID
+                break
+            }
+        }
+        list = append(list, vc)
+    }
+    writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,122 @@
+// Package jwk converts between JSON Web Keys (RFC 7517) and Go public keys.
+package jwk
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Key is a single public JSON Web Key.
+type Key struct {
+    Kty string `json:"kty"`
+    Kid string `json:"kid,omitempty"`
+    Use string `json:"use,omitempty"`
+    Alg string `json:"alg,omitempty"`
+    Crv string `json:"crv,omitempty"`
+    N   string `json:"n,omitempty"`
+    E   string `json:"e,omitempty"`
+    X   string `json:"x,omitempty"`
+    Y   string `json:"y,omitempty"`
+}
+
+// Set is a JWK Set document as served from a jwks_uri.
+type Set struct {
+    Keys []Key `json:"keys"`
+}
+
+// PublicKey decodes k into an *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey.
+func (k Key) PublicKey() (crypto.PublicKey, error) {
+    switch k.Kty {
+    case "RSA":
+        n, err := decodeInt(k.N)
+        if err != nil {
+            return nil, fmt.Errorf("invalid modulus: %w", err)
+        }
+        e, err := decodeInt(k.E)
+        if err != nil {
+            return nil, fmt.Errorf("invalid exponent: %w", err)
+        }
+        if !e.IsInt64() || e.Int64() > 1<<31-1 {
+            return nil, errors.New("exponent too large")
+        }
+        return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+    case "EC":
+        var curve elliptic.Curve
+        switch k.Crv {
+        case "P-256":
+            curve = elliptic.P256()
+        case "P-384":
+            curve = elliptic.P384()
+        case "P-521":
+            curve = elliptic.P521()
+        default:
+            return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+        }
+        x, err := decodeInt(k.X)
+        if err != nil {
+            return nil, fmt.Errorf("invalid x: %w", err)
+        }
+        y, err := decodeInt(k.Y)
+        if err != nil {
+            return nil, fmt.Errorf("invalid y: %w", err)
+        }
+        pub := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+        if !curve.IsOnCurve(x, y) {
+            return nil, errors.New("point is not on curve")
+        }
+        return pub, nil
+    case "OKP":
+        if k.Crv != "Ed25519" {
+            return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+        }
+        x, err := base64.RawURLEncoding.DecodeString(k.X)
+        if err != nil || len(x) != ed25519.PublicKeySize {
+            return nil, errors.New("invalid Ed25519 key")
+        }
+        return ed25519.PublicKey(x), nil
+    default:
+        return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+    }
+}
+
+func decodeInt(s string) (*big.Int, error) {
+    b, err := base64.RawURLEncoding.DecodeString(s)
+    if err != nil {
+        return nil, err
+    }
+    if len(b) == 0 {
+        return nil, errors.New("empty value")
+    }
+    return new(big.Int).SetBytes(b), nil
+}
+
+// FromPublicKey encodes pub as a signing key with the given key id and algorithm.
+func FromPublicKey(kid, alg string, pub crypto.PublicKey) (Key, error) {
+    k := Key{Kid: kid, Use: "sig", Alg: alg}
+    switch p := pub.(type) {
+    case *rsa.PublicKey:
+        k.Kty = "RSA"
+        k.N = base64.RawURLEncoding.EncodeToString(p.N.Bytes())
+        k.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.E)).Bytes())
+    case *ecdsa.PublicKey:
+        k.Kty = "EC"
+        k.Crv = p.Curve.Params().Name
+        size := (p.Curve.Params().BitSize + 7) / 8
+        k.X = base64.RawURLEncoding.EncodeToString(p.X.FillBytes(make([]byte, size)))
+        k.Y = base64.RawURLEncoding.EncodeToString(p.Y.FillBytes(make([]byte, size)))
+    case ed25519.PublicKey:
+        k.Kty = "OKP"
+        k.Crv = "Ed25519"
+        k.X = base64.RawURLEncoding.EncodeToString(p)
+    default:
+        return Key{}, fmt.Errorf("unsupported public key type %T", pub)
+    }
+    return k, nil
+}
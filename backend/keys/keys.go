@@ -0,0 +1,247 @@
+// Package keys holds the asymmetric keys used to sign and verify the JWTs
+// issued by this service.
+//
+// Keys are PEM files in JWT_KEYS_DIR; the key id (kid) is the file name
+// without its extension. Private keys (PKCS#8 Ed25519 or RSA, or PKCS#1 RSA)
+// can sign, public keys (PKIX) only verify. The signing key is the one named
+// by JWT_SIGNING_KEY_ID, or else the private key whose kid sorts last, so
+// naming files by date (e.g. 2025-06-01.pem) rotates naturally. Retired keys
+// stay in the directory as public keys until their tokens have expired.
+package keys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"concerts/jwk"
+)
+
+const minRSABits = 2048
+
+// Key is a single signing or verification key.
+type Key struct {
+    ID     string
+    Method jwt.SigningMethod
+    Public crypto.PublicKey
+    // Private is nil for verification-only keys.
+    Private crypto.Signer
+}
+
+// Keyring is a set of verification keys, one of which is used for signing.
+type Keyring struct {
+    signing *Key
+    byID    map[string]*Key
+}
+
+var (
+    mu      sync.RWMutex
+    current *Keyring
+)
+
+// Init loads the keyring from the environment. Without JWT_KEYS_DIR an
+// ephemeral Ed25519 key is generated, so tokens do not survive a restart.
+func Init() (*Keyring, error) {
+    ring, err := fromEnv()
+    if err != nil {
+        return nil, err
+    }
+    mu.Lock()
+    current = ring
+    mu.Unlock()
+    return ring, nil
+}
+
+// Reload re-reads the key directory, e.g. after a key was added or retired.
+// The previous keyring stays active if loading fails. Without JWT_KEYS_DIR
+// there is nothing to re-read, and the ephemeral key is kept so that issued
+// tokens stay valid.
+func Reload() error {
+    if os.Getenv("JWT_KEYS_DIR") == "" {
+        log.Printf("JWT_KEYS_DIR not set, keeping the ephemeral signing key")
+        return nil
+    }
+    if _, err := Init(); err != nil {
+        return err
+    }
+    log.Printf("signing keys reloaded")
+    return nil
+}
+
+// Get returns the active keyring. Panics if Init was not called.
+func Get() *Keyring {
+    mu.RLock()
+    defer mu.RUnlock()
+    if current == nil {
+        panic("keys not initialized: call keys.Init() first")
+    }
+    return current
+}
+
+func fromEnv() (*Keyring, error) {
+    dir := os.Getenv("JWT_KEYS_DIR")
+    if dir == "" {
+        log.Printf("JWT_KEYS_DIR not set, using an ephemeral signing key")
+        return Ephemeral()
+    }
+    return LoadDir(dir, os.Getenv("JWT_SIGNING_KEY_ID"))
+}
+
+// Ephemeral returns a keyring with a freshly generated Ed25519 key.
+func Ephemeral() (*Keyring, error) {
+    pub, priv, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    k := &Key{ID: "ephemeral", Method: jwt.SigningMethodEdDSA, Public: pub, Private: priv}
+    return &Keyring{signing: k, byID: map[string]*Key{k.ID: k}}, nil
+}
+
+// LoadDir reads every *.pem file in dir. signingID selects the signing key;
+// when empty the private key with the greatest id is used.
+func LoadDir(dir, signingID string) (*Keyring, error) {
+    paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+    if err != nil {
+        return nil, err
+    }
+    ring := &Keyring{byID: map[string]*Key{}}
+    for _, path := range paths {
+        k, err := loadFile(path)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", path, err)
+        }
+        ring.byID[k.ID] = k
+    }
+
+    if signingID == "" {
+        ids := make([]string, 0, len(ring.byID))
+        for id, k := range ring.byID {
+            if k.Private != nil {
+                ids = append(ids, id)
+            }
+        }
+        sort.Strings(ids)
+        if len(ids) > 0 {
+            signingID = ids[len(ids)-1]
+        }
+    }
+    k, ok := ring.byID[signingID]
+    if !ok || k.Private == nil {
+        return nil, fmt.Errorf("no private signing key %q in %s", signingID, dir)
+    }
+    ring.signing = k
+    return ring, nil
+}
+
+func loadFile(path string) (*Key, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, errors.New("no PEM block found")
+    }
+    id := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+    var parsed any
+    switch block.Type {
+    case "PRIVATE KEY":
+        parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+    case "RSA PRIVATE KEY":
+        parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+    case "PUBLIC KEY":
+        parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+    default:
+        return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    switch key := parsed.(type) {
+    case ed25519.PrivateKey:
+        return &Key{ID: id, Method: jwt.SigningMethodEdDSA, Public: key.Public(), Private: key}, nil
+    case ed25519.PublicKey:
+        return &Key{ID: id, Method: jwt.SigningMethodEdDSA, Public: key}, nil
+    case *rsa.PrivateKey:
+        if key.N.BitLen() < minRSABits {
+            return nil, fmt.Errorf("RSA key must be at least %d bits", minRSABits)
+        }
+        return &Key{ID: id, Method: jwt.SigningMethodRS256, Public: key.Public(), Private: key}, nil
+    case *rsa.PublicKey:
+        if key.N.BitLen() < minRSABits {
+            return nil, fmt.Errorf("RSA key must be at least %d bits", minRSABits)
+        }
+        return &Key{ID: id, Method: jwt.SigningMethodRS256, Public: key}, nil
+    default:
+        return nil, fmt.Errorf("unsupported key type %T", parsed)
+    }
+}
+
+// Sign signs claims with the signing key and records its id in the kid header.
+func (r *Keyring) Sign(claims jwt.Claims) (string, error) {
+    token := jwt.NewWithClaims(r.signing.Method, claims)
+    token.Header["kid"] = r.signing.ID
+    return token.SignedString(r.signing.Private)
+}
+
+// Keyfunc resolves the verification key for a token from its kid header. It
+// rejects tokens whose algorithm does not match the key.
+func (r *Keyring) Keyfunc(t *jwt.Token) (interface{}, error) {
+    kid, _ := t.Header["kid"].(string)
+    k, ok := r.byID[kid]
+    if !ok {
+        return nil, fmt.Errorf("unknown key id %q", kid)
+    }
+    if t.Method.Alg() != k.Method.Alg() {
+        return nil, errors.New("unexpected signing method")
+    }
+    return k.Public, nil
+}
+
+// Methods lists the algorithms of all keys in the ring.
+func (r *Keyring) Methods() []string {
+    seen := map[string]bool{}
+    var methods []string
+    for _, k := range r.byID {
+        if alg := k.Method.Alg(); !seen[alg] {
+            seen[alg] = true
+            methods = append(methods, alg)
+        }
+    }
+    sort.Strings(methods)
+    return methods
+}
+
+// JWKS returns the public keys as a JWK Set.
+func (r *Keyring) JWKS() (jwk.Set, error) {
+    ids := make([]string, 0, len(r.byID))
+    for id := range r.byID {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    set := jwk.Set{Keys: []jwk.Key{}}
+    for _, id := range ids {
+        k := r.byID[id]
+        encoded, err := jwk.FromPublicKey(k.ID, k.Method.Alg(), k.Public)
+        if err != nil {
+            return jwk.Set{}, err
+        }
+        set.Keys = append(set.Keys, encoded)
+    }
+    return set, nil
+}
@@ -0,0 +1,221 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writePEM writes one PEM block to dir/id.pem.
+func writePEM(t *testing.T, dir, id, blockType string, der []byte) {
+    t.Helper()
+    data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+    if err := os.WriteFile(filepath.Join(dir, id+".pem"), data, 0o600); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func writeEd25519(t *testing.T, dir, id string) ed25519.PrivateKey {
+    t.Helper()
+    _, priv, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    der, err := x509.MarshalPKCS8PrivateKey(priv)
+    if err != nil {
+        t.Fatal(err)
+    }
+    writePEM(t, dir, id, "PRIVATE KEY", der)
+    return priv
+}
+
+func writePublic(t *testing.T, dir, id string, pub crypto.PublicKey) {
+    t.Helper()
+    der, err := x509.MarshalPKIXPublicKey(pub)
+    if err != nil {
+        t.Fatal(err)
+    }
+    writePEM(t, dir, id, "PUBLIC KEY", der)
+}
+
+func writeRSA(t *testing.T, dir, id string, bits int) *rsa.PrivateKey {
+    t.Helper()
+    priv, err := rsa.GenerateKey(rand.Reader, bits)
+    if err != nil {
+        t.Fatal(err)
+    }
+    writePEM(t, dir, id, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(priv))
+    return priv
+}
+
+func testClaims() jwt.Claims {
+    return jwt.RegisteredClaims{Subject: "1", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))}
+}
+
+func TestReloadKeepsEphemeralKey(t *testing.T) {
+    t.Setenv("JWT_KEYS_DIR", "")
+    ring, err := Init()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := Reload(); err != nil {
+        t.Fatal(err)
+    }
+    if Get() != ring {
+        t.Fatal("Reload replaced the ephemeral keyring")
+    }
+}
+
+func TestLoadDirSelectsSigningKey(t *testing.T) {
+    dir := t.TempDir()
+    writeEd25519(t, dir, "2025-01-01")
+    writeRSA(t, dir, "2025-06-01", 2048)
+    // A retired key kept for verification sorts last but cannot sign.
+    retired := writeEd25519(t, t.TempDir(), "retired")
+    writePublic(t, dir, "2026-01-01", retired.Public())
+
+    for signingID, want := range map[string]string{"": "2025-06-01", "2025-01-01": "2025-01-01"} {
+        ring, err := LoadDir(dir, signingID)
+        if err != nil {
+            t.Fatal(err)
+        }
+        signed, err := ring.Sign(testClaims())
+        if err != nil {
+            t.Fatal(err)
+        }
+        token, err := jwt.Parse(signed, ring.Keyfunc, jwt.WithValidMethods(ring.Methods()))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if kid := token.Header["kid"]; kid != want {
+            t.Errorf("signing id %q: signed with %v, want %s", signingID, kid, want)
+        }
+    }
+    if got, want := mustLoad(t, dir).Methods(), []string{"EdDSA", "RS256"}; !slices.Equal(got, want) {
+        t.Errorf("Methods() = %v, want %v", got, want)
+    }
+
+    for _, signingID := range []string{"2026-01-01", "missing"} {
+        if _, err := LoadDir(dir, signingID); err == nil {
+            t.Errorf("signing id %q accepted", signingID)
+        }
+    }
+    if _, err := LoadDir(t.TempDir(), ""); err == nil {
+        t.Error("empty directory accepted")
+    }
+}
+
+func mustLoad(t *testing.T, dir string) *Keyring {
+    t.Helper()
+    ring, err := LoadDir(dir, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    return ring
+}
+
+func TestLoadDirRefusesShortRSAKeys(t *testing.T) {
+    dir := t.TempDir()
+    writeRSA(t, dir, "short", 1024)
+    if _, err := LoadDir(dir, ""); err == nil || !strings.Contains(err.Error(), "2048") {
+        t.Fatalf("1024-bit private key: err = %v", err)
+    }
+
+    dir = t.TempDir()
+    writeEd25519(t, dir, "signing")
+    short, err := rsa.GenerateKey(rand.Reader, 1024)
+    if err != nil {
+        t.Fatal(err)
+    }
+    writePublic(t, dir, "short", short.Public())
+    if _, err := LoadDir(dir, ""); err == nil || !strings.Contains(err.Error(), "2048") {
+        t.Fatalf("1024-bit public key: err = %v", err)
+    }
+}
+
+func TestKeyfuncRejectsMismatches(t *testing.T) {
+    dir := t.TempDir()
+    ed := writeEd25519(t, dir, "ed")
+    rsaKey := writeRSA(t, dir, "rsa", 2048)
+    ring := mustLoad(t, dir)
+    parse := func(method jwt.SigningMethod, kid string, key crypto.Signer) error {
+        token := jwt.NewWithClaims(method, testClaims())
+        if kid != "" {
+            token.Header["kid"] = kid
+        }
+        signed, err := token.SignedString(key)
+        if err != nil {
+            t.Fatal(err)
+        }
+        _, err = jwt.Parse(signed, ring.Keyfunc, jwt.WithValidMethods(ring.Methods()))
+        return err
+    }
+
+    if err := parse(jwt.SigningMethodEdDSA, "ed", ed); err != nil {
+        t.Fatalf("valid token rejected: %v", err)
+    }
+    if err := parse(jwt.SigningMethodRS256, "rsa", rsaKey); err != nil {
+        t.Fatalf("valid token rejected: %v", err)
+    }
+    // An RS256 token naming the Ed25519 key, and the other way round.
+    if err := parse(jwt.SigningMethodRS256, "ed", rsaKey); err == nil {
+        t.Error("RS256 token accepted for an EdDSA key")
+    }
+    if err := parse(jwt.SigningMethodEdDSA, "rsa", ed); err == nil {
+        t.Error("EdDSA token accepted for an RS256 key")
+    }
+    if err := parse(jwt.SigningMethodEdDSA, "unknown", ed); err == nil {
+        t.Error("token with an unknown kid accepted")
+    }
+    if err := parse(jwt.SigningMethodEdDSA, "", ed); err == nil {
+        t.Error("token without a kid accepted")
+    }
+}
+
+func TestJWKS(t *testing.T) {
+    dir := t.TempDir()
+    ed := writeEd25519(t, dir, "b-ed")
+    rsaKey := writeRSA(t, dir, "a-rsa", 2048)
+    retired := writeEd25519(t, t.TempDir(), "retired")
+    writePublic(t, dir, "c-retired", retired.Public())
+
+    set, err := mustLoad(t, dir).JWKS()
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := []struct {
+        kid, alg, kty string
+        pub           crypto.PublicKey
+    }{
+        {"a-rsa", "RS256", "RSA", rsaKey.Public()},
+        {"b-ed", "EdDSA", "OKP", ed.Public()},
+        {"c-retired", "EdDSA", "OKP", retired.Public()},
+    }
+    if len(set.Keys) != len(want) {
+        t.Fatalf("JWKS has %d keys, want %d", len(set.Keys), len(want))
+    }
+    for i, w := range want {
+        k := set.Keys[i]
+        if k.Kid != w.kid || k.Alg != w.alg || k.Kty != w.kty {
+            t.Errorf("key %d = %s/%s/%s, want %s/%s/%s", i, k.Kid, k.Alg, k.Kty, w.kid, w.alg, w.kty)
+        }
+        pub, err := k.PublicKey()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !pub.(interface{ Equal(crypto.PublicKey) bool }).Equal(w.pub) {
+            t.Errorf("key %s does not round-trip", k.Kid)
+        }
+    }
+}
@@ -0,0 +1,37 @@
+package mailer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileMailer writes each message as an .eml file into Dir instead of sending
+// it. Intended for local development and tests.
+type FileMailer struct {
+    Dir  string
+    From string
+}
+
+// Send writes msg to the outbox directory.
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+        return fmt.Errorf("failed to create outbox: %w", err)
+    }
+    suffix := make([]byte, 4)
+    if _, err := rand.Read(suffix); err != nil {
+        return err
+    }
+    name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+    if err := os.WriteFile(filepath.Join(m.Dir, name), format(m.From, msg), 0o600); err != nil {
+        return fmt.Errorf("failed to write message: %w", err)
+    }
+    return nil
+}
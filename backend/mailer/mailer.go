@@ -0,0 +1,99 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Message is a plain-text email.
+type Message struct {
+    To      string
+    Subject string
+    Body    string
+}
+
+// Mailer delivers outgoing email.
+type Mailer interface {
+    Send(ctx context.Context, msg Message) error
+}
+
+var (
+    current Mailer
+    once    sync.Once
+)
+
+// Init configures the process-wide mailer from the environment.
+//
+// MAILER selects the implementation: "smtp" or "file" (the default, which
+// writes messages to MAIL_OUTBOX_DIR for local development and tests).
+func Init() (Mailer, error) {
+    var initErr error
+    once.Do(func() {
+        from := os.Getenv("MAIL_FROM")
+        if from == "" {
+            from = "no-reply@localhost"
+        }
+        switch kind := os.Getenv("MAILER"); kind {
+        case "smtp":
+            port := 587
+            if p := os.Getenv("SMTP_PORT"); p != "" {
+                n, err := strconv.Atoi(p)
+                if err != nil {
+                    initErr = fmt.Errorf("invalid SMTP_PORT: %w", err)
+                    return
+                }
+                port = n
+            }
+            host := os.Getenv("SMTP_HOST")
+            if host == "" {
+                initErr = fmt.Errorf("SMTP_HOST is required when MAILER=smtp")
+                return
+            }
+            current = &SMTPMailer{
+                Host:     host,
+                Port:     port,
+                Username: os.Getenv("SMTP_USERNAME"),
+                Password: os.Getenv("SMTP_PASSWORD"),
+                From:     from,
+            }
+        case "", "file":
+            dir := os.Getenv("MAIL_OUTBOX_DIR")
+            if dir == "" {
+                dir = filepath.Join("data", "outbox")
+            }
+            current = &FileMailer{Dir: dir, From: from}
+        default:
+            initErr = fmt.Errorf("unknown MAILER %q", kind)
+        }
+    })
+    return current, initErr
+}
+
+// Get returns the configured Mailer. Panics if Init was not called.
+func Get() Mailer {
+    if current == nil {
+        panic("mailer not initialized: call mailer.Init() first")
+    }
+    return current
+}
+
+// format renders msg as an RFC 5322 message.
+func format(from string, msg Message) []byte {
+    var buf bytes.Buffer
+    fmt.Fprintf(&buf, "From: %s\r\n", from)
+    fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+    fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+    fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+    buf.WriteString("MIME-Version: 1.0\r\n")
+    buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+    buf.WriteString("\r\n")
+    buf.WriteString(msg.Body)
+    return buf.Bytes()
+}
@@ -0,0 +1,35 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+)
+
+// SMTPMailer sends email through an SMTP relay, upgrading to TLS via
+// STARTTLS when the server offers it.
+type SMTPMailer struct {
+    Host     string
+    Port     int
+    Username string
+    Password string
+    From     string
+}
+
+// Send delivers msg to the configured relay.
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    var auth smtp.Auth
+    if m.Username != "" {
+        auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+    }
+    addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+    if err := smtp.SendMail(addr, auth, m.From, []string{msg.To}, format(m.From, msg)); err != nil {
+        return fmt.Errorf("smtp send failed: %w", err)
+    }
+    return nil
+}
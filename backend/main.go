@@ -4,18 +4,64 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
+	// Embedded zone database, so user time zones validate on minimal images.
+	_ "time/tzdata"
 
 	"github.com/gorilla/mux"
 
 	"concerts/db"
 	"concerts/handlers"
+	"concerts/keys"
+	"concerts/mailer"
+	"concerts/oidc"
+	"concerts/passwords"
 )
 
 func main() {
     if _, err := db.Init(); err != nil {
         log.Fatalf("db init failed: %v", err)
     }
+    if _, err := keys.Init(); err != nil {
+        log.Fatalf("signing keys init failed: %v", err)
+    }
+    go reloadKeysOnSIGHUP()
+    if _, err := passwords.Init(); err != nil {
+        log.Fatalf("password hasher init failed: %v", err)
+    }
+    policy, err := passwords.InitPolicy()
+    if err != nil {
+        log.Fatalf("password policy init failed: %v", err)
+    }
+    if policy.Breached != nil {
+        log.Printf("loaded %d breached password hashes", policy.Breached.Len())
+    }
+    if _, err := mailer.Init(); err != nil {
+        log.Fatalf("mailer init failed: %v", err)
+    }
+    if err := handlers.EncryptTOTPSecrets(); err != nil {
+        log.Fatalf("TOTP secret encryption failed: %v", err)
+    }
+    mode, err := handlers.RegistrationMode()
+    if err != nil {
+        log.Fatalf("registration config failed: %v", err)
+    }
+    log.Printf("registration mode: %s", mode)
+    providers, err := oidc.ConfigsFromEnv()
+    if err != nil {
+        log.Fatalf("oidc config failed: %v", err)
+    }
+    for _, cfg := range providers {
+        handlers.RegisterOIDCProvider(oidc.NewProvider(cfg, nil))
+    }
+    if admin := os.Getenv("ADMIN_USERNAME"); admin != "" {
+        if err := handlers.BootstrapAdmin(admin); err != nil {
+            log.Fatalf("admin bootstrap failed: %v", err)
+        }
+    }
 
     r := mux.NewRouter()
     r.Use(corsMiddleware)
@@ -25,32 +71,122 @@ func main() {
         w.WriteHeader(http.StatusNoContent)
     }).Methods(http.MethodOptions)
 
-    // Health
+    // Health and discovery
+    r.HandleFunc("/.well-known/jwks.json", handlers.JWKS).Methods(http.MethodGet)
     r.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }).Methods(http.MethodGet)
 
     // Auth routes
     r.HandleFunc("/register", handlers.Register).Methods(http.MethodPost)
+    r.HandleFunc("/register/verify", handlers.VerifyEmail).Methods(http.MethodPost)
+    r.HandleFunc("/register/verify/resend", handlers.ResendVerification).Methods(http.MethodPost)
     r.HandleFunc("/login", handlers.Login).Methods(http.MethodPost)
+    r.HandleFunc("/login/2fa", handlers.LoginTwoFactor).Methods(http.MethodPost)
+    r.HandleFunc("/login/unlock", handlers.UnlockAccount).Methods(http.MethodPost)
+    r.HandleFunc("/login/magic", handlers.RequestMagicLink).Methods(http.MethodPost)
+    r.HandleFunc("/login/magic/redeem", handlers.RedeemMagicLink).Methods(http.MethodPost)
+    r.HandleFunc("/login/passkey/begin", handlers.BeginPasskeyLogin).Methods(http.MethodPost)
+    r.HandleFunc("/login/passkey/finish", handlers.FinishPasskeyLogin).Methods(http.MethodPost)
+    r.HandleFunc("/token/refresh", handlers.RefreshToken).Methods(http.MethodPost)
+    r.HandleFunc("/password/forgot", handlers.ForgotPassword).Methods(http.MethodPost)
+    r.HandleFunc("/password/reset", handlers.ResetPassword).Methods(http.MethodPost)
+    r.HandleFunc("/oidc/providers", handlers.ListOIDCProviders).Methods(http.MethodGet)
+    r.HandleFunc("/oidc/{provider}/login", handlers.OIDCLogin).Methods(http.MethodGet)
+    r.HandleFunc("/oidc/{provider}/callback", handlers.OIDCCallback).Methods(http.MethodGet)
+
+    // Account routes (protected, interactive sessions only)
+    account := r.NewRoute().Subrouter()
+    account.Use(handlers.RequireAuth, handlers.RequireScope(handlers.ScopeAccount))
+    account.HandleFunc("/me", handlers.GetMe).Methods(http.MethodGet)
+    account.HandleFunc("/me", handlers.UpdateMe).Methods(http.MethodPatch)
+    account.HandleFunc("/me", handlers.DeleteMe).Methods(http.MethodDelete)
+    account.HandleFunc("/me/export", handlers.ExportMe).Methods(http.MethodGet)
+    account.HandleFunc("/me/sessions", handlers.ListSessions).Methods(http.MethodGet)
+    account.HandleFunc("/me/sessions/{id}", handlers.RevokeSession).Methods(http.MethodDelete)
+    account.HandleFunc("/me/security-events", handlers.ListMySecurityEvents).Methods(http.MethodGet)
+    account.HandleFunc("/me/passkeys", handlers.ListPasskeys).Methods(http.MethodGet)
+    account.HandleFunc("/me/passkeys/register/begin", handlers.BeginPasskeyRegistration).Methods(http.MethodPost)
+    account.HandleFunc("/me/passkeys/register/finish", handlers.FinishPasskeyRegistration).Methods(http.MethodPost)
+    account.HandleFunc("/me/passkeys/{id}", handlers.DeletePasskey).Methods(http.MethodDelete)
+    account.HandleFunc("/logout", handlers.Logout).Methods(http.MethodPost)
+    account.HandleFunc("/logout/all", handlers.LogoutAll).Methods(http.MethodPost)
+    account.HandleFunc("/password/change", handlers.ChangePassword).Methods(http.MethodPost)
+    account.HandleFunc("/2fa/totp/setup", handlers.SetupTOTP).Methods(http.MethodPost)
+    account.HandleFunc("/2fa/totp/enable", handlers.EnableTOTP).Methods(http.MethodPost)
+    account.HandleFunc("/2fa/totp/disable", handlers.DisableTOTP).Methods(http.MethodPost)
+    account.HandleFunc("/2fa/recovery-codes", handlers.RegenerateRecoveryCodes).Methods(http.MethodPost)
+    account.HandleFunc("/tokens", handlers.ListAPITokens).Methods(http.MethodGet)
+    account.HandleFunc("/tokens", handlers.CreateAPIToken).Methods(http.MethodPost)
+    account.HandleFunc("/tokens/{id}", handlers.RevokeAPIToken).Methods(http.MethodDelete)
+    account.HandleFunc("/invites", handlers.ListInvites).Methods(http.MethodGet)
+    account.HandleFunc("/invites", handlers.CreateInvite).Methods(http.MethodPost)
+    account.HandleFunc("/invites/{id}", handlers.RevokeInvite).Methods(http.MethodDelete)
+
+    // Admin routes (protected, admins only)
+    admin := r.PathPrefix("/admin").Subrouter()
+    admin.Use(handlers.RequireAuth, handlers.RequireScope(handlers.ScopeAccount), handlers.RequireRole(handlers.RoleAdmin))
+    admin.HandleFunc("/users", handlers.AdminListUsers).Methods(http.MethodGet)
+    admin.HandleFunc("/auth-events", handlers.AdminListAuthEvents).Methods(http.MethodGet)
+    admin.HandleFunc("/users/{id}", handlers.AdminDeleteUser).Methods(http.MethodDelete)
+    admin.HandleFunc("/users/{id}/disable", handlers.AdminDisableUser).Methods(http.MethodPost)
+    admin.HandleFunc("/users/{id}/enable", handlers.AdminEnableUser).Methods(http.MethodPost)
+    admin.HandleFunc("/users/{id}/role", handlers.AdminSetUserRole).Methods(http.MethodPut)
+    admin.HandleFunc("/users/{id}/unlock", handlers.AdminUnlockUser).Methods(http.MethodPost)
+
+    // Lineups (protected)
+    lineup := r.PathPrefix("/concerts/{concertId}/lineup").Subrouter()
+    lineup.Use(handlers.RequireAuth)
+    lineup.Handle("", handlers.Scoped(handlers.ScopeConcertsRead, handlers.ListLineup)).Methods(http.MethodGet)
+    lineup.Handle("", handlers.Scoped(handlers.ScopeConcertsWrite, handlers.AddLineupEntry)).Methods(http.MethodPost)
+    lineup.Handle("/order", handlers.Scoped(handlers.ScopeConcertsWrite, handlers.UpdateLineupOrder)).Methods(http.MethodPut)
+    lineup.Handle("/{entryId}", handlers.Scoped(handlers.ScopeConcertsWrite, handlers.UpdateLineupEntry)).Methods(http.MethodPatch)
+    lineup.Handle("/{entryId}", handlers.Scoped(handlers.ScopeConcertsWrite, handlers.DeleteLineupEntry)).Methods(http.MethodDelete)
+
+    // Artists (protected)
+    artists := r.PathPrefix("/artists").Subrouter()
+    artists.Use(handlers.RequireAuth)
+    artists.Handle("", handlers.Scoped(handlers.ScopeConcertsRead, handlers.ListArtists)).Methods(http.MethodGet)
+    artists.Handle("", handlers.Scoped(handlers.ScopeConcertsWrite, handlers.CreateArtist)).Methods(http.MethodPost)
+    artists.Handle("/{id}", handlers.Scoped(handlers.ScopeConcertsRead, handlers.GetArtist)).Methods(http.MethodGet)
+    artists.Handle("/{id}", handlers.Scoped(handlers.ScopeConcertsWrite, handlers.RenameArtist)).Methods(http.MethodPut)
+    artists.Handle("/{id}", handlers.Scoped(handlers.ScopeConcertsWrite, handlers.DeleteArtist)).Methods(http.MethodDelete)
+
+    // Venues (protected)
+    venues := r.PathPrefix("/venues").Subrouter()
+    venues.Use(handlers.RequireAuth)
+    venues.Handle("", handlers.Scoped(handlers.ScopeConcertsRead, handlers.ListVenues)).Methods(http.MethodGet)
+    venues.Handle("", handlers.Scoped(handlers.ScopeConcertsWrite, handlers.CreateVenue)).Methods(http.MethodPost)
+    venues.Handle("/candidates", handlers.Scoped(handlers.ScopeConcertsRead, handlers.ListVenueCandidates)).Methods(http.MethodGet)
+    venues.Handle("/{id}", handlers.Scoped(handlers.ScopeConcertsRead, handlers.GetVenue)).Methods(http.MethodGet)
+    venues.Handle("/{id}", handlers.Scoped(handlers.ScopeConcertsWrite, handlers.ReplaceVenue)).Methods(http.MethodPut)
+    venues.Handle("/{id}", handlers.Scoped(handlers.ScopeConcertsWrite, handlers.DeleteVenue)).Methods(http.MethodDelete)
+    venues.Handle("/{id}/concerts", handlers.Scoped(handlers.ScopeConcertsWrite, handlers.LinkVenueConcerts)).Methods(http.MethodPost)
+
+    // Search (protected)
+    search := r.PathPrefix("/search").Subrouter()
+    search.Use(handlers.RequireAuth)
+    search.Handle("", handlers.Scoped(handlers.ScopeConcertsRead, handlers.Search)).Methods(http.MethodGet)
 
     // Concerts (protected)
     concerts := r.PathPrefix("/concerts").Subrouter()
     concerts.Use(handlers.RequireAuth)
-    concerts.HandleFunc("", handlers.ListConcerts).Methods(http.MethodGet)
-    concerts.HandleFunc("/", handlers.ListConcerts).Methods(http.MethodGet)
-    concerts.HandleFunc("", handlers.CreateConcert).Methods(http.MethodPost)
-    concerts.HandleFunc("/", handlers.CreateConcert).Methods(http.MethodPost)
-    concerts.HandleFunc("/{id}", handlers.GetConcert).Methods(http.MethodGet)
-    concerts.HandleFunc("/{id}", handlers.DeleteConcert).Methods(http.MethodDelete)
+    concerts.Handle("", handlers.Scoped(handlers.ScopeConcertsRead, handlers.ListConcerts)).Methods(http.MethodGet)
+    concerts.Handle("/", handlers.Scoped(handlers.ScopeConcertsRead, handlers.ListConcerts)).Methods(http.MethodGet)
+    concerts.Handle("", handlers.Scoped(handlers.ScopeConcertsWrite, handlers.CreateConcert)).Methods(http.MethodPost)
+    concerts.Handle("/", handlers.Scoped(handlers.ScopeConcertsWrite, handlers.CreateConcert)).Methods(http.MethodPost)
+    concerts.Handle("/{id}", handlers.Scoped(handlers.ScopeConcertsRead, handlers.GetConcert)).Methods(http.MethodGet)
+    concerts.Handle("/{id}", handlers.Scoped(handlers.ScopeConcertsWrite, handlers.ReplaceConcert)).Methods(http.MethodPut)
+    concerts.Handle("/{id}", handlers.Scoped(handlers.ScopeConcertsWrite, handlers.UpdateConcert)).Methods(http.MethodPatch)
+    concerts.Handle("/{id}", handlers.Scoped(handlers.ScopeConcertsWrite, handlers.DeleteConcert)).Methods(http.MethodDelete)
 
     // Songs (protected)
     songs := r.PathPrefix("/concerts/{concertId}/songs").Subrouter()
     songs.Use(handlers.RequireAuth)
-    songs.HandleFunc("", handlers.ListSongs).Methods(http.MethodGet)
-    songs.HandleFunc("/", handlers.ListSongs).Methods(http.MethodGet)
-    songs.HandleFunc("", handlers.CreateSong).Methods(http.MethodPost)
-    songs.HandleFunc("/", handlers.CreateSong).Methods(http.MethodPost)
-    songs.HandleFunc("/{songId}", handlers.DeleteSong).Methods(http.MethodDelete)
-    songs.HandleFunc("/order", handlers.UpdateSongOrder).Methods(http.MethodPut)
+    songs.Handle("", handlers.Scoped(handlers.ScopeSongsRead, handlers.ListSongs)).Methods(http.MethodGet)
+    songs.Handle("/", handlers.Scoped(handlers.ScopeSongsRead, handlers.ListSongs)).Methods(http.MethodGet)
+    songs.Handle("", handlers.Scoped(handlers.ScopeSongsWrite, handlers.CreateSong)).Methods(http.MethodPost)
+    songs.Handle("/", handlers.Scoped(handlers.ScopeSongsWrite, handlers.CreateSong)).Methods(http.MethodPost)
+    songs.Handle("/{songId}", handlers.Scoped(handlers.ScopeSongsWrite, handlers.DeleteSong)).Methods(http.MethodDelete)
+    songs.Handle("/order", handlers.Scoped(handlers.ScopeSongsWrite, handlers.UpdateSongOrder)).Methods(http.MethodPut)
 
     srv := &http.Server{
         Addr:              getAddr(),
@@ -64,6 +200,18 @@ func main() {
     log.Fatal(srv.ListenAndServe())
 }
 
+// reloadKeysOnSIGHUP re-reads JWT_KEYS_DIR whenever the process receives
+// SIGHUP, so keys can be rotated without a restart.
+func reloadKeysOnSIGHUP() {
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, syscall.SIGHUP)
+    for range sig {
+        if err := keys.Reload(); err != nil {
+            log.Printf("signing keys reload failed: %v", err)
+        }
+    }
+}
+
 func getAddr() string {
     if p := os.Getenv("PORT"); p != "" {
         return ":" + p
@@ -71,11 +219,39 @@ func getAddr() string {
     return ":8080"
 }
 
+// getAllowedOrigins returns the origins allowed to make credentialed requests,
+// from the comma separated CORS_ALLOWED_ORIGINS.
+func getAllowedOrigins() map[string]bool {
+    origins := map[string]bool{}
+    list := os.Getenv("CORS_ALLOWED_ORIGINS")
+    if list == "" {
+        list = "http://localhost:4200"
+    }
+    for _, o := range strings.Split(list, ",") {
+        if o = strings.TrimSpace(o); o != "" {
+            origins[o] = true
+        }
+    }
+    return origins
+}
+
 func corsMiddleware(next http.Handler) http.Handler {
+    allowed := getAllowedOrigins()
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        w.Header().Set("Access-Control-Allow-Origin", "*")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+        // Cookies are only sent cross-origin with credentials, which rules out
+        // the "*" wildcard: echo the origin back if it is allowed. Any other
+        // origin may still call the API with bearer tokens, but without
+        // credentials.
+        w.Header().Add("Vary", "Origin")
+        if origin := r.Header.Get("Origin"); allowed[origin] {
+            w.Header().Set("Access-Control-Allow-Origin", origin)
+            w.Header().Set("Access-Control-Allow-Credentials", "true")
+        } else {
+            w.Header().Set("Access-Control-Allow-Origin", "*")
+        }
+        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-CSRF-Token")
+        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+        w.Header().Set("Access-Control-Expose-Headers", "Retry-After, Link, X-Next-Cursor")
         if r.Method == http.MethodOptions {
             w.WriteHeader(http.StatusNoContent)
             return
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+    t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example.com")
+    handler := corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    for _, tc := range []struct {
+        origin, allowOrigin, allowCredentials string
+    }{
+        {"https://app.example.com", "https://app.example.com", "true"},
+        {"https://other.example.com", "*", ""},
+        {"", "*", ""},
+    } {
+        r := httptest.NewRequest(http.MethodOptions, "/concerts", nil)
+        if tc.origin != "" {
+            r.Header.Set("Origin", tc.origin)
+        }
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        if got := w.Header().Get("Access-Control-Allow-Origin"); got != tc.allowOrigin {
+            t.Errorf("origin %q: Access-Control-Allow-Origin = %q, want %q", tc.origin, got, tc.allowOrigin)
+        }
+        if got := w.Header().Get("Access-Control-Allow-Credentials"); got != tc.allowCredentials {
+            t.Errorf("origin %q: Access-Control-Allow-Credentials = %q, want %q", tc.origin, got, tc.allowCredentials)
+        }
+    }
+}
@@ -0,0 +1,13 @@
+package models
+
+// APIToken is a personal access token. The secret itself is only returned
+// once, at creation time.
+type APIToken struct {
+    ID         int64    `json:"id"`
+    Name       string   `json:"name"`
+    Prefix     string   `json:"prefix"`
+    Scopes     []string `json:"scopes"`
+    CreatedAt  int64    `json:"created_at"`
+    LastUsedAt *int64   `json:"last_used_at"`
+    ExpiresAt  *int64   `json:"expires_at"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// Artist is a band or performer in a user's concert lineups.
+type Artist struct {
+    ID     int64  `json:"id"`
+    Name   string `json:"name"`
+    UserID int64  `json:"user_id"`
+}
+
+// LineupEntry is one act of a concert. Position is the running order, first
+// act first; set times are shown in the concert's time zone.
+type LineupEntry struct {
+    ID          int64      `json:"id"`
+    ConcertID   int64      `json:"concert_id"`
+    ArtistID    int64      `json:"artist_id"`
+    ArtistName  string     `json:"artist_name"`
+    Role        string     `json:"role"`
+    Position    int        `json:"position"`
+    SetStartsAt *time.Time `json:"set_starts_at"`
+    SetEndsAt   *time.Time `json:"set_ends_at"`
+}
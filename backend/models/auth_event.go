@@ -0,0 +1,17 @@
+package models
+
+// AuthEvent is an entry of the append-only security audit log. UserID is the
+// account concerned, if known; ActorID is set when someone else, such as an
+// admin, caused the event.
+type AuthEvent struct {
+    ID        int64  `json:"id"`
+    CreatedAt int64  `json:"created_at"`
+    Event     string `json:"event"`
+    Outcome   string `json:"outcome"`
+    UserID    *int64 `json:"user_id"`
+    Username  string `json:"username"`
+    ActorID   *int64 `json:"actor_id"`
+    IP        string `json:"ip"`
+    UserAgent string `json:"user_agent"`
+    Detail    string `json:"detail"`
+}
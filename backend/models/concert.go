@@ -1,12 +1,22 @@
 package models
 
+import "time"
+
 // Concert represents a concert record owned by a user.
 type Concert struct {
-    ID       int64  `json:"id"`
-    Title    string `json:"title"`
+    ID    int64  `json:"id"`
+    Title string `json:"title"`
+    // Date is the local calendar date of StartsAt (YYYY-MM-DD). Concerts
+    // created before start times existed keep their original free-form date.
     Date     string `json:"date"`
     Location string `json:"location"`
     UserID   int64  `json:"user_id"`
+    // StartsAt and EndsAt are shown in the concert's time zone. StartsAt is
+    // only missing on old concerts whose date could not be parsed.
+    StartsAt *time.Time `json:"starts_at"`
+    EndsAt   *time.Time `json:"ends_at"`
+    Timezone string     `json:"timezone"`
+    // VenueID links the concert to one of the user's venues. Location is kept
+    // as entered.
+    VenueID *int64 `json:"venue_id"`
 }
-
-
@@ -0,0 +1,13 @@
+package models
+
+// Invite is a registration invite code. The code itself is only returned
+// once, at creation time.
+type Invite struct {
+    ID        int64  `json:"id"`
+    Prefix    string `json:"prefix"`
+    CreatedBy int64  `json:"created_by"`
+    CreatedAt int64  `json:"created_at"`
+    ExpiresAt int64  `json:"expires_at"`
+    MaxUses   int    `json:"max_uses"`
+    Uses      int    `json:"uses"`
+}
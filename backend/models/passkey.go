@@ -0,0 +1,13 @@
+package models
+
+// Passkey is a WebAuthn credential registered to a user. Its key material is
+// never returned.
+type Passkey struct {
+    ID             int64    `json:"id"`
+    Name           string   `json:"name"`
+    Transports     []string `json:"transports"`
+    BackupEligible bool     `json:"backup_eligible"`
+    BackedUp       bool     `json:"backed_up"`
+    CreatedAt      int64    `json:"created_at"`
+    LastUsedAt     *int64   `json:"last_used_at"`
+}
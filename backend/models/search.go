@@ -0,0 +1,16 @@
+package models
+
+// SearchHit is a concert or song matching a search. Title and Snippet are
+// HTML: the stored text, escaped, with the matched terms wrapped in <mark>
+// tags. ConcertTitle and Date are plain text. Rank orders hits, lower being
+// better.
+type SearchHit struct {
+    Type         string  `json:"type"`
+    ID           int64   `json:"id"`
+    ConcertID    int64   `json:"concert_id"`
+    Title        string  `json:"title"`
+    Snippet      string  `json:"snippet"`
+    ConcertTitle string  `json:"concert_title"`
+    Date         string  `json:"date"`
+    Rank         float64 `json:"rank"`
+}
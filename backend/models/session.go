@@ -0,0 +1,12 @@
+package models
+
+// Session is a login on one device. It lasts as long as its refresh token.
+type Session struct {
+    ID         string `json:"id"`
+    UserAgent  string `json:"user_agent"`
+    IP         string `json:"ip"`
+    CreatedAt  int64  `json:"created_at"`
+    LastSeenAt int64  `json:"last_seen_at"`
+    ExpiresAt  int64  `json:"expires_at"`
+    Current    bool   `json:"current"`
+}
@@ -2,9 +2,17 @@ package models
 
 // User represents an application user.
 type User struct {
-    ID           int64  `json:"id"`
-    Username     string `json:"username"`
-    PasswordHash string `json:"-"`
+    ID              int64  `json:"id"`
+    Username        string `json:"username"`
+    PasswordHash    string `json:"-"`
+    Email           string `json:"email,omitempty"`
+    EmailVerifiedAt *int64 `json:"email_verified_at"`
+    DisplayName     string `json:"display_name"`
+    Timezone        string `json:"timezone"`
+    Locale          string `json:"locale"`
+    AvatarURL       string `json:"avatar_url"`
+    Role            string `json:"role"`
+    DisabledAt      *int64 `json:"disabled_at"`
 }
 
 
@@ -0,0 +1,14 @@
+package models
+
+// Venue is a place where a user's concerts took place.
+type Venue struct {
+    ID        int64    `json:"id"`
+    Name      string   `json:"name"`
+    Address   string   `json:"address"`
+    City      string   `json:"city"`
+    Country   string   `json:"country"`
+    Capacity  *int64   `json:"capacity"`
+    Latitude  *float64 `json:"latitude"`
+    Longitude *float64 `json:"longitude"`
+    UserID    int64    `json:"user_id"`
+}
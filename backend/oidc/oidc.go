@@ -0,0 +1,335 @@
+// Package oidc is a minimal OpenID Connect relying party supporting the
+// authorization code flow with PKCE (RFC 7636).
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"concerts/jwk"
+)
+
+const (
+    discoveryTTL = time.Hour
+    // keysMinRefresh rate-limits JWKS refetches triggered by unknown key ids.
+    keysMinRefresh = time.Minute
+)
+
+// Config describes one identity provider.
+type Config struct {
+    Name         string
+    Issuer       string
+    ClientID     string
+    ClientSecret string
+    RedirectURL  string
+    Scopes       []string
+}
+
+// Claims are the identity claims taken from a verified ID token.
+type Claims struct {
+    Subject           string
+    Email             string
+    EmailVerified     bool
+    Name              string
+    PreferredUsername string
+}
+
+type discoveryDocument struct {
+    Issuer                string `json:"issuer"`
+    AuthorizationEndpoint string `json:"authorization_endpoint"`
+    TokenEndpoint         string `json:"token_endpoint"`
+    JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider talks to a single OpenID provider. Discovery metadata and signing
+// keys are fetched lazily and cached.
+type Provider struct {
+    cfg    Config
+    client *http.Client
+
+    mu          sync.Mutex
+    discovery   *discoveryDocument
+    discoveryAt time.Time
+    keys        map[string]crypto.PublicKey
+    keysAt      time.Time
+}
+
+// NewProvider returns a Provider for cfg. A nil client uses a default client
+// with a timeout.
+func NewProvider(cfg Config, client *http.Client) *Provider {
+    if client == nil {
+        client = &http.Client{Timeout: 10 * time.Second}
+    }
+    if len(cfg.Scopes) == 0 {
+        cfg.Scopes = []string{"openid", "email", "profile"}
+    }
+    return &Provider{cfg: cfg, client: client}
+}
+
+// Name returns the provider's configured name.
+func (p *Provider) Name() string {
+    return p.cfg.Name
+}
+
+// ConfigsFromEnv reads providers listed in OIDC_PROVIDERS (comma separated).
+// Each name NAME is configured through OIDC_NAME_ISSUER, OIDC_NAME_CLIENT_ID,
+// OIDC_NAME_CLIENT_SECRET, OIDC_NAME_REDIRECT_URL and OIDC_NAME_SCOPES.
+func ConfigsFromEnv() ([]Config, error) {
+    var configs []Config
+    for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+        name = strings.TrimSpace(name)
+        if name == "" {
+            continue
+        }
+        prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+        cfg := Config{
+            Name:         name,
+            Issuer:       os.Getenv(prefix + "ISSUER"),
+            ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+            ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+            RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+            Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+        }
+        if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+            return nil, fmt.Errorf("oidc provider %q needs %sISSUER, %sCLIENT_ID and %sREDIRECT_URL", name, prefix, prefix, prefix)
+        }
+        configs = append(configs, cfg)
+    }
+    return configs, nil
+}
+
+// PKCEChallenge derives the S256 code challenge for verifier.
+func PKCEChallenge(verifier string) string {
+    sum := sha256.Sum256([]byte(verifier))
+    return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the URL to send the user to.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+    doc, err := p.discover(ctx)
+    if err != nil {
+        return "", err
+    }
+    q := url.Values{}
+    q.Set("response_type", "code")
+    q.Set("client_id", p.cfg.ClientID)
+    q.Set("redirect_uri", p.cfg.RedirectURL)
+    q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+    q.Set("state", state)
+    q.Set("nonce", nonce)
+    q.Set("code_challenge", PKCEChallenge(verifier))
+    q.Set("code_challenge_method", "S256")
+    sep := "?"
+    if strings.Contains(doc.AuthorizationEndpoint, "?") {
+        sep = "&"
+    }
+    return doc.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the claims of the
+// verified ID token. nonce must match the value sent in AuthCodeURL.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+    doc, err := p.discover(ctx)
+    if err != nil {
+        return nil, err
+    }
+    form := url.Values{}
+    form.Set("grant_type", "authorization_code")
+    form.Set("code", code)
+    form.Set("redirect_uri", p.cfg.RedirectURL)
+    form.Set("client_id", p.cfg.ClientID)
+    form.Set("code_verifier", verifier)
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, doc.TokenEndpoint, strings.NewReader(form.Encode()))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Header.Set("Accept", "application/json")
+    if p.cfg.ClientSecret != "" {
+        req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+    }
+    resp, err := p.client.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("token request failed: %w", err)
+    }
+    defer resp.Body.Close()
+    body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+    if err != nil {
+        return nil, fmt.Errorf("token response read failed: %w", err)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("token endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+    }
+    var tokens struct {
+        IDToken string `json:"id_token"`
+    }
+    if err := json.Unmarshal(body, &tokens); err != nil {
+        return nil, fmt.Errorf("invalid token response: %w", err)
+    }
+    if tokens.IDToken == "" {
+        return nil, errors.New("token response has no id_token")
+    }
+    return p.verifyIDToken(ctx, tokens.IDToken, nonce)
+}
+
+type idTokenClaims struct {
+    jwt.RegisteredClaims
+    Nonce             string `json:"nonce"`
+    Email             string `json:"email"`
+    EmailVerified     any    `json:"email_verified"`
+    Name              string `json:"name"`
+    PreferredUsername string `json:"preferred_username"`
+}
+
+func (p *Provider) verifyIDToken(ctx context.Context, raw, nonce string) (*Claims, error) {
+    var claims idTokenClaims
+    _, err := jwt.ParseWithClaims(raw, &claims, func(t *jwt.Token) (interface{}, error) {
+        kid, _ := t.Header["kid"].(string)
+        return p.key(ctx, kid)
+    },
+        jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "ES512", "EdDSA"}),
+        jwt.WithIssuer(p.cfg.Issuer),
+        jwt.WithAudience(p.cfg.ClientID),
+        jwt.WithExpirationRequired(),
+    )
+    if err != nil {
+        return nil, fmt.Errorf("invalid id_token: %w", err)
+    }
+    if claims.Nonce != nonce {
+        return nil, errors.New("invalid id_token: nonce mismatch")
+    }
+    if claims.Subject == "" {
+        return nil, errors.New("invalid id_token: missing subject")
+    }
+    verified := false
+    switch v := claims.EmailVerified.(type) {
+    case bool:
+        verified = v
+    case string:
+        // Some providers encode booleans as strings.
+        verified = v == "true"
+    }
+    return &Claims{
+        Subject:           claims.Subject,
+        Email:             claims.Email,
+        EmailVerified:     verified,
+        Name:              claims.Name,
+        PreferredUsername: claims.PreferredUsername,
+    }, nil
+}
+
+// key returns the provider's signing key with the given id, refetching the
+// JWKS when the id is unknown (the provider may have rotated keys).
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+    p.mu.Lock()
+    keys, fetchedAt := p.keys, p.keysAt
+    p.mu.Unlock()
+    if k, ok := lookupKey(keys, kid); ok {
+        return k, nil
+    }
+    if time.Since(fetchedAt) < keysMinRefresh {
+        return nil, fmt.Errorf("unknown signing key %q", kid)
+    }
+    keys, err := p.fetchKeys(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if k, ok := lookupKey(keys, kid); ok {
+        return k, nil
+    }
+    return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey finds kid in keys. Tokens without a kid are accepted only when the
+// provider publishes exactly one key.
+func lookupKey(keys map[string]crypto.PublicKey, kid string) (crypto.PublicKey, bool) {
+    if kid == "" && len(keys) == 1 {
+        for _, k := range keys {
+            return k, true
+        }
+    }
+    k, ok := keys[kid]
+    return k, ok
+}
+
+func (p *Provider) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+    doc, err := p.discover(ctx)
+    if err != nil {
+        return nil, err
+    }
+    var set jwk.Set
+    if err := p.getJSON(ctx, doc.JWKSURI, &set); err != nil {
+        return nil, fmt.Errorf("jwks fetch failed: %w", err)
+    }
+    keys := make(map[string]crypto.PublicKey, len(set.Keys))
+    for _, k := range set.Keys {
+        if k.Use != "" && k.Use != "sig" {
+            continue
+        }
+        pub, err := k.PublicKey()
+        if err != nil {
+            // Skip key types we do not understand rather than failing outright.
+            continue
+        }
+        keys[k.Kid] = pub
+    }
+    p.mu.Lock()
+    p.keys, p.keysAt = keys, time.Now()
+    p.mu.Unlock()
+    return keys, nil
+}
+
+func (p *Provider) discover(ctx context.Context) (*discoveryDocument, error) {
+    p.mu.Lock()
+    doc, fetchedAt := p.discovery, p.discoveryAt
+    p.mu.Unlock()
+    if doc != nil && time.Since(fetchedAt) < discoveryTTL {
+        return doc, nil
+    }
+    var fresh discoveryDocument
+    wellKnown := strings.TrimRight(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+    if err := p.getJSON(ctx, wellKnown, &fresh); err != nil {
+        return nil, fmt.Errorf("oidc discovery failed: %w", err)
+    }
+    if fresh.Issuer != p.cfg.Issuer {
+        return nil, fmt.Errorf("oidc discovery: issuer %q does not match configured %q", fresh.Issuer, p.cfg.Issuer)
+    }
+    if fresh.AuthorizationEndpoint == "" || fresh.TokenEndpoint == "" || fresh.JWKSURI == "" {
+        return nil, errors.New("oidc discovery: incomplete provider metadata")
+    }
+    p.mu.Lock()
+    p.discovery, p.discoveryAt = &fresh, time.Now()
+    p.mu.Unlock()
+    return &fresh, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, u string, v any) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Accept", "application/json")
+    resp, err := p.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("GET %s returned %s", u, resp.Status)
+    }
+    return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
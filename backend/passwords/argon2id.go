@@ -0,0 +1,84 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+    argon2SaltLen = 16
+    argon2KeyLen  = 32
+)
+
+// Argon2id hashes with Argon2id. Memory is in KiB.
+type Argon2id struct {
+    Memory  uint32
+    Time    uint32
+    Threads uint8
+}
+
+// DefaultArgon2id follows the OWASP recommendation of 64 MiB, 2 passes.
+var DefaultArgon2id = Argon2id{Memory: 64 * 1024, Time: 2, Threads: 1}
+
+func (a Argon2id) Hash(password string) (string, error) {
+    salt := make([]byte, argon2SaltLen)
+    if _, err := rand.Read(salt); err != nil {
+        return "", err
+    }
+    key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, argon2KeyLen)
+    b64 := base64.RawStdEncoding
+    return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+        argon2.Version, a.Memory, a.Time, a.Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (Argon2id) Owns(encoded string) bool {
+    return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (Argon2id) Verify(password, encoded string) (bool, error) {
+    params, salt, key, err := parseArgon2id(encoded)
+    if err != nil {
+        return false, err
+    }
+    got := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+    return subtle.ConstantTimeCompare(got, key) == 1, nil
+}
+
+func (a Argon2id) Outdated(encoded string) bool {
+    params, salt, key, err := parseArgon2id(encoded)
+    if err != nil {
+        return true
+    }
+    return params != a || len(salt) != argon2SaltLen || len(key) != argon2KeyLen
+}
+
+func parseArgon2id(encoded string) (params Argon2id, salt, key []byte, err error) {
+    // "", "argon2id", "v=19", "m=...,t=...,p=...", salt, hash
+    parts := strings.Split(encoded, "$")
+    if len(parts) != 6 || parts[1] != "argon2id" {
+        return params, nil, nil, ErrUnknownFormat
+    }
+    var version int
+    if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+        return params, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+    }
+    if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+        return params, nil, nil, fmt.Errorf("invalid argon2 parameters: %w", err)
+    }
+    if params.Memory == 0 || params.Time == 0 || params.Threads == 0 {
+        return params, nil, nil, fmt.Errorf("invalid argon2 parameters %q", parts[3])
+    }
+    b64 := base64.RawStdEncoding
+    if salt, err = b64.DecodeString(parts[4]); err != nil {
+        return params, nil, nil, fmt.Errorf("invalid argon2 salt: %w", err)
+    }
+    if key, err = b64.DecodeString(parts[5]); err != nil || len(key) == 0 {
+        return params, nil, nil, fmt.Errorf("invalid argon2 hash")
+    }
+    return params, salt, key, nil
+}
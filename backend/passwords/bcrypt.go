@@ -0,0 +1,46 @@
+package passwords
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Bcrypt hashes with bcrypt at the given cost.
+type Bcrypt struct {
+    Cost int
+}
+
+// DefaultBcrypt uses bcrypt.DefaultCost.
+var DefaultBcrypt = Bcrypt{Cost: bcrypt.DefaultCost}
+
+func (b Bcrypt) Hash(password string) (string, error) {
+    hashed, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+    if err != nil {
+        return "", err
+    }
+    return string(hashed), nil
+}
+
+func (Bcrypt) Owns(encoded string) bool {
+    for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+        if strings.HasPrefix(encoded, prefix) {
+            return true
+        }
+    }
+    return false
+}
+
+func (Bcrypt) Verify(password, encoded string) (bool, error) {
+    err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+    if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+        return false, nil
+    }
+    return err == nil, err
+}
+
+func (b Bcrypt) Outdated(encoded string) bool {
+    cost, err := bcrypt.Cost([]byte(encoded))
+    return err != nil || cost != b.Cost
+}
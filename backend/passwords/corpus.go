@@ -0,0 +1,68 @@
+package passwords
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Corpus is a set of breached passwords, held as sorted SHA-1 digests so that
+// no plaintext is kept and lookups are a binary search.
+type Corpus struct {
+    digests [][sha1.Size]byte
+}
+
+// LoadCorpus reads a breached password file with one uppercase or lowercase
+// hex SHA-1 digest per line, optionally followed by ":count" as in the Have I
+// Been Pwned downloads. Blank lines and lines starting with # are skipped.
+func LoadCorpus(path string) (*Corpus, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, fmt.Errorf("open breached password file: %w", err)
+    }
+    defer f.Close()
+
+    c := &Corpus{}
+    scanner := bufio.NewScanner(f)
+    for line := 1; scanner.Scan(); line++ {
+        text := strings.TrimSpace(scanner.Text())
+        if text == "" || strings.HasPrefix(text, "#") {
+            continue
+        }
+        digest, _, _ := strings.Cut(text, ":")
+        var d [sha1.Size]byte
+        if len(digest) != hex.EncodedLen(sha1.Size) {
+            return nil, fmt.Errorf("%s:%d: expected a SHA-1 hex digest", path, line)
+        }
+        if _, err := hex.Decode(d[:], []byte(digest)); err != nil {
+            return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+        }
+        c.digests = append(c.digests, d)
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("read breached password file: %w", err)
+    }
+    sort.Slice(c.digests, func(i, j int) bool {
+        return bytes.Compare(c.digests[i][:], c.digests[j][:]) < 0
+    })
+    return c, nil
+}
+
+// Len returns the number of digests in the corpus.
+func (c *Corpus) Len() int {
+    return len(c.digests)
+}
+
+// Contains reports whether password is in the corpus.
+func (c *Corpus) Contains(password string) bool {
+    d := sha1.Sum([]byte(password))
+    i := sort.Search(len(c.digests), func(i int) bool {
+        return bytes.Compare(c.digests[i][:], d[:]) >= 0
+    })
+    return i < len(c.digests) && c.digests[i] == d
+}
@@ -0,0 +1,166 @@
+// Package passwords hashes and verifies user passwords.
+//
+// Hashes are stored in self-describing formats: Argon2id in the PHC string
+// format ($argon2id$v=19$m=...,t=...,p=...$salt$hash) and bcrypt in its
+// modular crypt format ($2a$cost$...). Any supported format can be verified
+// whichever algorithm is configured for new hashes, so the algorithm and its
+// parameters can change without invalidating existing passwords; Verify
+// reports when a hash should be upgraded.
+package passwords
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// ErrUnknownFormat is returned for stored hashes no Hasher recognizes.
+var ErrUnknownFormat = errors.New("unknown password hash format")
+
+// Hasher is one password hashing algorithm with fixed parameters.
+type Hasher interface {
+    // Hash returns the encoded hash of password.
+    Hash(password string) (string, error)
+    // Owns reports whether encoded was produced by this algorithm.
+    Owns(encoded string) bool
+    // Verify reports whether password matches encoded, using the
+    // parameters recorded in encoded.
+    Verify(password, encoded string) (bool, error)
+    // Outdated reports whether encoded uses other parameters than the hasher.
+    Outdated(encoded string) bool
+}
+
+var (
+    mu      sync.RWMutex
+    current Hasher
+    // dummy is a hash from current of a password nobody knows, verified
+    // against when there is no real hash so the response takes as long.
+    dummy string
+)
+
+// slots bounds concurrent hashing: each Argon2id hash holds its full memory
+// cost, so a burst of logins must queue rather than multiply it.
+var slots = make(chan struct{}, runtime.GOMAXPROCS(0))
+
+// Init configures the hasher for new passwords from the environment.
+//
+// PASSWORD_HASHER selects "argon2id" (the default) or "bcrypt". Argon2id is
+// tuned with ARGON2_MEMORY_KIB, ARGON2_TIME and ARGON2_THREADS, bcrypt with
+// BCRYPT_COST.
+func Init() (Hasher, error) {
+    var h Hasher
+    switch kind := os.Getenv("PASSWORD_HASHER"); kind {
+    case "", "argon2id":
+        a := DefaultArgon2id
+        var err error
+        if a.Memory, err = uintFromEnv("ARGON2_MEMORY_KIB", a.Memory, 8*1024); err != nil {
+            return nil, err
+        }
+        if a.Time, err = uintFromEnv("ARGON2_TIME", a.Time, 1); err != nil {
+            return nil, err
+        }
+        threads, err := uintFromEnv("ARGON2_THREADS", uint32(a.Threads), 1)
+        if err != nil {
+            return nil, err
+        }
+        if threads > 255 {
+            return nil, errors.New("ARGON2_THREADS must be at most 255")
+        }
+        a.Threads = uint8(threads)
+        h = a
+    case "bcrypt":
+        cost, err := uintFromEnv("BCRYPT_COST", uint32(DefaultBcrypt.Cost), 10)
+        if err != nil {
+            return nil, err
+        }
+        if cost > 31 {
+            return nil, errors.New("BCRYPT_COST must be at most 31")
+        }
+        h = Bcrypt{Cost: int(cost)}
+    default:
+        return nil, fmt.Errorf("unknown PASSWORD_HASHER %q", kind)
+    }
+    secret := make([]byte, 16)
+    if _, err := rand.Read(secret); err != nil {
+        return nil, err
+    }
+    decoy, err := h.Hash(hex.EncodeToString(secret))
+    if err != nil {
+        return nil, fmt.Errorf("dummy hash failed: %w", err)
+    }
+    mu.Lock()
+    current, dummy = h, decoy
+    mu.Unlock()
+    return h, nil
+}
+
+// Get returns the hasher used for new passwords. Panics if Init was not called.
+func Get() Hasher {
+    mu.RLock()
+    defer mu.RUnlock()
+    if current == nil {
+        panic("passwords not initialized: call passwords.Init() first")
+    }
+    return current
+}
+
+func uintFromEnv(name string, def, min uint32) (uint32, error) {
+    v := os.Getenv(name)
+    if v == "" {
+        return def, nil
+    }
+    n, err := strconv.ParseUint(v, 10, 32)
+    if err != nil || uint32(n) < min {
+        return 0, fmt.Errorf("%s must be an integer >= %d", name, min)
+    }
+    return uint32(n), nil
+}
+
+// known lists every format that can be verified.
+var known = []Hasher{Argon2id{}, Bcrypt{}}
+
+// Hash hashes password with the configured hasher.
+func Hash(password string) (string, error) {
+    slots <- struct{}{}
+    defer func() { <-slots }()
+    return Get().Hash(password)
+}
+
+// Verify checks password against a stored hash in any supported format.
+// rehash is true when the password matched but the hash should be replaced
+// with one from Hash, because the algorithm or its parameters changed. An
+// empty hash (an account without a password) never matches.
+func Verify(password, encoded string) (ok, rehash bool, err error) {
+    if encoded == "" {
+        return false, false, nil
+    }
+    slots <- struct{}{}
+    defer func() { <-slots }()
+    for _, h := range known {
+        if !h.Owns(encoded) {
+            continue
+        }
+        ok, err := h.Verify(password, encoded)
+        if err != nil || !ok {
+            return false, false, err
+        }
+        cur := Get()
+        return true, !cur.Owns(encoded) || cur.Outdated(encoded), nil
+    }
+    return false, false, ErrUnknownFormat
+}
+
+// VerifyDummy takes as long as a failed Verify against a hash from the
+// configured hasher. Use it when there is no hash to check, such as for an
+// unknown username, so the response time does not tell.
+func VerifyDummy(password string) {
+    mu.RLock()
+    decoy := dummy
+    mu.RUnlock()
+    Verify(password, decoy)
+}
@@ -0,0 +1,56 @@
+package passwords
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDummyHashMatchesConfiguredHasher(t *testing.T) {
+    for _, kind := range []string{"argon2id", "bcrypt"} {
+        t.Setenv("PASSWORD_HASHER", kind)
+        t.Setenv("ARGON2_MEMORY_KIB", "8192")
+        t.Setenv("BCRYPT_COST", "10")
+        h, err := Init()
+        if err != nil {
+            t.Fatal(err)
+        }
+        // The dummy hash costs as much to check as a real one only if it
+        // was made with the same algorithm and parameters.
+        if !h.Owns(dummy) || h.Outdated(dummy) {
+            t.Errorf("%s: dummy hash %q does not match the hasher", kind, dummy)
+        }
+        if ok, _, err := Verify("", dummy); ok || err != nil {
+            t.Errorf("%s: empty password matched the dummy hash, err = %v", kind, err)
+        }
+    }
+}
+
+func TestHashingIsBounded(t *testing.T) {
+    if cap(slots) < 1 {
+        t.Fatalf("hashing slots = %d", cap(slots))
+    }
+    // Hold every slot: a hash must wait until one is released.
+    for i := 0; i < cap(slots); i++ {
+        slots <- struct{}{}
+    }
+    t.Setenv("PASSWORD_HASHER", "bcrypt")
+    t.Setenv("BCRYPT_COST", "10")
+    if _, err := Init(); err != nil {
+        t.Fatal(err)
+    }
+    done := make(chan struct{})
+    go func() {
+        Hash("password")
+        close(done)
+    }()
+    select {
+    case <-done:
+        t.Fatal("Hash ran with every slot taken")
+    case <-time.After(100 * time.Millisecond):
+    }
+    <-slots
+    <-done
+    for i := 1; i < cap(slots); i++ {
+        <-slots
+    }
+}
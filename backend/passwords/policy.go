@@ -0,0 +1,131 @@
+package passwords
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// bcryptMaxBytes is the longest input bcrypt accepts.
+const bcryptMaxBytes = 72
+
+// Policy decides which new passwords are acceptable.
+type Policy struct {
+    // MinLength and MaxLength count characters.
+    MinLength int
+    MaxLength int
+    // MaxBytes, if set, limits the encoded length (bcrypt only reads 72 bytes).
+    MaxBytes int
+    // RejectUsername refuses passwords that contain the username.
+    RejectUsername bool
+    // Breached, if set, refuses passwords found in the corpus.
+    Breached *Corpus
+}
+
+// Violation is one policy rule a password breaks.
+type Violation struct {
+    Rule    string `json:"rule"`
+    Message string `json:"message"`
+}
+
+// PolicyError lists every rule a password breaks.
+type PolicyError struct {
+    Violations []Violation
+}
+
+func (e *PolicyError) Error() string {
+    msgs := make([]string, len(e.Violations))
+    for i, v := range e.Violations {
+        msgs[i] = v.Message
+    }
+    return strings.Join(msgs, "; ")
+}
+
+// Check returns a *PolicyError if password breaks any rule, nil otherwise.
+func (p *Policy) Check(password, username string) error {
+    var violations []Violation
+    n := utf8.RuneCountInString(password)
+    if n < p.MinLength {
+        violations = append(violations, Violation{"min_length", fmt.Sprintf("password must be at least %d characters", p.MinLength)})
+    }
+    if p.MaxLength > 0 && n > p.MaxLength {
+        violations = append(violations, Violation{"max_length", fmt.Sprintf("password must be at most %d characters", p.MaxLength)})
+    } else if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+        violations = append(violations, Violation{"max_length", fmt.Sprintf("password must be at most %d bytes", p.MaxBytes)})
+    }
+    if p.RejectUsername && len(username) >= 3 && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+        violations = append(violations, Violation{"contains_username", "password must not contain the username"})
+    }
+    if p.Breached != nil && p.Breached.Contains(password) {
+        violations = append(violations, Violation{"breached", "password appears in a list of breached passwords, choose another one"})
+    }
+    if len(violations) > 0 {
+        return &PolicyError{Violations: violations}
+    }
+    return nil
+}
+
+var (
+    policyMu sync.RWMutex
+    policy   *Policy
+)
+
+// InitPolicy configures the password policy from the environment:
+// PASSWORD_MIN_LENGTH (default 8), PASSWORD_MAX_LENGTH (default 128),
+// PASSWORD_REJECT_USERNAME (default 1) and PASSWORD_BREACHED_FILE, a corpus
+// of breached password hashes (see LoadCorpus). Call it after Init.
+func InitPolicy() (*Policy, error) {
+    p := &Policy{MinLength: 8, MaxLength: 128, RejectUsername: true}
+    var err error
+    if p.MinLength, err = intEnv("PASSWORD_MIN_LENGTH", p.MinLength); err != nil {
+        return nil, err
+    }
+    if p.MaxLength, err = intEnv("PASSWORD_MAX_LENGTH", p.MaxLength); err != nil {
+        return nil, err
+    }
+    if p.MinLength < 1 || p.MaxLength < p.MinLength {
+        return nil, fmt.Errorf("password length limits must satisfy 1 <= PASSWORD_MIN_LENGTH <= PASSWORD_MAX_LENGTH")
+    }
+    if v := os.Getenv("PASSWORD_REJECT_USERNAME"); v != "" {
+        if p.RejectUsername, err = strconv.ParseBool(v); err != nil {
+            return nil, fmt.Errorf("invalid PASSWORD_REJECT_USERNAME: %w", err)
+        }
+    }
+    if _, ok := Get().(Bcrypt); ok {
+        p.MaxBytes = bcryptMaxBytes
+    }
+    if path := os.Getenv("PASSWORD_BREACHED_FILE"); path != "" {
+        if p.Breached, err = LoadCorpus(path); err != nil {
+            return nil, err
+        }
+    }
+    policyMu.Lock()
+    policy = p
+    policyMu.Unlock()
+    return p, nil
+}
+
+// GetPolicy returns the configured policy. Panics if InitPolicy was not called.
+func GetPolicy() *Policy {
+    policyMu.RLock()
+    defer policyMu.RUnlock()
+    if policy == nil {
+        panic("password policy not initialized: call passwords.InitPolicy() first")
+    }
+    return policy
+}
+
+func intEnv(name string, def int) (int, error) {
+    v := os.Getenv(name)
+    if v == "" {
+        return def, nil
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil {
+        return 0, fmt.Errorf("invalid %s: %w", name, err)
+    }
+    return n, nil
+}
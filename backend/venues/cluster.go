@@ -0,0 +1,208 @@
+// Package venues groups the free-text locations concerts were stored with
+// into candidate venues, so that spellings of the same place can be merged.
+package venues
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Location is one distinct location string and the concerts that use it.
+type Location struct {
+    Text       string  `json:"location"`
+    ConcertIDs []int64 `json:"concert_ids"`
+}
+
+// Candidate is a group of locations that probably name the same venue. Name
+// is the most used spelling.
+type Candidate struct {
+    Key        string     `json:"key"`
+    Name       string     `json:"name"`
+    Locations  []Location `json:"locations"`
+    ConcertIDs []int64    `json:"concert_ids"`
+}
+
+// folds maps accented Latin letters to their base letter.
+var folds = map[rune]string{
+    'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'æ': "ae",
+    'ç': "c", 'č': "c", 'ć': "c",
+    'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ě': "e", 'ę': "e",
+    'ì': "i", 'í': "i", 'î': "i", 'ï': "i",
+    'ñ': "n", 'ń': "n", 'ň': "n",
+    'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'œ': "oe",
+    'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ů': "u",
+    'ý': "y", 'ÿ': "y",
+    'ß': "ss", 'ł': "l", 'ř': "r", 'š': "s", 'ś': "s", 'ž': "z", 'ź': "z", 'ż': "z",
+}
+
+// stopWords carry no information about which venue is meant.
+var stopWords = map[string]bool{"the": true, "a": true, "an": true, "at": true, "of": true, "and": true}
+
+// Normalize reduces a location to a comparison key: lower case, without
+// accents, punctuation or stop words, with its words sorted, so that
+// "The Roundhouse, London" and "london roundhouse" have the same key.
+func Normalize(s string) string {
+    var b strings.Builder
+    for _, r := range strings.ToLower(s) {
+        switch {
+        case folds[r] != "":
+            b.WriteString(folds[r])
+        case r == '&':
+            b.WriteString(" and ")
+        case unicode.IsLetter(r) || unicode.IsNumber(r):
+            b.WriteRune(r)
+        default:
+            b.WriteByte(' ')
+        }
+    }
+    words := slices.DeleteFunc(strings.Fields(b.String()), func(w string) bool { return stopWords[w] })
+    slices.Sort(words)
+    return strings.Join(slices.Compact(words), " ")
+}
+
+// Cluster groups locations whose keys are equal, differ by a typo, or where
+// one key's words are all part of the other's, as in "Paradiso" and
+// "Paradiso, Amsterdam". A single short word such as "Arena" is too generic
+// to be matched that way, and so is a key that is part of several others,
+// such as a bare city name. Each location is compared with the first
+// location of the candidates so far, the most used ones first, so that
+// matches are not chained into one large group. Candidates are returned with
+// the most concerts first.
+func Cluster(locations []Location) []Candidate {
+    type group struct {
+        key       string
+        locations []Location
+        concerts  int
+    }
+    byKey := map[string]*group{}
+    var groups []*group
+    for _, l := range locations {
+        key := Normalize(l.Text)
+        if key == "" {
+            continue
+        }
+        g, ok := byKey[key]
+        if !ok {
+            g = &group{key: key}
+            byKey[key] = g
+            groups = append(groups, g)
+        }
+        g.locations = append(g.locations, l)
+        g.concerts += len(l.ConcertIDs)
+    }
+    slices.SortStableFunc(groups, func(a, b *group) int {
+        return b.concerts - a.concerts
+    })
+
+    ambiguous := make([]bool, len(groups))
+    for i := range groups {
+        n := 0
+        for j := range groups {
+            if i != j && partOf(groups[i].key, groups[j].key) {
+                n++
+            }
+        }
+        ambiguous[i] = n > 1
+    }
+
+    var roots []int
+    members := map[int][]int{}
+    for i, g := range groups {
+        joined := false
+        for _, root := range roots {
+            r := groups[root]
+            if typo(r.key, g.key) || (partOf(r.key, g.key) && !ambiguous[root]) || (partOf(g.key, r.key) && !ambiguous[i]) {
+                members[root] = append(members[root], i)
+                joined = true
+                break
+            }
+        }
+        if !joined {
+            roots = append(roots, i)
+            members[i] = []int{i}
+        }
+    }
+
+    candidates := make([]Candidate, 0, len(roots))
+    for _, root := range roots {
+        c := Candidate{Key: groups[root].key}
+        for _, i := range members[root] {
+            c.Locations = append(c.Locations, groups[i].locations...)
+        }
+        best := -1
+        for i, l := range c.Locations {
+            c.ConcertIDs = append(c.ConcertIDs, l.ConcertIDs...)
+            if best < 0 || len(l.ConcertIDs) > len(c.Locations[best].ConcertIDs) {
+                best = i
+            }
+        }
+        c.Name = strings.TrimSpace(c.Locations[best].Text)
+        slices.Sort(c.ConcertIDs)
+        candidates = append(candidates, c)
+    }
+    slices.SortStableFunc(candidates, func(a, b Candidate) int {
+        return len(b.ConcertIDs) - len(a.ConcertIDs)
+    })
+    return candidates
+}
+
+// Match reports whether a location probably names the given venue.
+func Match(location, venue string) bool {
+    a, b := Normalize(location), Normalize(venue)
+    return a != "" && b != "" && (a == b || partOf(a, b) || partOf(b, a) || typo(a, b))
+}
+
+// partOf reports whether all of a's words are among b's more numerous words.
+// A single word shorter than six letters never is.
+func partOf(a, b string) bool {
+    aw, bw := strings.Fields(a), strings.Fields(b)
+    if len(aw) >= len(bw) || (len(aw) == 1 && len(aw[0]) < 6) {
+        return false
+    }
+    return subset(aw, bw)
+}
+
+// typo reports whether two keys differ by no more than one typo per eight
+// characters. Short names get none, as a single letter is often the whole
+// difference between two venues.
+func typo(a, b string) bool {
+    if len(a) > len(b) {
+        a, b = b, a
+    }
+    limit := len(a) / 8
+    return limit > 0 && len(b)-len(a) <= limit && distance(a, b) <= limit
+}
+
+func subset(small, large []string) bool {
+    for _, w := range small {
+        if _, found := slices.BinarySearch(large, w); !found {
+            return false
+        }
+    }
+    return true
+}
+
+// distance is the edit distance between a and b, in bytes, counting a swap
+// of two adjacent letters as one edit.
+func distance(a, b string) int {
+    older, prev, cur := make([]int, len(b)+1), make([]int, len(b)+1), make([]int, len(b)+1)
+    for j := range prev {
+        prev[j] = j
+    }
+    for i := 1; i <= len(a); i++ {
+        cur[0] = i
+        for j := 1; j <= len(b); j++ {
+            cost := 1
+            if a[i-1] == b[j-1] {
+                cost = 0
+            }
+            cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+            if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+                cur[j] = min(cur[j], older[j-2]+1)
+            }
+        }
+        older, prev, cur = prev, cur, older
+    }
+    return prev[len(b)]
+}
@@ -0,0 +1,82 @@
+package venues
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// groups returns the location texts of each candidate, sorted, in order of
+// their first text.
+func groups(candidates []Candidate) [][]string {
+    out := make([][]string, len(candidates))
+    for i, c := range candidates {
+        for _, l := range c.Locations {
+            out[i] = append(out[i], l.Text)
+        }
+        slices.Sort(out[i])
+    }
+    slices.SortFunc(out, func(a, b []string) int { return strings.Compare(a[0], b[0]) })
+    return out
+}
+
+func locations(texts ...string) []Location {
+    list := make([]Location, len(texts))
+    for i, t := range texts {
+        list[i] = Location{Text: t, ConcertIDs: []int64{int64(i + 1)}}
+    }
+    return list
+}
+
+func TestClusterMergesSpellings(t *testing.T) {
+    got := groups(Cluster(locations(
+        "Paradiso",
+        "Paradiso, Amsterdam",
+        "The Roundhouse, London",
+        "london roundhouse",
+        "Rounhdouse London",
+        "Arena",
+        "O2 Arena",
+    )))
+    want := [][]string{
+        {"Arena"},
+        {"O2 Arena"},
+        {"Paradiso", "Paradiso, Amsterdam"},
+        {"Rounhdouse London", "The Roundhouse, London", "london roundhouse"},
+    }
+    if !slices.EqualFunc(got, want, slices.Equal) {
+        t.Fatalf("got %q, want %q", got, want)
+    }
+}
+
+func TestClusterKeepsVenuesInOneCityApart(t *testing.T) {
+    list := locations(
+        "London",
+        "Roundhouse, London",
+        "O2 Arena, London",
+        "KOKO, London",
+        "Brixton Academy, London",
+        "Royal Albert Hall London",
+    )
+    // The bare city name is the most common location.
+    list[0].ConcertIDs = []int64{10, 11, 12}
+    got := groups(Cluster(list))
+    if len(got) != len(list) {
+        t.Fatalf("got %d candidates %q, want every location apart", len(got), got)
+    }
+}
+
+func TestClusterDoesNotChainMatches(t *testing.T) {
+    // Each neighbour differs by one typo, the ends by three.
+    got := groups(Cluster(locations(
+        "Philharmonie Berlin",
+        "Philharmonie Berlim",
+        "Philharmonie Berlxm",
+        "Philharmonie Bexlxm",
+    )))
+    for _, c := range got {
+        if slices.Contains(c, "Philharmonie Berlin") && slices.Contains(c, "Philharmonie Bexlxm") {
+            t.Fatalf("got %q, chained into one candidate", got)
+        }
+    }
+}
@@ -0,0 +1,144 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// maxCBORDepth bounds nesting so that hostile input cannot exhaust the stack.
+const maxCBORDepth = 16
+
+var errCBORTruncated = errors.New("cbor: unexpected end of input")
+
+// decodeCBOR decodes the first CBOR data item in data (RFC 8949) and returns
+// it with the number of bytes it used. Only the subset WebAuthn needs is
+// supported: integers (as int64), byte and text strings, arrays ([]any),
+// maps (map[any]any, with int64 or string keys), booleans and null.
+func decodeCBOR(data []byte) (any, int, error) {
+    d := cborDecoder{data: data}
+    v, err := d.item(0)
+    return v, d.pos, err
+}
+
+type cborDecoder struct {
+    data []byte
+    pos  int
+}
+
+func (d *cborDecoder) head() (major byte, arg uint64, err error) {
+    if d.pos >= len(d.data) {
+        return 0, 0, errCBORTruncated
+    }
+    b := d.data[d.pos]
+    d.pos++
+    major, info := b>>5, b&0x1f
+    switch {
+    case info < 24:
+        return major, uint64(info), nil
+    case info <= 27:
+        n := 1 << (info - 24)
+        if d.pos+n > len(d.data) {
+            return 0, 0, errCBORTruncated
+        }
+        buf := d.data[d.pos : d.pos+n]
+        d.pos += n
+        switch n {
+        case 1:
+            arg = uint64(buf[0])
+        case 2:
+            arg = uint64(binary.BigEndian.Uint16(buf))
+        case 4:
+            arg = uint64(binary.BigEndian.Uint32(buf))
+        default:
+            arg = binary.BigEndian.Uint64(buf)
+        }
+        return major, arg, nil
+    default:
+        return 0, 0, fmt.Errorf("cbor: unsupported additional info %d", info)
+    }
+}
+
+func (d *cborDecoder) bytes(n uint64) ([]byte, error) {
+    if n > uint64(len(d.data)-d.pos) {
+        return nil, errCBORTruncated
+    }
+    b := d.data[d.pos : d.pos+int(n)]
+    d.pos += int(n)
+    return b, nil
+}
+
+func (d *cborDecoder) item(depth int) (any, error) {
+    if depth > maxCBORDepth {
+        return nil, errors.New("cbor: nesting too deep")
+    }
+    major, arg, err := d.head()
+    if err != nil {
+        return nil, err
+    }
+    switch major {
+    case 0:
+        if arg > math.MaxInt64 {
+            return nil, errors.New("cbor: integer overflow")
+        }
+        return int64(arg), nil
+    case 1:
+        if arg > math.MaxInt64 {
+            return nil, errors.New("cbor: integer overflow")
+        }
+        return -1 - int64(arg), nil
+    case 2:
+        return d.bytes(arg)
+    case 3:
+        b, err := d.bytes(arg)
+        return string(b), err
+    case 4:
+        if arg > uint64(len(d.data)) {
+            return nil, errCBORTruncated
+        }
+        list := make([]any, 0, arg)
+        for i := uint64(0); i < arg; i++ {
+            v, err := d.item(depth + 1)
+            if err != nil {
+                return nil, err
+            }
+            list = append(list, v)
+        }
+        return list, nil
+    case 5:
+        if arg > uint64(len(d.data)) {
+            return nil, errCBORTruncated
+        }
+        m := make(map[any]any, arg)
+        for i := uint64(0); i < arg; i++ {
+            k, err := d.item(depth + 1)
+            if err != nil {
+                return nil, err
+            }
+            switch k.(type) {
+            case int64, string:
+            default:
+                return nil, fmt.Errorf("cbor: unsupported map key type %T", k)
+            }
+            v, err := d.item(depth + 1)
+            if err != nil {
+                return nil, err
+            }
+            m[k] = v
+        }
+        return m, nil
+    case 7:
+        switch arg {
+        case 20:
+            return false, nil
+        case 21:
+            return true, nil
+        case 22:
+            return nil, nil
+        }
+        return nil, fmt.Errorf("cbor: unsupported simple value %d", arg)
+    default:
+        return nil, fmt.Errorf("cbor: unsupported major type %d", major)
+    }
+}
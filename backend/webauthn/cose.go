@@ -0,0 +1,121 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers (RFC 9053) accepted for credentials.
+const (
+    AlgES256 int64 = -7
+    AlgEdDSA int64 = -8
+    AlgRS256 int64 = -257
+)
+
+// Algorithms lists the supported algorithms in order of preference.
+var Algorithms = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+// COSE key parameters.
+const (
+    coseKty = 1
+    coseAlg = 3
+    coseCrv = -1
+    coseX   = -2
+    coseY   = -3
+    coseN   = -1
+    coseE   = -2
+
+    ktyOKP = 1
+    ktyEC2 = 2
+    ktyRSA = 3
+
+    crvP256    = 1
+    crvEd25519 = 6
+)
+
+// PublicKey is a credential public key decoded from its COSE_Key form.
+type PublicKey struct {
+    Algorithm int64
+    key       crypto.PublicKey
+}
+
+// ParsePublicKey decodes a COSE_Key (RFC 9052 section 7) holding an ES256,
+// EdDSA (Ed25519) or RS256 public key.
+func ParsePublicKey(data []byte) (*PublicKey, error) {
+    v, n, err := decodeCBOR(data)
+    if err != nil {
+        return nil, err
+    }
+    if n != len(data) {
+        return nil, errors.New("cose: trailing data after key")
+    }
+    return publicKeyFromCOSE(v)
+}
+
+func publicKeyFromCOSE(v any) (*PublicKey, error) {
+    m, ok := v.(map[any]any)
+    if !ok {
+        return nil, errors.New("cose: key is not a map")
+    }
+    kty, _ := m[int64(coseKty)].(int64)
+    alg, ok := m[int64(coseAlg)].(int64)
+    if !ok {
+        return nil, errors.New("cose: key has no algorithm")
+    }
+    switch {
+    case kty == ktyEC2 && alg == AlgES256:
+        if crv, _ := m[int64(coseCrv)].(int64); crv != crvP256 {
+            return nil, errors.New("cose: ES256 key is not on P-256")
+        }
+        x, _ := m[int64(coseX)].([]byte)
+        y, _ := m[int64(coseY)].([]byte)
+        if len(x) != 32 || len(y) != 32 {
+            return nil, errors.New("cose: malformed P-256 coordinates")
+        }
+        pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+        if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+            return nil, errors.New("cose: point is not on P-256")
+        }
+        return &PublicKey{Algorithm: alg, key: pub}, nil
+    case kty == ktyOKP && alg == AlgEdDSA:
+        if crv, _ := m[int64(coseCrv)].(int64); crv != crvEd25519 {
+            return nil, errors.New("cose: EdDSA key is not Ed25519")
+        }
+        x, _ := m[int64(coseX)].([]byte)
+        if len(x) != ed25519.PublicKeySize {
+            return nil, errors.New("cose: malformed Ed25519 key")
+        }
+        return &PublicKey{Algorithm: alg, key: ed25519.PublicKey(x)}, nil
+    case kty == ktyRSA && alg == AlgRS256:
+        n, _ := m[int64(coseN)].([]byte)
+        e, _ := m[int64(coseE)].([]byte)
+        if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+            return nil, errors.New("cose: malformed or short RSA key")
+        }
+        exp := int(new(big.Int).SetBytes(e).Int64())
+        return &PublicKey{Algorithm: alg, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}}, nil
+    }
+    return nil, fmt.Errorf("cose: unsupported key type %d with algorithm %d", kty, alg)
+}
+
+// Verify checks sig over message with the key's algorithm.
+func (k *PublicKey) Verify(message, sig []byte) bool {
+    switch pub := k.key.(type) {
+    case *ecdsa.PublicKey:
+        digest := sha256.Sum256(message)
+        return ecdsa.VerifyASN1(pub, digest[:], sig)
+    case ed25519.PublicKey:
+        return ed25519.Verify(pub, message, sig)
+    case *rsa.PublicKey:
+        digest := sha256.Sum256(message)
+        return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+    }
+    return false
+}
@@ -0,0 +1,367 @@
+// Package webauthn is a minimal WebAuthn relying party (W3C Web
+// Authentication Level 2) for passkey registration and login. Attestation is
+// requested as "none" and not verified: a credential is trusted because the
+// signed-in user registered it, not because of where it was made.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ChallengeSize is the length of generated challenges in bytes.
+const ChallengeSize = 32
+
+// Timeout is the ceremony timeout suggested to the browser.
+const Timeout = 5 * time.Minute
+
+// Authenticator data flags.
+const (
+    flagUserPresent    = 0x01
+    flagUserVerified   = 0x04
+    flagBackupEligible = 0x08
+    flagBackedUp       = 0x10
+    flagAttestedData   = 0x40
+    flagExtensions     = 0x80
+)
+
+// ErrVerification wraps every reason a ceremony response is rejected.
+var ErrVerification = errors.New("webauthn verification failed")
+
+func verificationError(format string, args ...any) error {
+    return fmt.Errorf("%w: %s", ErrVerification, fmt.Sprintf(format, args...))
+}
+
+// Encoding is the base64url encoding used for binary values in JSON.
+var Encoding = base64.RawURLEncoding
+
+// RelyingParty identifies the site credentials are scoped to.
+type RelyingParty struct {
+    // ID is the registrable domain credentials are bound to, e.g. example.com.
+    ID   string
+    Name string
+    // Origins lists the accepted client origins, e.g. https://example.com.
+    Origins []string
+}
+
+// NewChallenge returns a random ceremony challenge.
+func NewChallenge() ([]byte, error) {
+    b := make([]byte, ChallengeSize)
+    if _, err := rand.Read(b); err != nil {
+        return nil, err
+    }
+    return b, nil
+}
+
+// User is the account a credential is created for.
+type User struct {
+    // Handle is an opaque, random id stored by the authenticator; it must
+    // not contain personal information.
+    Handle      []byte
+    Name        string
+    DisplayName string
+}
+
+// CredentialDescriptor names an existing credential.
+type CredentialDescriptor struct {
+    Type       string   `json:"type"`
+    ID         string   `json:"id"`
+    Transports []string `json:"transports,omitempty"`
+}
+
+type rpEntity struct {
+    ID   string `json:"id"`
+    Name string `json:"name"`
+}
+
+type userEntity struct {
+    ID          string `json:"id"`
+    Name        string `json:"name"`
+    DisplayName string `json:"displayName"`
+}
+
+type credentialParameter struct {
+    Type string `json:"type"`
+    Alg  int64  `json:"alg"`
+}
+
+type authenticatorSelection struct {
+    ResidentKey        string `json:"residentKey"`
+    RequireResidentKey bool   `json:"requireResidentKey"`
+    UserVerification   string `json:"userVerification"`
+}
+
+// CreationOptions is the JSON form of PublicKeyCredentialCreationOptions,
+// with binary values base64url encoded as for PublicKeyCredential.parseCreationOptionsFromJSON.
+type CreationOptions struct {
+    Challenge              string                 `json:"challenge"`
+    RP                     rpEntity               `json:"rp"`
+    User                   userEntity             `json:"user"`
+    PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+    Timeout                int64                  `json:"timeout"`
+    Attestation            string                 `json:"attestation"`
+    AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+    ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+}
+
+// RequestOptions is the JSON form of PublicKeyCredentialRequestOptions.
+type RequestOptions struct {
+    Challenge        string                 `json:"challenge"`
+    RPID             string                 `json:"rpId"`
+    Timeout          int64                  `json:"timeout"`
+    UserVerification string                 `json:"userVerification"`
+    AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+}
+
+// CreationOptions builds the options for registering a discoverable,
+// user-verifying credential (a passkey) for user.
+func (rp *RelyingParty) CreationOptions(challenge []byte, user User, exclude []CredentialDescriptor) CreationOptions {
+    params := make([]credentialParameter, len(Algorithms))
+    for i, alg := range Algorithms {
+        params[i] = credentialParameter{Type: "public-key", Alg: alg}
+    }
+    if exclude == nil {
+        exclude = []CredentialDescriptor{}
+    }
+    return CreationOptions{
+        Challenge:        Encoding.EncodeToString(challenge),
+        RP:               rpEntity{ID: rp.ID, Name: rp.Name},
+        User:             userEntity{ID: Encoding.EncodeToString(user.Handle), Name: user.Name, DisplayName: user.DisplayName},
+        PubKeyCredParams: params,
+        Timeout:          Timeout.Milliseconds(),
+        Attestation:      "none",
+        AuthenticatorSelection: authenticatorSelection{
+            ResidentKey:        "required",
+            RequireResidentKey: true,
+            UserVerification:   "required",
+        },
+        ExcludeCredentials: exclude,
+    }
+}
+
+// RequestOptions builds the options for a login. An empty allow list lets
+// the user pick any passkey they hold for this site.
+func (rp *RelyingParty) RequestOptions(challenge []byte, allow []CredentialDescriptor) RequestOptions {
+    if allow == nil {
+        allow = []CredentialDescriptor{}
+    }
+    return RequestOptions{
+        Challenge:        Encoding.EncodeToString(challenge),
+        RPID:             rp.ID,
+        Timeout:          Timeout.Milliseconds(),
+        UserVerification: "required",
+        AllowCredentials: allow,
+    }
+}
+
+// Credential is a verified new credential, to be stored with its user.
+type Credential struct {
+    ID []byte
+    // PublicKey is the COSE_Key as sent by the authenticator.
+    PublicKey      []byte
+    Algorithm      int64
+    SignCount      uint32
+    AAGUID         []byte
+    BackupEligible bool
+    BackedUp       bool
+}
+
+// VerifyRegistration checks the response to a creation ceremony started with
+// challenge and returns the new credential.
+func (rp *RelyingParty) VerifyRegistration(challenge, clientDataJSON, attestationObject []byte) (*Credential, error) {
+    if err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+        return nil, err
+    }
+    v, n, err := decodeCBOR(attestationObject)
+    if err != nil || n != len(attestationObject) {
+        return nil, verificationError("malformed attestation object")
+    }
+    att, ok := v.(map[any]any)
+    if !ok {
+        return nil, verificationError("malformed attestation object")
+    }
+    if _, ok := att["fmt"].(string); !ok {
+        return nil, verificationError("attestation object has no format")
+    }
+    raw, ok := att["authData"].([]byte)
+    if !ok {
+        return nil, verificationError("attestation object has no authenticator data")
+    }
+    data, err := parseAuthenticatorData(raw)
+    if err != nil {
+        return nil, err
+    }
+    if err := rp.verifyAuthenticatorData(data); err != nil {
+        return nil, err
+    }
+    if data.flags&flagAttestedData == 0 || data.credentialID == nil {
+        return nil, verificationError("no attested credential data")
+    }
+    key, err := ParsePublicKey(data.publicKey)
+    if err != nil {
+        return nil, verificationError("%v", err)
+    }
+    return &Credential{
+        ID:             data.credentialID,
+        PublicKey:      data.publicKey,
+        Algorithm:      key.Algorithm,
+        SignCount:      data.signCount,
+        AAGUID:         data.aaguid,
+        BackupEligible: data.flags&flagBackupEligible != 0,
+        BackedUp:       data.flags&flagBackedUp != 0,
+    }, nil
+}
+
+// Assertion is the outcome of a verified login.
+type Assertion struct {
+    SignCount uint32
+    BackedUp  bool
+}
+
+// VerifyAssertion checks the response to a request ceremony started with
+// challenge against a stored credential's COSE public key and signature
+// counter. A counter that fails to increase indicates a cloned
+// authenticator and is rejected; authenticators that always report zero
+// (as synced passkeys do) are accepted.
+func (rp *RelyingParty) VerifyAssertion(challenge, publicKey []byte, storedCount uint32, clientDataJSON, authenticatorData, signature []byte) (*Assertion, error) {
+    if err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+        return nil, err
+    }
+    data, err := parseAuthenticatorData(authenticatorData)
+    if err != nil {
+        return nil, err
+    }
+    if err := rp.verifyAuthenticatorData(data); err != nil {
+        return nil, err
+    }
+    key, err := ParsePublicKey(publicKey)
+    if err != nil {
+        return nil, fmt.Errorf("stored credential key: %w", err)
+    }
+    clientDataHash := sha256.Sum256(clientDataJSON)
+    signed := append(slices.Clip(authenticatorData), clientDataHash[:]...)
+    if !key.Verify(signed, signature) {
+        return nil, verificationError("invalid signature")
+    }
+    if (data.signCount != 0 || storedCount != 0) && data.signCount <= storedCount {
+        return nil, verificationError("signature counter did not increase, the authenticator may be cloned")
+    }
+    return &Assertion{SignCount: data.signCount, BackedUp: data.flags&flagBackedUp != 0}, nil
+}
+
+type clientData struct {
+    Type        string `json:"type"`
+    Challenge   string `json:"challenge"`
+    Origin      string `json:"origin"`
+    CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// ClientChallenge returns the challenge a response was made for, so that the
+// ceremony it belongs to can be looked up before verification.
+func ClientChallenge(clientDataJSON []byte) ([]byte, error) {
+    var cd clientData
+    if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+        return nil, verificationError("malformed client data")
+    }
+    challenge, err := Encoding.DecodeString(cd.Challenge)
+    if err != nil || len(challenge) == 0 {
+        return nil, verificationError("malformed challenge")
+    }
+    return challenge, nil
+}
+
+func (rp *RelyingParty) verifyClientData(raw []byte, typ string, challenge []byte) error {
+    var cd clientData
+    if err := json.Unmarshal(raw, &cd); err != nil {
+        return verificationError("malformed client data")
+    }
+    if cd.Type != typ {
+        return verificationError("client data type is %q, want %q", cd.Type, typ)
+    }
+    got, err := Encoding.DecodeString(cd.Challenge)
+    if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+        return verificationError("challenge mismatch")
+    }
+    if !slices.Contains(rp.Origins, cd.Origin) {
+        return verificationError("origin %q is not allowed", cd.Origin)
+    }
+    if cd.CrossOrigin {
+        return verificationError("cross-origin ceremonies are not allowed")
+    }
+    return nil
+}
+
+func (rp *RelyingParty) verifyAuthenticatorData(data *authenticatorData) error {
+    want := sha256.Sum256([]byte(rp.ID))
+    if !bytes.Equal(data.rpIDHash, want[:]) {
+        return verificationError("credential is scoped to another relying party")
+    }
+    if data.flags&flagUserPresent == 0 {
+        return verificationError("user presence was not confirmed")
+    }
+    if data.flags&flagUserVerified == 0 {
+        return verificationError("user verification was not performed")
+    }
+    return nil
+}
+
+type authenticatorData struct {
+    rpIDHash     []byte
+    flags        byte
+    signCount    uint32
+    aaguid       []byte
+    credentialID []byte
+    publicKey    []byte
+}
+
+// parseAuthenticatorData splits authenticator data (WebAuthn section 6.1).
+func parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+    if len(raw) < 37 {
+        return nil, verificationError("authenticator data too short")
+    }
+    data := &authenticatorData{
+        rpIDHash:  raw[:32],
+        flags:     raw[32],
+        signCount: binary.BigEndian.Uint32(raw[33:37]),
+    }
+    rest := raw[37:]
+    if data.flags&flagAttestedData != 0 {
+        if len(rest) < 18 {
+            return nil, verificationError("attested credential data too short")
+        }
+        data.aaguid = rest[:16]
+        idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+        rest = rest[18:]
+        if idLen == 0 || idLen > 1023 || len(rest) < idLen {
+            return nil, verificationError("malformed credential id")
+        }
+        data.credentialID = rest[:idLen]
+        rest = rest[idLen:]
+        _, n, err := decodeCBOR(rest)
+        if err != nil {
+            return nil, verificationError("malformed credential public key")
+        }
+        data.publicKey = rest[:n]
+        rest = rest[n:]
+    }
+    if data.flags&flagExtensions != 0 {
+        _, n, err := decodeCBOR(rest)
+        if err != nil {
+            return nil, verificationError("malformed extensions")
+        }
+        rest = rest[n:]
+    }
+    if len(rest) != 0 {
+        return nil, verificationError("trailing authenticator data")
+    }
+    return data, nil
+}
@@ -1,5 +1,6 @@
 import { Injectable, inject } from '@angular/core';
 import { HttpClient } from '@angular/common/http';
+import { getAllPages } from './paging';
 
 export interface Concert {
   id: number;
@@ -15,7 +16,7 @@ export class ConcertsService {
   private readonly baseUrl = 'http://localhost:8080/concerts';
 
   list() {
-    return this.http.get<Concert[]>(this.baseUrl);
+    return getAllPages<Concert>(this.http, this.baseUrl);
   }
 
   get(id: number) {
@@ -0,0 +1,26 @@
+import { HttpClient, HttpParams } from '@angular/common/http';
+import { EMPTY, Observable, expand, reduce } from 'rxjs';
+
+// The largest page the API serves, so that whole lists take few requests.
+const PAGE_LIMIT = 200;
+
+/**
+ * Loads every page of a paginated list, following the X-Next-Cursor header
+ * until the last page.
+ */
+export function getAllPages<T>(http: HttpClient, url: string): Observable<T[]> {
+  const page = (cursor?: string) => {
+    let params = new HttpParams().set('limit', PAGE_LIMIT);
+    if (cursor) {
+      params = params.set('cursor', cursor);
+    }
+    return http.get<T[]>(url, { params, observe: 'response' });
+  };
+  return page().pipe(
+    expand((res) => {
+      const next = res.headers.get('X-Next-Cursor');
+      return next ? page(next) : EMPTY;
+    }),
+    reduce((all, res) => all.concat(res.body ?? []), [] as T[]),
+  );
+}
@@ -1,6 +1,7 @@
 import { Injectable, inject } from '@angular/core';
 import { HttpClient } from '@angular/common/http';
 import { Observable } from 'rxjs';
+import { getAllPages } from './paging';
 
 export interface Song {
   id: number;
@@ -28,7 +29,7 @@ export class SongsService {
   private readonly baseUrl = 'http://localhost:8080';
 
   list(concertId: number): Observable<Song[]> {
-    return this.http.get<Song[]>(`${this.baseUrl}/concerts/${concertId}/songs`);
+    return getAllPages<Song>(this.http, `${this.baseUrl}/concerts/${concertId}/songs`);
   }
 
   create(concertId: number, song: CreateSongRequest): Observable<Song> {